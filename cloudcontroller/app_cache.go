@@ -0,0 +1,165 @@
+package cloudcontroller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
+)
+
+const (
+	lookupQueueSize      = 1024
+	defaultRetryDelay    = time.Second
+	defaultMaxRetryDelay = 5 * time.Minute
+)
+
+type AppFetcher interface {
+	FetchApp(appGUID string) (AppMetadata, error)
+}
+
+type cacheEntry struct {
+	metadata  AppMetadata
+	found     bool
+	expiresAt time.Time
+
+	// failures counts the fetches that failed in a row, and retryAt delays
+	// the next fetch so that an unavailable cloud controller is not asked
+	// for the same GUID on every envelope.
+	failures int
+	retryAt  time.Time
+}
+
+// AppCache resolves app GUIDs from memory and fetches unknown or expired
+// ones in the background, so Lookup never waits on the cloud controller.
+// Entries that were not looked up for a TTL after expiring are evicted.
+type AppCache struct {
+	fetcher       AppFetcher
+	ttl           time.Duration
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+
+	lock     sync.RWMutex
+	entries  map[string]cacheEntry
+	pending  map[string]bool
+	lookups  chan string
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewAppCache(fetcher AppFetcher, ttl time.Duration) *AppCache {
+	return &AppCache{
+		fetcher:       fetcher,
+		ttl:           ttl,
+		retryDelay:    defaultRetryDelay,
+		maxRetryDelay: defaultMaxRetryDelay,
+		entries:       make(map[string]cacheEntry),
+		pending:       make(map[string]bool),
+		lookups:       make(chan string, lookupQueueSize),
+		done:          make(chan struct{}),
+	}
+}
+
+// SetRetryDelays sets how long a GUID that failed to resolve is not
+// fetched again. The delay doubles with every failure, up to maxRetryDelay.
+func (a *AppCache) SetRetryDelays(retryDelay time.Duration, maxRetryDelay time.Duration) {
+	a.retryDelay = retryDelay
+	a.maxRetryDelay = maxRetryDelay
+}
+
+func (a *AppCache) Start() {
+	go a.fetchApps()
+}
+
+func (a *AppCache) Stop() {
+	a.stopOnce.Do(func() {
+		close(a.done)
+	})
+}
+
+func (a *AppCache) Lookup(appGUID string) (AppMetadata, bool) {
+	a.lock.RLock()
+	entry, cached := a.entries[appGUID]
+	a.lock.RUnlock()
+
+	now := time.Now()
+	if (!cached || now.After(entry.expiresAt)) && !now.Before(entry.retryAt) {
+		a.scheduleFetch(appGUID)
+	}
+	return entry.metadata, entry.found
+}
+
+func (a *AppCache) scheduleFetch(appGUID string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.pending[appGUID] {
+		return
+	}
+
+	select {
+	case a.lookups <- appGUID:
+		a.pending[appGUID] = true
+	default:
+		// The queue is full; the GUID is requested again on its next envelope.
+	}
+}
+
+func (a *AppCache) fetchApps() {
+	evictTicker := time.NewTicker(a.ttl)
+	defer evictTicker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case appGUID := <-a.lookups:
+			a.fetchApp(appGUID)
+		case now := <-evictTicker.C:
+			a.evictExpired(now)
+		}
+	}
+}
+
+// evictExpired removes the entries that expired, or could have been
+// retried, more than a TTL ago. Apps that are still sending envelopes are
+// refreshed when they expire and never get that old.
+func (a *AppCache) evictExpired(now time.Time) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for appGUID, entry := range a.entries {
+		if a.pending[appGUID] {
+			continue
+		}
+		if now.After(entry.expiresAt.Add(a.ttl)) && now.After(entry.retryAt.Add(a.ttl)) {
+			delete(a.entries, appGUID)
+		}
+	}
+}
+
+func (a *AppCache) fetchApp(appGUID string) {
+	metadata, err := a.fetcher.FetchApp(appGUID)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.pending, appGUID)
+
+	switch err {
+	case nil:
+		a.entries[appGUID] = cacheEntry{metadata: metadata, found: true, expiresAt: time.Now().Add(a.ttl)}
+	case ErrAppNotFound:
+		a.entries[appGUID] = cacheEntry{expiresAt: time.Now().Add(a.ttl)}
+	default:
+		// keep serving the stale entry, if there is one, until a retry succeeds
+		entry := a.entries[appGUID]
+		delay := a.retryDelay
+		for i := 0; i < entry.failures && delay < a.maxRetryDelay; i++ {
+			delay *= 2
+		}
+		if delay > a.maxRetryDelay {
+			delay = a.maxRetryDelay
+		}
+		entry.failures++
+		entry.retryAt = time.Now().Add(delay)
+		a.entries[appGUID] = entry
+		logger.Warn("Could not look up app", logger.Fields{"app_guid": appGUID, "retry_in": delay, "error": err})
+	}
+}
@@ -0,0 +1,154 @@
+package cloudcontroller_test
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/cloudcontroller"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AppCache", func() {
+	var (
+		fetcher *fakeAppFetcher
+		cache   *cloudcontroller.AppCache
+	)
+
+	BeforeEach(func() {
+		fetcher = &fakeAppFetcher{
+			apps: map[string]cloudcontroller.AppMetadata{
+				"app-guid": {AppName: "my-app", SpaceName: "my-space", OrgName: "my-org"},
+			},
+		}
+		cache = cloudcontroller.NewAppCache(fetcher, time.Hour)
+		cache.SetRetryDelays(time.Millisecond, 10*time.Millisecond)
+		cache.Start()
+	})
+
+	AfterEach(func() {
+		cache.Stop()
+	})
+
+	It("does not block on unknown apps and resolves them in the background", func() {
+		_, found := cache.Lookup("app-guid")
+		Expect(found).To(BeFalse())
+
+		Eventually(func() cloudcontroller.AppMetadata {
+			metadata, _ := cache.Lookup("app-guid")
+			return metadata
+		}).Should(Equal(cloudcontroller.AppMetadata{AppName: "my-app", SpaceName: "my-space", OrgName: "my-org"}))
+	})
+
+	It("serves cached apps without fetching them again", func() {
+		cache.Lookup("app-guid")
+		Eventually(func() bool {
+			_, found := cache.Lookup("app-guid")
+			return found
+		}).Should(BeTrue())
+
+		for i := 0; i < 10; i++ {
+			cache.Lookup("app-guid")
+		}
+		Consistently(fetcher.Calls).Should(Equal(1))
+	})
+
+	It("remembers apps the cloud controller does not know", func() {
+		cache.Lookup("unknown-guid")
+		Eventually(fetcher.Calls).Should(Equal(1))
+
+		_, found := cache.Lookup("unknown-guid")
+		Expect(found).To(BeFalse())
+		Consistently(fetcher.Calls).Should(Equal(1))
+	})
+
+	It("retries apps that failed to resolve", func() {
+		fetcher.SetError(errors.New("cloud controller unavailable"))
+		cache.Lookup("app-guid")
+		Eventually(fetcher.Calls).Should(Equal(1))
+
+		fetcher.SetError(nil)
+		Eventually(func() bool {
+			_, found := cache.Lookup("app-guid")
+			return found
+		}).Should(BeTrue())
+	})
+
+	It("backs off before fetching a failed app again", func() {
+		cache.SetRetryDelays(time.Hour, time.Hour)
+		fetcher.SetError(errors.New("cloud controller unavailable"))
+		cache.Lookup("app-guid")
+		Eventually(fetcher.Calls).Should(Equal(1))
+
+		for i := 0; i < 10; i++ {
+			cache.Lookup("app-guid")
+		}
+		Consistently(fetcher.Calls).Should(Equal(1))
+	})
+
+	Context("when entries expire", func() {
+		BeforeEach(func() {
+			cache.Stop()
+			cache = cloudcontroller.NewAppCache(fetcher, 50*time.Millisecond)
+			cache.Start()
+		})
+
+		It("keeps serving the stale entry while refreshing it", func() {
+			Eventually(func() bool {
+				_, found := cache.Lookup("app-guid")
+				return found
+			}).Should(BeTrue())
+			time.Sleep(60 * time.Millisecond)
+
+			_, found := cache.Lookup("app-guid")
+			Expect(found).To(BeTrue())
+			Eventually(fetcher.Calls).Should(BeNumerically(">=", 2))
+		})
+
+		It("evicts entries that are no longer looked up", func() {
+			Eventually(func() bool {
+				_, found := cache.Lookup("app-guid")
+				return found
+			}).Should(BeTrue())
+			time.Sleep(200 * time.Millisecond)
+
+			_, found := cache.Lookup("app-guid")
+			Expect(found).To(BeFalse())
+		})
+	})
+})
+
+type fakeAppFetcher struct {
+	lock  sync.Mutex
+	apps  map[string]cloudcontroller.AppMetadata
+	err   error
+	calls int
+}
+
+func (f *fakeAppFetcher) FetchApp(appGUID string) (cloudcontroller.AppMetadata, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls++
+	if f.err != nil {
+		return cloudcontroller.AppMetadata{}, f.err
+	}
+	metadata, ok := f.apps[appGUID]
+	if !ok {
+		return cloudcontroller.AppMetadata{}, cloudcontroller.ErrAppNotFound
+	}
+	return metadata, nil
+}
+
+func (f *fakeAppFetcher) SetError(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.err = err
+}
+
+func (f *fakeAppFetcher) Calls() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls
+}
@@ -0,0 +1,130 @@
+package cloudcontroller
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrAppNotFound = errors.New("app not found")
+
+type AuthTokenFetcher interface {
+	FetchAuthToken() string
+}
+
+// tokenExpirer is implemented by token fetchers that know when the last
+// token they fetched expires. The client then refreshes the token shortly
+// before, instead of waiting for the cloud controller to reject it.
+type tokenExpirer interface {
+	TokenExpiry() time.Time
+}
+
+const tokenRefreshMargin = 30 * time.Second
+
+type AppMetadata struct {
+	AppName   string
+	SpaceName string
+	OrgName   string
+}
+
+type Client struct {
+	apiURL       string
+	tokenFetcher AuthTokenFetcher
+	httpClient   *http.Client
+
+	lock      sync.Mutex
+	authToken string
+}
+
+func NewClient(apiURL string, insecureSSLSkipVerify bool, tokenFetcher AuthTokenFetcher) *Client {
+	return &Client{
+		apiURL:       strings.TrimRight(apiURL, "/"),
+		tokenFetcher: tokenFetcher,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSSLSkipVerify},
+			},
+		},
+	}
+}
+
+func (c *Client) FetchApp(appGUID string) (AppMetadata, error) {
+	resp, err := c.get(fmt.Sprintf("/v2/apps/%s?inline-relations-depth=2", appGUID), false)
+	if err != nil {
+		return AppMetadata{}, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		resp, err = c.get(fmt.Sprintf("/v2/apps/%s?inline-relations-depth=2", appGUID), true)
+		if err != nil {
+			return AppMetadata{}, err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return AppMetadata{}, ErrAppNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return AppMetadata{}, fmt.Errorf("cloud controller request for app %s returned HTTP response: %v", appGUID, resp.StatusCode)
+	}
+
+	var app appResource
+	if err := json.NewDecoder(resp.Body).Decode(&app); err != nil {
+		return AppMetadata{}, fmt.Errorf("Can not parse cloud controller response for app %s: %s", appGUID, err)
+	}
+	return AppMetadata{
+		AppName:   app.Entity.Name,
+		SpaceName: app.Entity.Space.Entity.Name,
+		OrgName:   app.Entity.Space.Entity.Organization.Entity.Name,
+	}, nil
+}
+
+func (c *Client) get(path string, refreshToken bool) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.apiURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", c.token(refreshToken))
+	return c.httpClient.Do(req)
+}
+
+func (c *Client) token(refresh bool) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.authToken == "" || refresh || c.tokenExpiring() {
+		c.authToken = c.tokenFetcher.FetchAuthToken()
+	}
+	return c.authToken
+}
+
+func (c *Client) tokenExpiring() bool {
+	expirer, ok := c.tokenFetcher.(tokenExpirer)
+	if !ok {
+		return false
+	}
+	expiry := expirer.TokenExpiry()
+	return !expiry.IsZero() && time.Now().Add(tokenRefreshMargin).After(expiry)
+}
+
+type appResource struct {
+	Entity struct {
+		Name  string `json:"name"`
+		Space struct {
+			Entity struct {
+				Name         string `json:"name"`
+				Organization struct {
+					Entity struct {
+						Name string `json:"name"`
+					} `json:"entity"`
+				} `json:"organization"`
+			} `json:"entity"`
+		} `json:"space"`
+	} `json:"entity"`
+}
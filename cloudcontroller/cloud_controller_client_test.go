@@ -0,0 +1,93 @@
+package cloudcontroller_test
+
+import (
+	"time"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/cloudcontroller"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/testhelpers"
+)
+
+type expiringTokenFetcher struct {
+	testhelpers.FakeTokenFetcher
+	expiry time.Time
+}
+
+func (f *expiringTokenFetcher) TokenExpiry() time.Time {
+	return f.expiry
+}
+
+var _ = Describe("CloudController Client", func() {
+	var (
+		fakeCC       *testhelpers.FakeCloudController
+		tokenFetcher *testhelpers.FakeTokenFetcher
+		client       *cloudcontroller.Client
+	)
+
+	BeforeEach(func() {
+		fakeCC = testhelpers.NewFakeCloudController("auth token")
+		fakeCC.AddApp("app-guid", "my-app", "my-space", "my-org")
+		fakeCC.Start()
+
+		tokenFetcher = &testhelpers.FakeTokenFetcher{}
+		client = cloudcontroller.NewClient(fakeCC.URL(), false, tokenFetcher)
+	})
+
+	AfterEach(func() {
+		fakeCC.Close()
+	})
+
+	It("resolves the app, space and org names of an app", func() {
+		metadata, err := client.FetchApp("app-guid")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(metadata).To(Equal(cloudcontroller.AppMetadata{
+			AppName:   "my-app",
+			SpaceName: "my-space",
+			OrgName:   "my-org",
+		}))
+		Expect(fakeCC.LastAuthorization()).To(Equal("auth token"))
+	})
+
+	It("reuses the auth token between requests", func() {
+		_, err := client.FetchApp("app-guid")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.FetchApp("app-guid")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(tokenFetcher.NumCalls).To(Equal(1))
+	})
+
+	It("refreshes the token before it expires", func() {
+		expiring := &expiringTokenFetcher{expiry: time.Now().Add(time.Hour)}
+		client = cloudcontroller.NewClient(fakeCC.URL(), false, expiring)
+		_, err := client.FetchApp("app-guid")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.FetchApp("app-guid")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(expiring.NumCalls).To(Equal(1))
+
+		expiring.expiry = time.Now().Add(10 * time.Second)
+		_, err = client.FetchApp("app-guid")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(expiring.NumCalls).To(Equal(2))
+	})
+
+	It("returns ErrAppNotFound for unknown apps", func() {
+		_, err := client.FetchApp("unknown-guid")
+		Expect(err).To(Equal(cloudcontroller.ErrAppNotFound))
+	})
+
+	It("refetches the token once when the cloud controller rejects it", func() {
+		fakeCC.Close()
+		fakeCC = testhelpers.NewFakeCloudController("another token")
+		fakeCC.Start()
+		client = cloudcontroller.NewClient(fakeCC.URL(), false, tokenFetcher)
+
+		_, err := client.FetchApp("app-guid")
+		Expect(err).To(MatchError(ContainSubstring("returned HTTP response: 401")))
+		Expect(tokenFetcher.NumCalls).To(Equal(2))
+		Expect(fakeCC.Requests()).To(Equal(2))
+	})
+})
@@ -0,0 +1,19 @@
+package cloudcontroller_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestCloudController(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CloudController Suite")
+}
+
+var _ = BeforeSuite(func() {
+	log.SetOutput(ioutil.Discard)
+})
@@ -0,0 +1,196 @@
+package configcheck
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/nozzleconfig"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/uaatokenfetcher"
+)
+
+// Result is the outcome of checking that the nozzle can reach one of the
+// services in its configuration.
+type Result struct {
+	Name   string
+	Target string
+	Err    error
+}
+
+// CheckConnectivity tries to reach the UAA, the envelope source and every
+// output the nozzle would use, giving up on each after timeout.
+func CheckConnectivity(config *nozzleconfig.NozzleConfig, timeout time.Duration) []Result {
+	var results []Result
+	add := func(name string, target string, err error) {
+		results = append(results, Result{Name: name, Target: target, Err: err})
+	}
+	insecureTLS := &tls.Config{InsecureSkipVerify: config.InsecureSSLSkipVerify}
+
+	switch config.Input {
+	case "", nozzleconfig.FirehoseInput, nozzleconfig.RLPGatewayInput:
+		if !config.DisableAccessControl {
+			add("UAA", config.UAAURL, checkUAA(config))
+		}
+		if config.Input == nozzleconfig.RLPGatewayInput {
+			add("RLP gateway", config.RLPGatewayURL, dialURL(config.RLPGatewayURL, insecureTLS, timeout))
+		} else {
+			add("Traffic controller", config.TrafficControllerURL, dialURL(config.TrafficControllerURL, insecureTLS, timeout))
+		}
+	}
+	if config.CloudControllerURL != "" {
+		add("Cloud controller", config.CloudControllerURL, dialURL(config.CloudControllerURL, insecureTLS, timeout))
+	}
+
+	if config.DryRun {
+		return results
+	}
+	outputs := config.Outputs
+	if len(outputs) == 0 {
+		outputs = []nozzleconfig.OutputConfig{config.PrimaryOutput()}
+	}
+	for _, output := range outputs {
+		results = append(results, checkOutput(output, timeout)...)
+	}
+	return results
+}
+
+func checkUAA(config *nozzleconfig.NozzleConfig) error {
+	fetcher := &uaatokenfetcher.UAATokenFetcher{
+		UaaUrl:                config.UAAURL,
+		Username:              config.Username,
+		Password:              config.Password,
+		ClientID:              config.UAAClientID,
+		ClientSecret:          config.UAAClientSecret,
+		Scopes:                config.UAAScopes,
+		InsecureSSLSkipVerify: config.InsecureSSLSkipVerify,
+	}
+	_, err := fetcher.TryFetchAuthToken()
+	return err
+}
+
+func checkOutput(output nozzleconfig.OutputConfig, timeout time.Duration) []Result {
+	name := output.Name
+	if name == "" {
+		name = output.Type
+	}
+
+	switch output.Type {
+	case "", nozzleconfig.OpenTSDBOutput:
+		urls := output.OpenTSDBURLs
+		if len(urls) == 0 {
+			urls = []string{output.OpenTSDBURL}
+		}
+		var results []Result
+		for _, tsdURL := range urls {
+			results = append(results, Result{Name: "OpenTSDB " + name, Target: tsdURL, Err: checkOpenTSDB(output, tsdURL, timeout)})
+		}
+		return results
+	case nozzleconfig.GraphiteOutput:
+		return []Result{{Name: "Graphite " + name, Target: output.GraphiteAddress, Err: dial(output.GraphiteAddress, nil, timeout)}}
+	case nozzleconfig.InfluxDBOutput:
+		if strings.HasPrefix(output.InfluxDBURL, "udp://") {
+			// UDP is connectionless, there is nothing to check
+			return nil
+		}
+		client := &http.Client{Timeout: timeout}
+		return []Result{{Name: "InfluxDB " + name, Target: output.InfluxDBURL, Err: get(client, strings.TrimRight(output.InfluxDBURL, "/")+"/ping")}}
+	case nozzleconfig.RemoteWriteOutput:
+		return []Result{{Name: "Remote write " + name, Target: output.RemoteWriteURL, Err: checkRemoteWrite(output, timeout)}}
+	default:
+		return nil
+	}
+}
+
+// checkOpenTSDB requests /api/version over HTTP, which also checks the TLS
+// settings and credentials, or connects to the telnet API.
+func checkOpenTSDB(output nozzleconfig.OutputConfig, tsdURL string, timeout time.Duration) error {
+	if output.UseTelnetAPI {
+		tlsConfig, err := output.TelnetTLSConfig()
+		if err != nil {
+			return err
+		}
+		return dial(tsdURL, tlsConfig, timeout)
+	}
+
+	clientConfig := output.HTTPClientConfig()
+	clientConfig.RequestTimeout = timeout
+	client, err := poster.NewHTTPClient(clientConfig)
+	if err != nil {
+		return err
+	}
+	return get(client, poster.VersionURL(tsdURL, false))
+}
+
+// checkRemoteWrite sends an empty write request with the output's HTTP
+// client, which checks the TLS settings and credentials like checkOpenTSDB.
+func checkRemoteWrite(output nozzleconfig.OutputConfig, timeout time.Duration) error {
+	clientConfig := output.HTTPClientConfig()
+	clientConfig.RequestTimeout = timeout
+	client, err := poster.NewHTTPClient(clientConfig)
+	if err != nil {
+		return err
+	}
+	remoteWritePoster := poster.NewRemoteWritePoster(output.RemoteWriteURL)
+	remoteWritePoster.SetHTTPClient(client)
+	return remoteWritePoster.Check()
+}
+
+func get(client *http.Client, target string) error {
+	resp, err := client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("GET %s returned HTTP response: %d", target, resp.StatusCode)
+	}
+	return nil
+}
+
+// dialURL connects to the host of rawURL, over TLS for wss and https.
+func dialURL(rawURL string, tlsConfig *tls.Config, timeout time.Duration) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	address := parsed.Host
+	secure := parsed.Scheme == "wss" || parsed.Scheme == "https"
+	if parsed.Port() == "" {
+		if secure {
+			address = net.JoinHostPort(parsed.Hostname(), "443")
+		} else {
+			address = net.JoinHostPort(parsed.Hostname(), "80")
+		}
+	}
+	if !secure {
+		tlsConfig = nil
+	} else if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	return dial(address, tlsConfig, timeout)
+}
+
+func dial(address string, tlsConfig *tls.Config, timeout time.Duration) error {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,19 @@
+package configcheck_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestConfigcheck(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Configcheck Suite")
+}
+
+var _ = BeforeSuite(func() {
+	log.SetOutput(ioutil.Discard)
+})
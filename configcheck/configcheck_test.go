@@ -0,0 +1,126 @@
+package configcheck_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/configcheck"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/nozzleconfig"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/testhelpers"
+)
+
+var _ = Describe("CheckConnectivity", func() {
+	var fakeUAA *testhelpers.FakeUAA
+	var trafficController *httptest.Server
+	var openTSDB *httptest.Server
+	var versionStatus int
+	var authorization string
+	var config *nozzleconfig.NozzleConfig
+
+	BeforeEach(func() {
+		fakeUAA = testhelpers.NewFakeUAA("bearer", "123456789")
+		fakeUAA.Start()
+		trafficController = httptest.NewServer(http.NotFoundHandler())
+		versionStatus = http.StatusOK
+		openTSDB = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			authorization = r.Header.Get("Authorization")
+			if r.URL.Path != "/api/version" {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			rw.WriteHeader(versionStatus)
+		}))
+
+		config = &nozzleconfig.NozzleConfig{
+			UAAURL:               fakeUAA.URL(),
+			Username:             "nozzle",
+			Password:             "secret",
+			TrafficControllerURL: strings.Replace(trafficController.URL, "http://", "ws://", 1),
+			OpenTSDBURL:          openTSDB.URL,
+			OpenTSDBBearerToken:  "tsd-token",
+		}
+	})
+
+	AfterEach(func() {
+		fakeUAA.Close()
+		trafficController.Close()
+		openTSDB.Close()
+	})
+
+	errs := func(results []configcheck.Result) []error {
+		var errs []error
+		for _, result := range results {
+			errs = append(errs, result.Err)
+		}
+		return errs
+	}
+
+	It("reaches the UAA, the traffic controller and OpenTSDB", func() {
+		results := configcheck.CheckConnectivity(config, time.Second)
+
+		Expect(results).To(HaveLen(3))
+		Expect(results[0].Name).To(Equal("UAA"))
+		Expect(results[1].Name).To(Equal("Traffic controller"))
+		Expect(results[2].Name).To(Equal("OpenTSDB opentsdb"))
+		Expect(results[2].Target).To(Equal(openTSDB.URL))
+		Expect(errs(results)).To(Equal([]error{nil, nil, nil}))
+		Expect(authorization).To(Equal("Bearer tsd-token"))
+	})
+
+	It("reports the services that can not be reached", func() {
+		trafficController.Close()
+		versionStatus = http.StatusUnauthorized
+
+		results := configcheck.CheckConnectivity(config, time.Second)
+
+		Expect(results[0].Err).NotTo(HaveOccurred())
+		Expect(results[1].Err).To(HaveOccurred())
+		Expect(results[2].Err).To(MatchError("GET " + openTSDB.URL + "/api/version returned HTTP response: 401"))
+	})
+
+	It("connects to the telnet API and every configured output", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+
+		config.DisableAccessControl = true
+		config.Outputs = []nozzleconfig.OutputConfig{
+			{Name: "telnet", Type: "opentsdb", OpenTSDBURL: listener.Addr().String(), UseTelnetAPI: true},
+			{Name: "carbon", Type: "graphite", GraphiteAddress: trafficController.Listener.Addr().String()},
+			{Name: "influx", Type: "influxdb", InfluxDBURL: "udp://127.0.0.1:8089"},
+		}
+		results := configcheck.CheckConnectivity(config, time.Second)
+
+		Expect(results).To(HaveLen(3))
+		Expect(results[1].Name).To(Equal("OpenTSDB telnet"))
+		Expect(results[2].Name).To(Equal("Graphite carbon"))
+		Expect(errs(results)).To(Equal([]error{nil, nil, nil}))
+	})
+
+	It("sends an authenticated empty write request to remote write outputs", func() {
+		receiver := testhelpers.NewFakeRemoteWriteReceiver()
+		receiver.Start()
+		defer receiver.Close()
+
+		config.DisableAccessControl = true
+		config.Outputs = []nozzleconfig.OutputConfig{
+			{Name: "prometheus", Type: "prometheus-remote-write", RemoteWriteURL: receiver.URL(), OpenTSDBBearerToken: "writer-token"},
+		}
+		results := configcheck.CheckConnectivity(config, time.Second)
+
+		Expect(results[1].Name).To(Equal("Remote write prometheus"))
+		Expect(results[1].Err).NotTo(HaveOccurred())
+		Expect(receiver.Headers()[0].Get("Authorization")).To(Equal("Bearer writer-token"))
+		Expect(receiver.Requests()[0].Timeseries).To(BeEmpty())
+
+		receiver.RespondWith(http.StatusUnauthorized)
+		results = configcheck.CheckConnectivity(config, time.Second)
+		Expect(results[1].Err).To(MatchError(ContainSubstring("remote write returned HTTP response: 401")))
+		Expect(receiver.Attempts()).To(Equal(2))
+	})
+})
@@ -0,0 +1,38 @@
+package envelopesource
+
+import (
+	"errors"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// ErrSourceExhausted is sent on the error channel by sources that have a
+// natural end, such as a file replay, once every envelope was delivered.
+var ErrSourceExhausted = errors.New("envelope source exhausted")
+
+// FatalError is sent on the error channel by sources that can not go on,
+// such as a file replay that hit a corrupt record. Reconnecting would only
+// deliver the same envelopes again.
+type FatalError struct {
+	Err error
+}
+
+func (e *FatalError) Error() string {
+	return e.Err.Error()
+}
+
+type EnvelopeSource interface {
+	Connect() (<-chan *events.Envelope, <-chan error)
+	Close() error
+}
+
+type AuthTokenFetcher interface {
+	FetchAuthToken() string
+}
+
+func fetchAuthToken(tokenFetcher AuthTokenFetcher) string {
+	if tokenFetcher == nil {
+		return ""
+	}
+	return tokenFetcher.FetchAuthToken()
+}
@@ -0,0 +1,19 @@
+package envelopesource_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestEnvelopeSource(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "EnvelopeSource Suite")
+}
+
+var _ = BeforeSuite(func() {
+	log.SetOutput(ioutil.Discard)
+})
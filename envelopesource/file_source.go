@@ -0,0 +1,179 @@
+package envelopesource
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+const maxRecordSize = 16 * 1024 * 1024
+
+// WriteEnvelope appends an envelope to w as a uvarint length followed by
+// the protobuf encoded envelope, the format FileSource reads.
+func WriteEnvelope(w io.Writer, envelope *events.Envelope) error {
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(data)))
+	if _, err := w.Write(length[:n]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func ReadEnvelope(r *bufio.Reader) (*events.Envelope, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxRecordSize {
+		return nil, fmt.Errorf("envelope record of %d bytes exceeds the maximum of %d bytes", length, maxRecordSize)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	envelope := &events.Envelope{}
+	if err := proto.Unmarshal(data, envelope); err != nil {
+		return nil, err
+	}
+	return envelope, nil
+}
+
+type FileSource struct {
+	path              string
+	realTime          bool
+	rewriteTimestamps bool
+
+	lock sync.Mutex
+	done chan struct{}
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path}
+}
+
+// SetRealTime paces the replay by the recorded envelope timestamps instead
+// of sending the envelopes as fast as they are consumed.
+func (f *FileSource) SetRealTime(realTime bool) {
+	f.realTime = realTime
+}
+
+// SetRewriteTimestamps shifts the envelope timestamps so that the first
+// recorded envelope is stamped with the time the replay started.
+func (f *FileSource) SetRewriteTimestamps(rewriteTimestamps bool) {
+	f.rewriteTimestamps = rewriteTimestamps
+}
+
+func (f *FileSource) Connect() (<-chan *events.Envelope, <-chan error) {
+	messages := make(chan *events.Envelope)
+	errs := make(chan error, 1)
+
+	done := make(chan struct{})
+	f.lock.Lock()
+	f.done = done
+	f.lock.Unlock()
+
+	go func() {
+		file, err := os.Open(f.path)
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer file.Close()
+
+		reader := bufio.NewReader(file)
+		var clock replayClock
+		for {
+			envelope, err := ReadEnvelope(reader)
+			if err == io.EOF {
+				errs <- ErrSourceExhausted
+				return
+			}
+			if err != nil {
+				errs <- &FatalError{Err: fmt.Errorf("Can not read envelope from %s: %s", f.path, err)}
+				return
+			}
+
+			recorded := envelope.GetTimestamp()
+			clock.observe(recorded)
+			if f.realTime && !clock.wait(recorded, done) {
+				return
+			}
+			if f.rewriteTimestamps {
+				envelope.Timestamp = proto.Int64(clock.rewrite(recorded))
+			}
+
+			select {
+			case messages <- envelope:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return messages, errs
+}
+
+func (f *FileSource) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.done != nil {
+		close(f.done)
+		f.done = nil
+	}
+	return nil
+}
+
+// replayClock maps recorded envelope timestamps onto the wall clock, taking
+// the first envelope of the file as the start of the replay.
+type replayClock struct {
+	started        bool
+	start          time.Time
+	firstTimestamp int64
+}
+
+func (c *replayClock) observe(timestamp int64) {
+	if !c.started {
+		c.started = true
+		c.start = time.Now()
+		c.firstTimestamp = timestamp
+	}
+}
+
+func (c *replayClock) rewrite(timestamp int64) int64 {
+	return c.start.UnixNano() + timestamp - c.firstTimestamp
+}
+
+// wait sleeps until the envelope is due and reports false when the replay
+// was closed in the meantime.
+func (c *replayClock) wait(timestamp int64, done <-chan struct{}) bool {
+	delay := time.Duration(timestamp-c.firstTimestamp) - time.Since(c.start)
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
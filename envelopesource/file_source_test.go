@@ -0,0 +1,155 @@
+package envelopesource_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/envelopesource"
+)
+
+func valueMetric(name string, value float64) *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String("origin"),
+		Timestamp: proto.Int64(1000000000),
+		EventType: events.Envelope_ValueMetric.Enum(),
+		ValueMetric: &events.ValueMetric{
+			Name:  proto.String(name),
+			Value: proto.Float64(value),
+			Unit:  proto.String("gauge"),
+		},
+	}
+}
+
+var _ = Describe("FileSource", func() {
+	var dir string
+	var path string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "envelopesource")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "envelopes.bin")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	writeEnvelopes := func(envelopes ...*events.Envelope) {
+		file, err := os.Create(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer file.Close()
+		for _, envelope := range envelopes {
+			Expect(envelopesource.WriteEnvelope(file, envelope)).To(Succeed())
+		}
+	}
+
+	It("replays the recorded envelopes in order and reports exhaustion", func() {
+		writeEnvelopes(valueMetric("first", 1), valueMetric("second", 2))
+		source := envelopesource.NewFileSource(path)
+		defer source.Close()
+
+		messages, errs := source.Connect()
+
+		var envelope *events.Envelope
+		Eventually(messages).Should(Receive(&envelope))
+		Expect(envelope.GetValueMetric().GetName()).To(Equal("first"))
+		Eventually(messages).Should(Receive(&envelope))
+		Expect(envelope.GetValueMetric().GetName()).To(Equal("second"))
+		Expect(envelope.GetValueMetric().GetValue()).To(Equal(2.0))
+		Eventually(errs).Should(Receive(Equal(envelopesource.ErrSourceExhausted)))
+	})
+
+	It("reports truncated records as fatal, so that the replay is not repeated", func() {
+		writeEnvelopes(valueMetric("first", 1))
+		info, err := os.Stat(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.Truncate(path, info.Size()-1)).To(Succeed())
+
+		source := envelopesource.NewFileSource(path)
+		defer source.Close()
+		_, errs := source.Connect()
+
+		var received error
+		Eventually(errs).Should(Receive(&received))
+		Expect(received.Error()).To(ContainSubstring("unexpected EOF"))
+		Expect(received).To(BeAssignableToTypeOf(&envelopesource.FatalError{}))
+	})
+
+	It("reports a missing file", func() {
+		source := envelopesource.NewFileSource(filepath.Join(dir, "missing.bin"))
+		_, errs := source.Connect()
+
+		var received error
+		Eventually(errs).Should(Receive(&received))
+		Expect(os.IsNotExist(received)).To(BeTrue())
+	})
+
+	Context("when pacing the replay in real time", func() {
+		It("waits for the recorded interval between envelopes", func() {
+			second := valueMetric("second", 2)
+			second.Timestamp = proto.Int64(1000000000 + int64(300*time.Millisecond))
+			writeEnvelopes(valueMetric("first", 1), second)
+
+			source := envelopesource.NewFileSource(path)
+			source.SetRealTime(true)
+			defer source.Close()
+			messages, _ := source.Connect()
+
+			Eventually(messages).Should(Receive())
+			Consistently(messages, 200*time.Millisecond).ShouldNot(Receive())
+			Eventually(messages).Should(Receive())
+		})
+	})
+
+	Context("when rewriting timestamps", func() {
+		It("shifts the recording to the start of the replay", func() {
+			second := valueMetric("second", 2)
+			second.Timestamp = proto.Int64(1000000000 + int64(time.Minute))
+			writeEnvelopes(valueMetric("first", 1), second)
+
+			source := envelopesource.NewFileSource(path)
+			source.SetRewriteTimestamps(true)
+			defer source.Close()
+			start := time.Now().UnixNano()
+			messages, _ := source.Connect()
+
+			var first, last *events.Envelope
+			Eventually(messages).Should(Receive(&first))
+			Eventually(messages).Should(Receive(&last))
+			Expect(first.GetTimestamp()).To(BeNumerically(">=", start))
+			Expect(first.GetTimestamp()).To(BeNumerically("<", time.Now().UnixNano()))
+			Expect(last.GetTimestamp() - first.GetTimestamp()).To(Equal(int64(time.Minute)))
+		})
+	})
+})
+
+var _ = Describe("Recorder", func() {
+	It("records envelopes that the file source replays", func() {
+		dir, err := ioutil.TempDir("", "envelopesource")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "recording.bin")
+
+		recorder, err := envelopesource.NewRecorder(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(recorder.Record(valueMetric("recorded", 3))).To(Succeed())
+		Expect(recorder.Close()).To(Succeed())
+
+		source := envelopesource.NewFileSource(path)
+		defer source.Close()
+		messages, errs := source.Connect()
+
+		var envelope *events.Envelope
+		Eventually(messages).Should(Receive(&envelope))
+		Expect(envelope.GetValueMetric().GetName()).To(Equal("recorded"))
+		Expect(envelope.GetTimestamp()).To(Equal(int64(1000000000)))
+		Eventually(errs).Should(Receive(Equal(envelopesource.ErrSourceExhausted)))
+	})
+})
@@ -0,0 +1,44 @@
+package envelopesource
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/cloudfoundry/noaa/consumer"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+type FirehoseSource struct {
+	trafficControllerURL string
+	subscriptionID       string
+	tlsConfig            *tls.Config
+	idleTimeout          time.Duration
+	tokenFetcher         AuthTokenFetcher
+	consumer             *consumer.Consumer
+}
+
+// NewFirehoseSource consumes the V1 firehose. A nil tokenFetcher connects
+// without an auth token, for deployments with access control disabled.
+func NewFirehoseSource(trafficControllerURL string, subscriptionID string, insecureSSLSkipVerify bool, idleTimeout time.Duration, tokenFetcher AuthTokenFetcher) *FirehoseSource {
+	return &FirehoseSource{
+		trafficControllerURL: trafficControllerURL,
+		subscriptionID:       subscriptionID,
+		tlsConfig:            &tls.Config{InsecureSkipVerify: insecureSSLSkipVerify},
+		idleTimeout:          idleTimeout,
+		tokenFetcher:         tokenFetcher,
+	}
+}
+
+func (f *FirehoseSource) Connect() (<-chan *events.Envelope, <-chan error) {
+	authToken := fetchAuthToken(f.tokenFetcher)
+	f.consumer = consumer.New(f.trafficControllerURL, f.tlsConfig, nil)
+	f.consumer.SetIdleTimeout(f.idleTimeout)
+	return f.consumer.Firehose(f.subscriptionID, authToken)
+}
+
+func (f *FirehoseSource) Close() error {
+	if f.consumer == nil {
+		return nil
+	}
+	return f.consumer.Close()
+}
@@ -0,0 +1,70 @@
+package envelopesource
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// GeneratorSource emits a fixed list of envelopes on every connect and then
+// stays connected until it is closed or told to fail.
+type GeneratorSource struct {
+	envelopes []*events.Envelope
+
+	lock     sync.Mutex
+	connects int
+	errs     chan error
+	done     chan struct{}
+}
+
+func NewGeneratorSource(envelopes ...*events.Envelope) *GeneratorSource {
+	return &GeneratorSource{envelopes: envelopes}
+}
+
+func (g *GeneratorSource) Connect() (<-chan *events.Envelope, <-chan error) {
+	messages := make(chan *events.Envelope)
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+
+	g.lock.Lock()
+	g.connects++
+	g.errs = errs
+	g.done = done
+	g.lock.Unlock()
+
+	go func() {
+		for _, envelope := range g.envelopes {
+			select {
+			case messages <- envelope:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return messages, errs
+}
+
+func (g *GeneratorSource) Fail(err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.errs != nil {
+		g.errs <- err
+	}
+}
+
+func (g *GeneratorSource) Connects() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.connects
+}
+
+func (g *GeneratorSource) Close() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.done != nil {
+		close(g.done)
+		g.done = nil
+		g.errs = nil
+	}
+	return nil
+}
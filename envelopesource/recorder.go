@@ -0,0 +1,49 @@
+package envelopesource
+
+import (
+	"bufio"
+	"os"
+	"sync"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// Recorder appends envelopes to a file in the format FileSource replays.
+type Recorder struct {
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+func (r *Recorder) Record(envelope *events.Envelope) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return WriteEnvelope(r.writer, envelope)
+}
+
+func (r *Recorder) Flush() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.writer.Flush()
+}
+
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.writer.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,32 @@
+package envelopesource
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/rlpgateway"
+)
+
+type RLPGatewaySource struct {
+	shardID      string
+	tokenFetcher AuthTokenFetcher
+	client       *rlpgateway.Client
+}
+
+func NewRLPGatewaySource(gatewayURL string, shardID string, selectors []string, insecureSSLSkipVerify bool, idleTimeout time.Duration, tokenFetcher AuthTokenFetcher) *RLPGatewaySource {
+	client := rlpgateway.NewClient(gatewayURL, insecureSSLSkipVerify, selectors)
+	client.SetIdleTimeout(idleTimeout)
+	return &RLPGatewaySource{
+		shardID:      shardID,
+		tokenFetcher: tokenFetcher,
+		client:       client,
+	}
+}
+
+func (r *RLPGatewaySource) Connect() (<-chan *events.Envelope, <-chan error) {
+	return r.client.Stream(r.shardID, fetchAuthToken(r.tokenFetcher))
+}
+
+func (r *RLPGatewaySource) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,90 @@
+package envelopesource
+
+import (
+	"net"
+	"sync"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
+)
+
+const maxDatagramSize = 65507
+
+// UDPSource listens for dropsonde envelopes, one protobuf encoded envelope
+// per datagram, the way metron agents receive them.
+type UDPSource struct {
+	address string
+
+	lock sync.Mutex
+	conn net.PacketConn
+	done chan struct{}
+}
+
+func NewUDPSource(address string) *UDPSource {
+	return &UDPSource{address: address}
+}
+
+func (u *UDPSource) Connect() (<-chan *events.Envelope, <-chan error) {
+	messages := make(chan *events.Envelope)
+	errs := make(chan error, 1)
+
+	conn, err := net.ListenPacket("udp", u.address)
+	if err != nil {
+		errs <- err
+		return messages, errs
+	}
+	done := make(chan struct{})
+	u.lock.Lock()
+	u.conn = conn
+	u.done = done
+	u.lock.Unlock()
+
+	go func() {
+		buffer := make([]byte, maxDatagramSize)
+		for {
+			n, _, err := conn.ReadFrom(buffer)
+			if err != nil {
+				select {
+				case <-done:
+				default:
+					errs <- err
+				}
+				return
+			}
+
+			envelope := &events.Envelope{}
+			if err := proto.Unmarshal(buffer[:n], envelope); err != nil {
+				logger.Warn("Could not unmarshal dropsonde envelope", logger.Fields{"error": err})
+				continue
+			}
+			select {
+			case messages <- envelope:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return messages, errs
+}
+
+func (u *UDPSource) Addr() net.Addr {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.conn == nil {
+		return nil
+	}
+	return u.conn.LocalAddr()
+}
+
+func (u *UDPSource) Close() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.done == nil {
+		return nil
+	}
+	close(u.done)
+	u.done = nil
+	return u.conn.Close()
+}
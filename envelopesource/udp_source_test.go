@@ -0,0 +1,55 @@
+package envelopesource_test
+
+import (
+	"net"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/envelopesource"
+)
+
+var _ = Describe("UDPSource", func() {
+	var source *envelopesource.UDPSource
+	var messages <-chan *events.Envelope
+	var conn net.Conn
+
+	BeforeEach(func() {
+		source = envelopesource.NewUDPSource("127.0.0.1:0")
+		messages, _ = source.Connect()
+
+		var err error
+		conn, err = net.Dial("udp", source.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		source.Close()
+	})
+
+	It("receives one envelope per datagram", func() {
+		data, err := proto.Marshal(valueMetric("udp", 5))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = conn.Write(data)
+		Expect(err).ToNot(HaveOccurred())
+
+		var envelope *events.Envelope
+		Eventually(messages).Should(Receive(&envelope))
+		Expect(envelope.GetValueMetric().GetName()).To(Equal("udp"))
+	})
+
+	It("skips datagrams that are not envelopes", func() {
+		_, err := conn.Write([]byte{0xff, 0xff, 0xff})
+		Expect(err).ToNot(HaveOccurred())
+		data, err := proto.Marshal(valueMetric("valid", 1))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = conn.Write(data)
+		Expect(err).ToNot(HaveOccurred())
+
+		var envelope *events.Envelope
+		Eventually(messages).Should(Receive(&envelope))
+		Expect(envelope.GetValueMetric().GetName()).To(Equal("valid"))
+	})
+})
@@ -0,0 +1,110 @@
+package fanout
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/opentsdbclient"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+)
+
+// FanOut is a poster that hands every batch to several outputs, each
+// posting asynchronously from its own queue.
+type FanOut struct {
+	outputs  []*Output
+	blocking bool
+	wg       sync.WaitGroup
+}
+
+func New(outputs ...*Output) *FanOut {
+	f := &FanOut{outputs: outputs}
+	for _, output := range outputs {
+		output.queue = make(chan []poster.Metric, output.queueSize)
+		f.wg.Add(1)
+		go func(output *Output) {
+			defer f.wg.Done()
+			output.run()
+		}(output)
+	}
+	return f
+}
+
+// SetBlocking makes the fan-out hold back the nozzle instead of dropping
+// metrics, for the block overflow policy: outputs retry failed batches
+// until they are closed, and Post refuses a batch, without queueing it
+// anywhere, while any output's queue is full. It must be called before the
+// first Post.
+func (f *FanOut) SetBlocking(blocking bool) {
+	f.blocking = blocking
+	for _, output := range f.outputs {
+		output.blocking = blocking
+	}
+}
+
+// Post queues the metrics on every output. It only fails when an output's
+// queue is full; backend errors are retried and counted per output.
+func (f *FanOut) Post(metrics []poster.Metric) error {
+	if f.blocking {
+		for _, output := range f.outputs {
+			if output.queueFull() {
+				return fmt.Errorf("queue of output %s is full, keeping %d metrics", output.name, len(metrics))
+			}
+		}
+	}
+
+	var failures []string
+	for _, output := range f.outputs {
+		if err := output.enqueue(metrics); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Outputs returns the outputs in the order they were given to New.
+func (f *FanOut) Outputs() []*Output {
+	return f.outputs
+}
+
+func (f *FanOut) OutputStats() []opentsdbclient.OutputStats {
+	stats := make([]opentsdbclient.OutputStats, 0, len(f.outputs))
+	for _, output := range f.outputs {
+		stats = append(stats, output.Stats())
+	}
+	return stats
+}
+
+// BytesSent adds up the bytes sent by the outputs whose posters count them.
+func (f *FanOut) BytesSent() (uncompressed uint64, compressed uint64) {
+	for _, output := range f.outputs {
+		if reporter, ok := output.poster.(opentsdbclient.BytesSentReporter); ok {
+			outputUncompressed, outputCompressed := reporter.BytesSent()
+			uncompressed += outputUncompressed
+			compressed += outputCompressed
+		}
+	}
+	return uncompressed, compressed
+}
+
+// Close waits for the queued batches to be posted and closes the posters
+// that hold connections. Blocking outputs give up on failing batches.
+func (f *FanOut) Close() error {
+	for _, output := range f.outputs {
+		close(output.stop)
+		close(output.queue)
+	}
+	f.wg.Wait()
+
+	for _, output := range f.outputs {
+		if closer, ok := output.poster.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package fanout_test
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/fanout"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/opentsdbclient"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+)
+
+type fakePoster struct {
+	lock     sync.Mutex
+	posted   [][]poster.Metric
+	failures int
+	block    chan struct{}
+	closed   bool
+}
+
+func (p *fakePoster) Post(metrics []poster.Metric) error {
+	if p.block != nil {
+		<-p.block
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("backend unavailable")
+	}
+	p.posted = append(p.posted, metrics)
+	return nil
+}
+
+func (p *fakePoster) Posted() [][]poster.Metric {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.posted
+}
+
+func (p *fakePoster) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	return nil
+}
+
+func metricNamed(name string) poster.Metric {
+	return poster.Metric{Metric: name, Value: 1, Timestamp: 1}
+}
+
+func newOutput(name string, p opentsdbclient.Poster, include []string, exclude []string) *fanout.Output {
+	output, err := fanout.NewOutput(name, p, include, exclude)
+	Expect(err).ToNot(HaveOccurred())
+	output.SetRetryDelay(time.Millisecond)
+	return output
+}
+
+var _ = Describe("FanOut", func() {
+	var first, second *fakePoster
+	var metrics []poster.Metric
+
+	BeforeEach(func() {
+		first = &fakePoster{}
+		second = &fakePoster{}
+		metrics = []poster.Metric{metricNamed("nozzle.router.latency"), metricNamed("nozzle.doppler.ingress")}
+	})
+
+	It("posts every batch to all outputs", func() {
+		f := fanout.New(newOutput("first", first, nil, nil), newOutput("second", second, nil, nil))
+		Expect(f.Post(metrics)).To(Succeed())
+		f.Close()
+
+		Expect(first.Posted()).To(Equal([][]poster.Metric{metrics}))
+		Expect(second.Posted()).To(Equal([][]poster.Metric{metrics}))
+		Expect(first.closed).To(BeTrue())
+	})
+
+	It("applies the filters of each output", func() {
+		f := fanout.New(
+			newOutput("routers", first, []string{"nozzle.router.*"}, nil),
+			newOutput("no-routers", second, nil, []string{"nozzle.router.*"}),
+		)
+		Expect(f.Post(metrics)).To(Succeed())
+		f.Close()
+
+		Expect(first.Posted()).To(Equal([][]poster.Metric{{metrics[0]}}))
+		Expect(second.Posted()).To(Equal([][]poster.Metric{{metrics[1]}}))
+		Expect(f.OutputStats()[0].MetricsFiltered).To(BeEquivalentTo(1))
+		Expect(f.OutputStats()[1].MetricsFiltered).To(BeEquivalentTo(1))
+	})
+
+	It("replaces the filters of a running output", func() {
+		routers := newOutput("routers", first, []string{"nozzle.router.*"}, nil)
+		f := fanout.New(routers)
+		Expect(f.Outputs()).To(Equal([]*fanout.Output{routers}))
+		Expect(f.Post(metrics)).To(Succeed())
+
+		Expect(routers.SetFilters(nil, []string{"nozzle.router.*"})).To(Succeed())
+		Expect(f.Post(metrics)).To(Succeed())
+		f.Close()
+
+		Expect(first.Posted()).To(Equal([][]poster.Metric{{metrics[0]}, {metrics[1]}}))
+		Expect(routers.SetFilters([]string{"nozzle.[router"}, nil)).To(MatchError(ContainSubstring("invalid metric pattern")))
+	})
+
+	It("rejects invalid patterns", func() {
+		_, err := fanout.NewOutput("broken", first, []string{"nozzle.[router"}, nil)
+		Expect(err).To(MatchError(ContainSubstring(`invalid metric pattern "nozzle.[router" for output broken`)))
+	})
+
+	It("does not let a slow output hold up the others", func() {
+		first.block = make(chan struct{})
+		f := fanout.New(newOutput("slow", first, nil, nil), newOutput("fast", second, nil, nil))
+		defer f.Close()
+		defer close(first.block)
+
+		Expect(f.Post(metrics)).To(Succeed())
+		Eventually(second.Posted).Should(HaveLen(1))
+		Expect(first.Posted()).To(BeEmpty())
+	})
+
+	It("drops batches and reports an error when an output's queue is full", func() {
+		first.block = make(chan struct{})
+		slow := newOutput("slow", first, nil, nil)
+		slow.SetQueueSize(1)
+		f := fanout.New(slow, newOutput("fast", second, nil, nil))
+
+		Expect(f.Post(metrics)).To(Succeed())
+		Eventually(func() float64 { return f.OutputStats()[0].QueuedBatches }).Should(BeZero())
+		Expect(f.Post(metrics)).To(Succeed())
+
+		err := f.Post(metrics)
+		Expect(err).To(MatchError("queue of output slow is full, dropping 2 metrics"))
+		Expect(f.OutputStats()[0].MetricsDropped).To(BeEquivalentTo(2))
+
+		close(first.block)
+		f.Close()
+		Expect(second.Posted()).To(HaveLen(3))
+	})
+
+	It("retries failed posts and counts them", func() {
+		first.failures = 2
+		f := fanout.New(newOutput("flaky", first, nil, nil))
+		Expect(f.Post(metrics)).To(Succeed())
+		f.Close()
+
+		Expect(first.Posted()).To(HaveLen(1))
+		stats := f.OutputStats()
+		Expect(stats).To(HaveLen(1))
+		Expect(stats[0].PostDurationSeconds).To(BeNumerically(">=", 0))
+		stats[0].PostDurationSeconds = 0
+		Expect(stats).To(Equal([]opentsdbclient.OutputStats{{
+			Name:           "flaky",
+			PostsSucceeded: 1,
+			PostsFailed:    2,
+			MetricsSent:    2,
+			PostFailures:   map[string]float64{"other": 2},
+		}}))
+	})
+
+	It("keeps retrying and refuses batches for every output while one is full when blocking", func() {
+		first.failures = 10
+		down := newOutput("down", first, nil, nil)
+		down.SetMaxRetries(1)
+		down.SetQueueSize(1)
+		f := fanout.New(down, newOutput("up", second, nil, nil))
+		f.SetBlocking(true)
+
+		Expect(f.Post(metrics)).To(Succeed())
+		Eventually(func() float64 { return f.OutputStats()[0].QueuedBatches }).Should(BeZero())
+		Expect(f.Post(metrics)).To(Succeed())
+		Expect(f.Post(metrics)).To(MatchError("queue of output down is full, keeping 2 metrics"))
+		Eventually(second.Posted).Should(HaveLen(2))
+		Consistently(second.Posted).Should(HaveLen(2))
+		Expect(f.OutputStats()[0].PostsFailed).To(BeNumerically(">", 2))
+		Expect(f.OutputStats()[0].MetricsDropped).To(BeZero())
+
+		first.lock.Lock()
+		first.failures = 0
+		first.lock.Unlock()
+		Eventually(first.Posted).Should(HaveLen(2))
+		Expect(f.Post(metrics)).To(Succeed())
+		f.Close()
+		Expect(second.Posted()).To(HaveLen(3))
+	})
+
+	It("drops a batch after the maximum number of retries", func() {
+		first.failures = 10
+		output := newOutput("down", first, nil, nil)
+		output.SetMaxRetries(1)
+		f := fanout.New(output)
+		Expect(f.Post(metrics)).To(Succeed())
+		f.Close()
+
+		Expect(first.Posted()).To(BeEmpty())
+		stats := f.OutputStats()[0]
+		Expect(stats.PostsFailed).To(BeEquivalentTo(2))
+		Expect(stats.MetricsDropped).To(BeEquivalentTo(2))
+	})
+})
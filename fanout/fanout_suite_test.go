@@ -0,0 +1,19 @@
+package fanout_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestFanOut(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "FanOut Suite")
+}
+
+var _ = BeforeSuite(func() {
+	log.SetOutput(ioutil.Discard)
+})
@@ -0,0 +1,225 @@
+package fanout
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/opentsdbclient"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+)
+
+const (
+	defaultQueueSize  = 10
+	defaultMaxRetries = 3
+	defaultRetryDelay = time.Second
+	maxRetryDelay     = time.Minute
+)
+
+// Output posts batches to one backend from its own queue, so that a slow
+// or failing backend does not hold up the others.
+type Output struct {
+	name    string
+	poster  opentsdbclient.Poster
+	include []string
+	exclude []string
+
+	queueSize  int
+	maxRetries int
+	retryDelay time.Duration
+	queue      chan []poster.Metric
+	blocking   bool
+	stop       chan struct{}
+
+	lock  sync.Mutex
+	stats opentsdbclient.OutputStats
+}
+
+// NewOutput creates an output that only receives the metrics whose name
+// matches one of the include patterns, if any are given, and none of the
+// exclude patterns. Patterns use path.Match syntax.
+func NewOutput(name string, p opentsdbclient.Poster, include []string, exclude []string) (*Output, error) {
+	output := &Output{
+		name:       name,
+		poster:     p,
+		queueSize:  defaultQueueSize,
+		maxRetries: defaultMaxRetries,
+		retryDelay: defaultRetryDelay,
+		stop:       make(chan struct{}),
+		stats:      opentsdbclient.OutputStats{Name: name},
+	}
+	if err := output.SetFilters(include, exclude); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// SetFilters replaces the include and exclude patterns. It can be called
+// while the output is running; batches posted afterwards use the new
+// patterns.
+func (o *Output) SetFilters(include []string, exclude []string) error {
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid metric pattern %q for output %s: %s", pattern, o.name, err)
+		}
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.include = include
+	o.exclude = exclude
+	return nil
+}
+
+// SetQueueSize sets the number of batches that can wait for the backend
+// before new batches are dropped.
+func (o *Output) SetQueueSize(queueSize int) {
+	o.queueSize = queueSize
+}
+
+// SetMaxRetries sets how often a batch is retried before it is dropped.
+func (o *Output) SetMaxRetries(maxRetries int) {
+	o.maxRetries = maxRetries
+}
+
+// SetRetryDelay sets the delay before the first retry. It doubles after
+// every attempt, up to a minute.
+func (o *Output) SetRetryDelay(retryDelay time.Duration) {
+	o.retryDelay = retryDelay
+}
+
+func (o *Output) Name() string {
+	return o.name
+}
+
+func (o *Output) Stats() opentsdbclient.OutputStats {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	stats := o.stats
+	stats.QueuedBatches = float64(len(o.queue))
+	stats.PostFailures = make(map[string]float64, len(o.stats.PostFailures))
+	for reason, count := range o.stats.PostFailures {
+		stats.PostFailures[reason] = count
+	}
+	return stats
+}
+
+func (o *Output) filter(metrics []poster.Metric) []poster.Metric {
+	o.lock.Lock()
+	include, exclude := o.include, o.exclude
+	o.lock.Unlock()
+	if len(include) == 0 && len(exclude) == 0 {
+		return metrics
+	}
+
+	filtered := make([]poster.Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		if matches(metric.Metric, include, exclude) {
+			filtered = append(filtered, metric)
+		}
+	}
+	o.lock.Lock()
+	o.stats.MetricsFiltered += float64(len(metrics) - len(filtered))
+	o.lock.Unlock()
+	return filtered
+}
+
+func matches(name string, include []string, exclude []string) bool {
+	for _, pattern := range exclude {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, pattern := range include {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Output) queueFull() bool {
+	return len(o.queue) >= cap(o.queue)
+}
+
+func (o *Output) enqueue(metrics []poster.Metric) error {
+	metrics = o.filter(metrics)
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	select {
+	case o.queue <- metrics:
+		return nil
+	default:
+		o.lock.Lock()
+		o.stats.MetricsDropped += float64(len(metrics))
+		o.lock.Unlock()
+		return fmt.Errorf("queue of output %s is full, dropping %d metrics", o.name, len(metrics))
+	}
+}
+
+func (o *Output) run() {
+	for metrics := range o.queue {
+		o.post(metrics)
+	}
+}
+
+func (o *Output) post(metrics []poster.Metric) {
+	delay := o.retryDelay
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		err := o.poster.Post(metrics)
+		duration := time.Since(start)
+		if err == nil {
+			o.lock.Lock()
+			o.stats.PostDurationSeconds = duration.Seconds()
+			o.stats.PostsSucceeded++
+			o.stats.MetricsSent += float64(len(metrics))
+			o.lock.Unlock()
+			return
+		}
+
+		o.lock.Lock()
+		o.stats.PostDurationSeconds = duration.Seconds()
+		o.stats.PostsFailed++
+		if o.stats.PostFailures == nil {
+			o.stats.PostFailures = make(map[string]float64)
+		}
+		o.stats.PostFailures[poster.FailureReason(err)]++
+		o.lock.Unlock()
+		// a blocking output keeps retrying until the fan-out is closed,
+		// so that its queue fills up and holds back the nozzle
+		if attempt >= o.maxRetries && !o.blocking {
+			logger.Error("Could not post to output, dropping the metrics", logger.Fields{"output": o.name, "batch_size": len(metrics), "error": err})
+			o.lock.Lock()
+			o.stats.MetricsDropped += float64(len(metrics))
+			o.lock.Unlock()
+			return
+		}
+
+		logger.Warn("Could not post to output, retrying", logger.Fields{"output": o.name, "retry_in": delay, "error": err})
+		if o.blocking {
+			select {
+			case <-time.After(delay):
+			case <-o.stop:
+				logger.Error("Output closed, dropping the metrics", logger.Fields{"output": o.name, "batch_size": len(metrics)})
+				o.lock.Lock()
+				o.stats.MetricsDropped += float64(len(metrics))
+				o.lock.Unlock()
+				return
+			}
+		} else {
+			time.Sleep(delay)
+		}
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Package logger writes leveled log lines with structured fields, as text,
+// JSON or logfmt. Everything goes through the standard library logger, so
+// log.SetOutput redirects it.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	fatalLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	default:
+		return "fatal"
+	}
+}
+
+// ParseLevel parses debug, info, warn or error. The empty string is info.
+func ParseLevel(level string) (Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return DebugLevel, nil
+	case "", "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	default:
+		return InfoLevel, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", level)
+	}
+}
+
+type Format int
+
+const (
+	TextFormat Format = iota
+	JSONFormat
+	LogfmtFormat
+)
+
+// ParseFormat parses text, json or logfmt. The empty string is text.
+func ParseFormat(format string) (Format, error) {
+	switch strings.ToLower(format) {
+	case "", "text":
+		return TextFormat, nil
+	case "json":
+		return JSONFormat, nil
+	case "logfmt":
+		return LogfmtFormat, nil
+	default:
+		return TextFormat, fmt.Errorf("unknown log format %q, expected text, json or logfmt", format)
+	}
+}
+
+// Fields are the structured values of a log line. The same keys are used
+// everywhere: batch_size, endpoint, output, duration and error among others.
+type Fields map[string]interface{}
+
+const defaultRateLimit = time.Minute
+
+var (
+	lock      sync.Mutex
+	level     = InfoLevel
+	format    = TextFormat
+	rateLimit = defaultRateLimit
+	limited   = make(map[string]*limitedMessage)
+)
+
+type limitedMessage struct {
+	last       time.Time
+	suppressed int
+}
+
+func SetLevel(l Level) {
+	lock.Lock()
+	defer lock.Unlock()
+	level = l
+}
+
+func GetLevel() Level {
+	lock.Lock()
+	defer lock.Unlock()
+	return level
+}
+
+// SetFormat selects the format of the log lines. The structured formats
+// carry their own time field, so the standard logger's prefix is turned
+// off for them.
+func SetFormat(f Format) {
+	lock.Lock()
+	defer lock.Unlock()
+	format = f
+	if f == TextFormat {
+		log.SetFlags(log.LstdFlags)
+	} else {
+		log.SetFlags(0)
+	}
+}
+
+// SetRateLimit sets how often InfoLimited logs the same message. Zero
+// logs it every time.
+func SetRateLimit(interval time.Duration) {
+	lock.Lock()
+	defer lock.Unlock()
+	rateLimit = interval
+}
+
+func Debug(msg string, fields ...Fields) {
+	write(DebugLevel, msg, fields)
+}
+
+func Info(msg string, fields ...Fields) {
+	write(InfoLevel, msg, fields)
+}
+
+func Warn(msg string, fields ...Fields) {
+	write(WarnLevel, msg, fields)
+}
+
+func Error(msg string, fields ...Fields) {
+	write(ErrorLevel, msg, fields)
+}
+
+// Fatal logs the message and exits.
+func Fatal(msg string, fields ...Fields) {
+	write(fatalLevel, msg, fields)
+	os.Exit(1)
+}
+
+// InfoLimited logs a message that would otherwise be repeated on every
+// flush at most once per rate limit interval, with the number of times it
+// was suppressed in between. At debug level every message is logged.
+func InfoLimited(msg string, fields ...Fields) {
+	lock.Lock()
+	if level > InfoLevel {
+		lock.Unlock()
+		return
+	}
+	var suppressed int
+	if level > DebugLevel {
+		now := time.Now()
+		limit, ok := limited[msg]
+		if !ok {
+			limit = &limitedMessage{}
+			limited[msg] = limit
+		}
+		if now.Sub(limit.last) < rateLimit {
+			limit.suppressed++
+			lock.Unlock()
+			return
+		}
+		limit.last = now
+		suppressed = limit.suppressed
+		limit.suppressed = 0
+	}
+	lock.Unlock()
+
+	if suppressed > 0 {
+		fields = append(fields, Fields{"suppressed": suppressed})
+	}
+	write(InfoLevel, msg, fields)
+}
+
+func write(l Level, msg string, fields []Fields) {
+	lock.Lock()
+	minLevel, f := level, format
+	lock.Unlock()
+	if l < minLevel {
+		return
+	}
+
+	merged := make(Fields)
+	for _, fieldSet := range fields {
+		for key, value := range fieldSet {
+			merged[key] = fieldValue(value)
+		}
+	}
+
+	switch f {
+	case JSONFormat:
+		log.Print(formatJSON(l, msg, merged))
+	case LogfmtFormat:
+		log.Print(formatLogfmt(l, msg, merged))
+	default:
+		log.Print(formatText(l, msg, merged))
+	}
+}
+
+// fieldValue turns errors and durations into strings, so that they read
+// the same in every format.
+func fieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatText(l Level, msg string, fields Fields) string {
+	var line bytes.Buffer
+	line.WriteString(strings.ToUpper(l.String()))
+	line.WriteString(" ")
+	line.WriteString(msg)
+	for _, key := range sortedKeys(fields) {
+		fmt.Fprintf(&line, " %s=%s", key, logfmtValue(fields[key]))
+	}
+	return line.String()
+}
+
+func formatLogfmt(l Level, msg string, fields Fields) string {
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "time=%s level=%s msg=%s", time.Now().UTC().Format(time.RFC3339Nano), l, logfmtValue(msg))
+	for _, key := range sortedKeys(fields) {
+		fmt.Fprintf(&line, " %s=%s", key, logfmtValue(fields[key]))
+	}
+	return line.String()
+}
+
+func logfmtValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func formatJSON(l Level, msg string, fields Fields) string {
+	entry := make(map[string]interface{}, len(fields)+3)
+	for key, value := range fields {
+		entry[key] = value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = l.String()
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Sprintf(`{"level":"error","msg":"can not encode log line as JSON","error":%q}`, err.Error())
+	}
+	return string(line)
+}
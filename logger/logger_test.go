@@ -0,0 +1,114 @@
+package logger_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Logger", func() {
+	var output *bytes.Buffer
+
+	BeforeEach(func() {
+		output = &bytes.Buffer{}
+		log.SetOutput(output)
+		logger.SetLevel(logger.InfoLevel)
+		logger.SetFormat(logger.TextFormat)
+		logger.SetRateLimit(time.Minute)
+	})
+
+	AfterEach(func() {
+		log.SetOutput(ioutil.Discard)
+		logger.SetLevel(logger.InfoLevel)
+		logger.SetFormat(logger.TextFormat)
+	})
+
+	It("writes the level, the message and the sorted fields as text", func() {
+		logger.Warn("Could not post metrics", logger.Fields{
+			"endpoint":   "http://opentsdb:4242",
+			"batch_size": 3,
+			"error":      errors.New("connection refused"),
+		})
+
+		Expect(output.String()).To(HaveSuffix(`WARN Could not post metrics batch_size=3 endpoint=http://opentsdb:4242 error="connection refused"` + "\n"))
+	})
+
+	It("skips the messages below the level", func() {
+		logger.SetLevel(logger.WarnLevel)
+		logger.Info("ignored")
+		logger.Debug("ignored")
+		logger.Error("kept")
+
+		Expect(output.String()).NotTo(ContainSubstring("ignored"))
+		Expect(output.String()).To(ContainSubstring("ERROR kept"))
+	})
+
+	It("writes JSON", func() {
+		logger.SetFormat(logger.JSONFormat)
+		logger.Info("Posted metrics", logger.Fields{"batch_size": 2, "duration": 1500 * time.Millisecond})
+
+		var entry map[string]interface{}
+		Expect(json.Unmarshal(output.Bytes(), &entry)).To(Succeed())
+		Expect(entry).To(HaveKeyWithValue("level", "info"))
+		Expect(entry).To(HaveKeyWithValue("msg", "Posted metrics"))
+		Expect(entry).To(HaveKeyWithValue("batch_size", 2.0))
+		Expect(entry).To(HaveKeyWithValue("duration", "1.5s"))
+		Expect(entry).To(HaveKey("time"))
+	})
+
+	It("writes logfmt", func() {
+		logger.SetFormat(logger.LogfmtFormat)
+		logger.Info("Posted metrics", logger.Fields{"batch_size": 2})
+
+		Expect(output.String()).To(MatchRegexp(`^time=\S+ level=info msg="Posted metrics" batch_size=2\n$`))
+	})
+
+	Describe("InfoLimited", func() {
+		It("logs the same message once per interval and counts the others", func() {
+			logger.SetRateLimit(50 * time.Millisecond)
+			logger.InfoLimited("Posted metrics")
+			logger.InfoLimited("Posted metrics")
+			logger.InfoLimited("Posted metrics")
+			time.Sleep(60 * time.Millisecond)
+			logger.InfoLimited("Posted metrics")
+
+			lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+			Expect(lines).To(HaveLen(2))
+			Expect(lines[0]).To(HaveSuffix("INFO Posted metrics"))
+			Expect(lines[1]).To(HaveSuffix("INFO Posted metrics suppressed=2"))
+		})
+
+		It("logs every message at debug level", func() {
+			logger.SetLevel(logger.DebugLevel)
+			logger.InfoLimited("Posted metrics")
+			logger.InfoLimited("Posted metrics")
+
+			Expect(strings.Count(output.String(), "INFO Posted metrics")).To(Equal(2))
+		})
+	})
+
+	It("parses levels and formats", func() {
+		level, err := logger.ParseLevel("WARNING")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(level).To(Equal(logger.WarnLevel))
+
+		_, err = logger.ParseLevel("verbose")
+		Expect(err).To(MatchError(`unknown log level "verbose", expected debug, info, warn or error`))
+
+		format, err := logger.ParseFormat("logfmt")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(format).To(Equal(logger.LogfmtFormat))
+
+		_, err = logger.ParseFormat("xml")
+		Expect(err).To(HaveOccurred())
+	})
+})
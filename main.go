@@ -10,6 +10,7 @@ import (
 	"runtime/pprof"
 	"syscall"
 
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/nozzleconfig"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/opentsdbfirehosenozzle"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/uaatokenfetcher"
@@ -24,20 +25,32 @@ var (
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	configFilePath := flag.String("config", "config/opentsdb-firehose-nozzle.json", "Location of the nozzle config json file")
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	configFilePath := flag.String("config", "config/opentsdb-firehose-nozzle.json", "Location of the nozzle config file, JSON or YAML")
+	overrides := nozzleconfig.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
-	config, err := nozzleconfig.Parse(*configFilePath)
+	loadConfig := func() (*nozzleconfig.NozzleConfig, error) {
+		return nozzleconfig.Load(*configFilePath, overrides)
+	}
+	config, err := loadConfig()
 	if err != nil {
 		log.Fatalf("Error parsing config: %s", err.Error())
 	}
 
-	log.Printf("The version is: %s; the commit hash is: %s. Build time is: %s", VersionTag, CommitHash, BuildTime)
+	configureLogger(config)
+	logger.Info("Starting the nozzle", logger.Fields{"version": VersionTag, "commit": CommitHash, "build_time": BuildTime})
 
 	tokenFetcher := &uaatokenfetcher.UAATokenFetcher{
 		UaaUrl:                config.UAAURL,
 		Username:              config.Username,
 		Password:              config.Password,
+		ClientID:              config.UAAClientID,
+		ClientSecret:          config.UAAClientSecret,
+		Scopes:                config.UAAScopes,
 		InsecureSSLSkipVerify: config.InsecureSSLSkipVerify,
 	}
 
@@ -46,9 +59,22 @@ func main() {
 	go dumpGoRoutine(threadDumpChan)
 
 	opentsdbNozzle := opentsdbfirehosenozzle.NewOpenTSDBFirehoseNozzle(config, tokenFetcher)
+	go reloadOnSignal(*configFilePath, loadConfig, opentsdbNozzle)
+	if config.ConfigWatchInterval > 0 {
+		go watchConfig(*configFilePath, config.ConfigWatchInterval, loadConfig, opentsdbNozzle)
+	}
 	opentsdbNozzle.Start()
 }
 
+// configureLogger applies the log settings of a validated config.
+func configureLogger(config *nozzleconfig.NozzleConfig) {
+	level, _ := logger.ParseLevel(config.LogLevel)
+	format, _ := logger.ParseFormat(config.LogFormat)
+	logger.SetLevel(level)
+	logger.SetFormat(format)
+	logger.SetRateLimit(config.LogRateLimit)
+}
+
 func registerGoRoutineDumpSignalChannel() chan os.Signal {
 	threadDumpChan := make(chan os.Signal, 1)
 	signal.Notify(threadDumpChan, syscall.SIGUSR1)
@@ -0,0 +1,461 @@
+package nozzleconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const envPrefix = "NOZZLE_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Defaults returns the settings used for everything the config file,
+// the environment and the flags leave out.
+func Defaults() NozzleConfig {
+	return NozzleConfig{
+		FlushDurationSeconds:   15,
+		Input:                  FirehoseInput,
+		Output:                 OpenTSDBOutput,
+		TimestampPrecision:     "seconds",
+		LogLevel:               "info",
+		LogFormat:              "text",
+		LogRateLimit:           time.Minute,
+		BufferOverflowPolicy:   "drop-oldest",
+		BufferHighWaterPercent: 80,
+	}
+}
+
+// Flags holds the command line flags that override the config file and
+// the environment. There is one for every setting, named after it in
+// lower case, like -flushdurationseconds, except for -dry-run.
+type Flags struct {
+	values map[string]string
+}
+
+// RegisterFlags defines a flag for every setting on flagSet.
+func RegisterFlags(flagSet *flag.FlagSet) *Flags {
+	flags := &Flags{values: make(map[string]string)}
+	configType := reflect.TypeOf(NozzleConfig{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		flagSet.Var(&flagValue{flags: flags, field: field}, FlagName(field.Name), fmt.Sprintf("Overrides %s", field.Name))
+	}
+	return flags
+}
+
+// EnvName is the environment variable that overrides a setting.
+func EnvName(setting string) string {
+	return envPrefix + strings.ToUpper(setting)
+}
+
+// flagNames keeps the names of flags that predate the generic ones.
+var flagNames = map[string]string{
+	"DryRun": "dry-run",
+}
+
+// FlagName is the command line flag that overrides a setting.
+func FlagName(setting string) string {
+	if name, ok := flagNames[setting]; ok {
+		return name
+	}
+	return strings.ToLower(setting)
+}
+
+type flagValue struct {
+	flags *Flags
+	field reflect.StructField
+}
+
+func (f *flagValue) String() string {
+	if f.flags == nil {
+		return ""
+	}
+	return f.flags.values[f.field.Name]
+}
+
+func (f *flagValue) Set(value string) error {
+	f.flags.values[f.field.Name] = value
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.field.Type.Kind() == reflect.Bool
+}
+
+// Load builds the configuration from, in increasing order of precedence,
+// the defaults, the config file, the NOZZLE_ environment variables, the
+// flags, the credentials of the CredentialsService in VCAP_SERVICES and
+// the secret files, and validates the result. The config file is YAML
+// when its name ends in .yml or .yaml and JSON otherwise. flags may be
+// nil. When Load returns a *ValidationError the config is returned as
+// well, so that it can be shown next to the problems.
+func Load(configPath string, flags *Flags) (*NozzleConfig, error) {
+	configBytes, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Can not read config file [%s]: %s", configPath, err)
+	}
+
+	raw, err := unmarshalConfigFile(configPath, configBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Can not parse config file %s: %s", configPath, err)
+	}
+
+	config := Defaults()
+	var problems []string
+	for _, problem := range decodeValue("", raw, reflect.ValueOf(&config).Elem()) {
+		problems = append(problems, fmt.Sprintf("%s: %s", configPath, problem))
+	}
+
+	problems = append(problems, unknownEnvProblems()...)
+	configValue := reflect.ValueOf(&config).Elem()
+	for i := 0; i < configValue.NumField(); i++ {
+		name := configValue.Type().Field(i).Name
+		if value := os.Getenv(EnvName(name)); value != "" {
+			if problem := setFromString(configValue.Field(i), value); problem != "" {
+				problems = append(problems, fmt.Sprintf("%s: %s", EnvName(name), problem))
+			}
+		}
+	}
+	if flags != nil {
+		for i := 0; i < configValue.NumField(); i++ {
+			name := configValue.Type().Field(i).Name
+			if value, ok := flags.values[name]; ok {
+				if problem := setFromString(configValue.Field(i), value); problem != "" {
+					problems = append(problems, fmt.Sprintf("-%s: %s", FlagName(name), problem))
+				}
+			}
+		}
+	}
+
+	problems = append(problems, config.applyServiceCredentials()...)
+	problems = append(problems, config.readSecretFiles()...)
+	problems = append(problems, config.validationProblems()...)
+	if len(problems) > 0 {
+		return &config, &ValidationError{Problems: problems}
+	}
+	return &config, nil
+}
+
+// unknownEnvProblems reports the NOZZLE_ environment variables that do not
+// name a setting, which are usually misspelled.
+func unknownEnvProblems() []string {
+	configType := reflect.TypeOf(NozzleConfig{})
+	var problems []string
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		setting := strings.TrimPrefix(name, envPrefix)
+		if _, ok := fieldNamed(configType, setting); !ok {
+			problems = append(problems, fmt.Sprintf("%s: unknown setting%s", name, suggestion(configType, setting, EnvName)))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+func unmarshalConfigFile(configPath string, configBytes []byte) (interface{}, error) {
+	var raw interface{}
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yml", ".yaml":
+		if err := yaml.Unmarshal(configBytes, &raw); err != nil {
+			return nil, err
+		}
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(configBytes))
+		decoder.UseNumber()
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, err
+		}
+	}
+	return raw, nil
+}
+
+// setFromString parses an environment variable or a flag into value. Lists
+// of strings are comma separated and other structured settings are JSON.
+// It returns a description of the problem, or "" when value was set.
+func setFromString(value reflect.Value, s string) string {
+	switch {
+	case value.Type() == durationType:
+		duration, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Sprintf("%q is not a duration like 500ms or 2m", s)
+		}
+		value.SetInt(int64(duration))
+	case value.Kind() == reflect.String:
+		value.SetString(s)
+	case value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Sprintf("%q is not true or false", s)
+		}
+		value.SetBool(b)
+	case value.Kind() == reflect.Uint32:
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return fmt.Sprintf("%q is not a non-negative number", s)
+		}
+		value.SetUint(n)
+	case value.Kind() == reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Sprintf("%q is not a number", s)
+		}
+		value.SetInt(int64(n))
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.String:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		value.Set(reflect.ValueOf(list))
+	default:
+		decoder := json.NewDecoder(strings.NewReader(s))
+		decoder.UseNumber()
+		var raw interface{}
+		if err := decoder.Decode(&raw); err != nil {
+			return fmt.Sprintf("invalid JSON: %s", err)
+		}
+		value.Set(reflect.Zero(value.Type()))
+		if problems := decodeValue("", raw, value); len(problems) > 0 {
+			return strings.Join(problems, "; ")
+		}
+	}
+	return ""
+}
+
+// decodeValue stores a value decoded from JSON or YAML in target, matching
+// keys to field names regardless of case. Durations can be numbers of
+// nanoseconds or strings like "30s". It returns every value that does not
+// fit, named by its path.
+func decodeValue(path string, raw interface{}, target reflect.Value) []string {
+	if raw == nil {
+		return nil
+	}
+	invalid := func(expected string) []string {
+		if s, ok := raw.(string); ok {
+			return []string{fmt.Sprintf("%s%q is not %s", label(path), s, expected)}
+		}
+		return []string{fmt.Sprintf("%s%v is not %s", label(path), raw, expected)}
+	}
+
+	switch {
+	case target.Type() == durationType:
+		if s, ok := raw.(string); ok {
+			duration, err := time.ParseDuration(s)
+			if err != nil {
+				return invalid("a duration like 500ms or 2m")
+			}
+			target.SetInt(int64(duration))
+			return nil
+		}
+		n, ok := toInt64(raw)
+		if !ok {
+			return invalid("a duration like 500ms or 2m")
+		}
+		target.SetInt(n)
+	case target.Kind() == reflect.String:
+		switch raw.(type) {
+		case map[string]interface{}, map[interface{}]interface{}, []interface{}:
+			return invalid("a string")
+		}
+		target.SetString(fmt.Sprint(raw))
+	case target.Kind() == reflect.Bool:
+		b, ok := raw.(bool)
+		if !ok {
+			return invalid("true or false")
+		}
+		target.SetBool(b)
+	case target.Kind() == reflect.Uint32:
+		n, ok := toInt64(raw)
+		if !ok || n < 0 || n > math.MaxUint32 {
+			return invalid("a non-negative number")
+		}
+		target.SetUint(uint64(n))
+	case target.Kind() == reflect.Int:
+		n, ok := toInt64(raw)
+		if !ok {
+			return invalid("a number")
+		}
+		target.SetInt(n)
+	case target.Kind() == reflect.Slice:
+		items, ok := raw.([]interface{})
+		if !ok {
+			return invalid("a list")
+		}
+		slice := reflect.MakeSlice(target.Type(), len(items), len(items))
+		var problems []string
+		for i, item := range items {
+			problems = append(problems, decodeValue(fmt.Sprintf("%s[%d]", path, i), item, slice.Index(i))...)
+		}
+		target.Set(slice)
+		return problems
+	case target.Kind() == reflect.Map:
+		entries, ok := toStringMap(raw)
+		if !ok {
+			return invalid("a map")
+		}
+		m := reflect.MakeMap(target.Type())
+		var problems []string
+		for _, key := range sortedKeys(entries) {
+			value := reflect.New(target.Type().Elem()).Elem()
+			problems = append(problems, decodeValue(fmt.Sprintf("%s[%s]", path, key), entries[key], value)...)
+			m.SetMapIndex(reflect.ValueOf(key), value)
+		}
+		target.Set(m)
+		return problems
+	case target.Kind() == reflect.Struct:
+		entries, ok := toStringMap(raw)
+		if !ok {
+			return invalid("an object")
+		}
+		var problems []string
+		for _, key := range sortedKeys(entries) {
+			field, ok := fieldNamed(target.Type(), key)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%sunknown setting %q%s", label(path), key, suggestion(target.Type(), key, func(name string) string { return name })))
+				continue
+			}
+			fieldPath := field.Name
+			if path != "" {
+				fieldPath = path + "." + field.Name
+			}
+			problems = append(problems, decodeValue(fieldPath, entries[key], target.FieldByIndex(field.Index))...)
+		}
+		return problems
+	default:
+		return []string{fmt.Sprintf("%scan not be set from a config file", label(path))}
+	}
+	return nil
+}
+
+func label(path string) string {
+	if path == "" {
+		return ""
+	}
+	return path + ": "
+}
+
+func toInt64(raw interface{}) (int64, bool) {
+	switch n := raw.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i, true
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return 0, false
+		}
+		return toInt64(f)
+	case int:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint64:
+		if n > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(n), true
+	case float64:
+		if n != math.Trunc(n) || math.Abs(n) > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// toStringMap accepts JSON objects and YAML mappings, whose keys can be of
+// any type.
+func toStringMap(raw interface{}) (map[string]interface{}, bool) {
+	switch m := raw.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(m))
+		for key, value := range m {
+			converted[fmt.Sprint(key)] = value
+		}
+		return converted, true
+	}
+	return nil, false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func fieldNamed(structType reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < structType.NumField(); i++ {
+		if field := structType.Field(i); strings.EqualFold(field.Name, name) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// suggestion names the field closest to a misspelled setting, if any is
+// close enough, in the form the user wrote it.
+func suggestion(structType reflect.Type, name string, format func(string) string) string {
+	best, bestDistance := "", len(name)/4+1
+	if bestDistance < 3 {
+		bestDistance = 3
+	}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i).Name
+		if distance := editDistance(strings.ToLower(field), strings.ToLower(name)); distance < bestDistance {
+			best, bestDistance = field, distance
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %s?", format(best))
+}
+
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, minInt(current[j-1]+1, previous[j-1]+cost))
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,124 @@
+package nozzleconfig_test
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/nozzleconfig"
+)
+
+var _ = Describe("Load", func() {
+	var dir string
+
+	BeforeEach(func() {
+		os.Clearenv()
+		var err error
+		dir, err = ioutil.TempDir("", "nozzleconfig")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	writeConfig := func(name string, contents string) string {
+		configPath := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(configPath, []byte(contents), 0644)).To(Succeed())
+		return configPath
+	}
+
+	It("reads YAML config files", func() {
+		yamlConf, err := nozzleconfig.Load("../config/opentsdb-firehose-nozzle.yml", nil)
+		Expect(err).ToNot(HaveOccurred())
+		jsonConf, err := nozzleconfig.Load("../config/opentsdb-firehose-nozzle.json", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(yamlConf).To(Equal(jsonConf))
+	})
+
+	It("accepts human readable durations and numbers of nanoseconds", func() {
+		configPath := writeConfig("config.json", `{
+			"FirehoseReconnectDelay": "2s",
+			"OpenTSDBRequestTimeout": 1000000000,
+			"Outputs": [{"Type": "graphite", "RetryDelay": "1m30s"}]
+		}`)
+
+		conf, _ := nozzleconfig.Load(configPath, nil)
+		Expect(conf.FirehoseReconnectDelay).To(Equal(2 * time.Second))
+		Expect(conf.OpenTSDBRequestTimeout).To(Equal(time.Second))
+		Expect(conf.Outputs[0].RetryDelay).To(Equal(90 * time.Second))
+	})
+
+	It("fills in the defaults", func() {
+		conf, _ := nozzleconfig.Load(writeConfig("config.yaml", "MetricPrefix: cf.\n"), nil)
+		Expect(conf.MetricPrefix).To(Equal("cf."))
+		Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(15))
+		Expect(conf.Input).To(Equal(nozzleconfig.FirehoseInput))
+		Expect(conf.TimestampPrecision).To(Equal("seconds"))
+	})
+
+	It("applies the flags over the environment and the file", func() {
+		configPath := writeConfig("config.yml", "MetricPrefix: file.\nFlushDurationSeconds: 30\nJob: file-job\n")
+		os.Setenv("NOZZLE_METRICPREFIX", "env.")
+		os.Setenv("NOZZLE_JOB", "env-job")
+
+		flagSet := flag.NewFlagSet("nozzle", flag.ContinueOnError)
+		flags := nozzleconfig.RegisterFlags(flagSet)
+		Expect(flagSet.Parse([]string{"-metricprefix", "flag.", "-dry-run", "-opentsdburls", "http://tsd-0:4242,http://tsd-1:4242"})).To(Succeed())
+
+		conf, _ := nozzleconfig.Load(configPath, flags)
+		Expect(conf.MetricPrefix).To(Equal("flag."))
+		Expect(conf.Job).To(Equal("env-job"))
+		Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(30))
+		Expect(conf.DryRun).To(BeTrue())
+		Expect(conf.OpenTSDBURLs).To(Equal([]string{"http://tsd-0:4242", "http://tsd-1:4242"}))
+	})
+
+	It("derives the environment variable and flag names from the settings", func() {
+		Expect(nozzleconfig.EnvName("ConfigWatchInterval")).To(Equal("NOZZLE_CONFIGWATCHINTERVAL"))
+		Expect(nozzleconfig.FlagName("ConfigWatchInterval")).To(Equal("configwatchinterval"))
+		Expect(nozzleconfig.FlagName("DryRun")).To(Equal("dry-run"))
+
+		os.Setenv("NOZZLE_CONFIGWATCHINTERVAL", "30s")
+		conf, _ := nozzleconfig.Load("../config/opentsdb-firehose-nozzle.yml", nil)
+		Expect(conf.ConfigWatchInterval).To(Equal(30 * time.Second))
+	})
+
+	It("reports every value that does not fit", func() {
+		configPath := writeConfig("config.yml", "FlushDurationSeconds: often\nFirehoseReconnectDelay: soon\nOutputs:\n- RetryDelay: later\n")
+		flagSet := flag.NewFlagSet("nozzle", flag.ContinueOnError)
+		flags := nozzleconfig.RegisterFlags(flagSet)
+		Expect(flagSet.Parse([]string{"-usetelnetapi=maybe", "-idletimeoutseconds", "-1"})).To(Succeed())
+
+		_, err := nozzleconfig.Load(configPath, flags)
+		Expect(err).To(BeAssignableToTypeOf(&nozzleconfig.ValidationError{}))
+		Expect(err.(*nozzleconfig.ValidationError).Problems).To(ContainElement(configPath + `: FirehoseReconnectDelay: "soon" is not a duration like 500ms or 2m`))
+		Expect(err.(*nozzleconfig.ValidationError).Problems).To(ContainElement(configPath + `: FlushDurationSeconds: "often" is not a non-negative number`))
+		Expect(err.(*nozzleconfig.ValidationError).Problems).To(ContainElement(configPath + `: Outputs[0].RetryDelay: "later" is not a duration like 500ms or 2m`))
+		Expect(err.(*nozzleconfig.ValidationError).Problems).To(ContainElement(`-idletimeoutseconds: "-1" is not a non-negative number`))
+		Expect(err.(*nozzleconfig.ValidationError).Problems).To(ContainElement(`-usetelnetapi: "maybe" is not true or false`))
+	})
+
+	It("reports unknown settings in the file and the environment", func() {
+		configPath := writeConfig("config.yml", "FlushDurationSecs: 30\nOutputs:\n- Type: graphite\n  GraphiteAdress: graphite:2003\n")
+		os.Setenv("NOZZLE_METRICPREFX", "env.")
+		defer os.Unsetenv("NOZZLE_METRICPREFX")
+
+		_, err := nozzleconfig.Load(configPath, nil)
+		Expect(err).To(BeAssignableToTypeOf(&nozzleconfig.ValidationError{}))
+		problems := err.(*nozzleconfig.ValidationError).Problems
+		Expect(problems).To(ContainElement(configPath + `: unknown setting "FlushDurationSecs", did you mean FlushDurationSeconds?`))
+		Expect(problems).To(ContainElement(configPath + `: Outputs[0]: unknown setting "GraphiteAdress", did you mean GraphiteAddress?`))
+		Expect(problems).To(ContainElement("NOZZLE_METRICPREFX: unknown setting, did you mean NOZZLE_METRICPREFIX?"))
+	})
+
+	It("fails on a config file that is not valid YAML", func() {
+		_, err := nozzleconfig.Load(writeConfig("config.yml", "Outputs: [\n"), nil)
+		Expect(err).To(MatchError(ContainSubstring("Can not parse config file")))
+	})
+})
@@ -1,103 +1,236 @@
 package nozzleconfig
 
 import (
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"crypto/tls"
 	"os"
-	"strconv"
 	"time"
-)
-
-type NozzleConfig struct {
-	UAAURL                 string
-	Username               string
-	Password               string
-	TrafficControllerURL   string
-	FirehoseSubscriptionID string
-	OpenTSDBURL            string
-	FlushDurationSeconds   uint32
-	InsecureSSLSkipVerify  bool
-	MetricPrefix           string
-	Deployment             string
-	DisableAccessControl   bool
-	UseTelnetAPI           bool
-	Job                    string
-	Index                  string
-	IdleTimeoutSeconds     uint32
-	FirehoseReconnectDelay time.Duration
-}
 
-func Parse(configPath string) (*NozzleConfig, error) {
-	configBytes, err := ioutil.ReadFile(configPath)
-	var config NozzleConfig
-	if err != nil {
-		return nil, fmt.Errorf("Can not read config file [%s]: %s", configPath, err)
-	}
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+)
 
-	err = json.Unmarshal(configBytes, &config)
-	if err != nil {
-		return nil, fmt.Errorf("Can not parse config file %s: %s", configPath, err)
-	}
+const (
+	FirehoseInput   = "firehose"
+	RLPGatewayInput = "rlp-gateway"
+	UDPInput        = "udp"
+	ReplayInput     = "replay"
+)
 
-	overrideWithEnvVar("NOZZLE_UAAURL", &config.UAAURL)
-	overrideWithEnvVar("NOZZLE_USERNAME", &config.Username)
-	overrideWithEnvVar("NOZZLE_PASSWORD", &config.Password)
-	overrideWithEnvVar("NOZZLE_TRAFFICCONTROLLERURL", &config.TrafficControllerURL)
-	overrideWithEnvVar("NOZZLE_FIREHOSESUBSCRIPTIONID", &config.FirehoseSubscriptionID)
-	overrideWithEnvVar("NOZZLE_OPENTSDBURL", &config.OpenTSDBURL)
+const (
+	OpenTSDBOutput    = "opentsdb"
+	GraphiteOutput    = "graphite"
+	InfluxDBOutput    = "influxdb"
+	RemoteWriteOutput = "prometheus-remote-write"
+)
 
-	overrideWithEnvUint32("NOZZLE_FLUSHDURATIONSECONDS", &config.FlushDurationSeconds)
+type NozzleConfig struct {
+	UAAURL                     string
+	Username                   string
+	Password                   string
+	TrafficControllerURL       string
+	FirehoseSubscriptionID     string
+	OpenTSDBURL                string
+	FlushDurationSeconds       uint32
+	InsecureSSLSkipVerify      bool
+	MetricPrefix               string
+	Deployment                 string
+	DisableAccessControl       bool
+	UseTelnetAPI               bool
+	Job                        string
+	Index                      string
+	IdleTimeoutSeconds         uint32
+	FirehoseReconnectDelay     time.Duration
+	TimestampPrecision         string
+	ForwardAppMetrics          bool
+	CloudControllerURL         string
+	AppCacheTTLSeconds         uint32
+	AppMetricTags              []string
+	NozzleInstanceTag          string
+	Input                      string
+	RLPGatewayURL              string
+	RLPGatewaySelectors        string
+	UDPListenAddress           string
+	RecordFile                 string
+	ReplayFile                 string
+	ReplayRealTime             bool
+	ReplayRewriteTimestamps    bool
+	DryRun                     bool
+	DryRunFile                 string
+	Output                     string
+	GraphiteAddress            string
+	GraphiteFormat             string
+	GraphiteTagStyle           string
+	InfluxDBURL                string
+	InfluxDBDatabase           string
+	InfluxDBRetentionPolicy    string
+	InfluxDBOrganization       string
+	InfluxDBBucket             string
+	InfluxDBToken              string
+	RemoteWriteURL             string
+	Outputs                    []OutputConfig
+	OpenTSDBURLs               []string
+	OpenTSDBBalancing          string
+	OpenTSDBEjectAfter         uint32
+	OpenTSDBEjectCooldown      time.Duration
+	OpenTSDBCACertFile         string
+	OpenTSDBClientCertFile     string
+	OpenTSDBClientKeyFile      string
+	OpenTSDBInsecureSkipVerify bool
+	OpenTSDBUsername           string
+	OpenTSDBPassword           string
+	OpenTSDBBearerToken        string
+	OpenTSDBHeaders            map[string]string
+	OpenTSDBConnectTimeout     time.Duration
+	OpenTSDBRequestTimeout     time.Duration
+	OpenTSDBIdleConnTimeout    time.Duration
+	OpenTSDBMaxIdleConns       uint32
+	OpenTSDBTelnetTLS          bool
+	OpenTSDBCompression        string
+	OpenTSDBCompressionLevel   int
+	ConfigWatchInterval        time.Duration
+	PasswordFile               string
+	OpenTSDBPasswordFile       string
+	OpenTSDBBearerTokenFile    string
+	CredentialsService         string
+	UAAClientID                string
+	UAAClientSecret            string
+	UAAClientSecretFile        string
+	UAAScopes                  []string
+	LogLevel                   string
+	LogFormat                  string
+	LogRateLimit               time.Duration
+	MaxBufferedMetrics         uint32
+	MaxBufferedBytes           uint32
+	BufferOverflowPolicy       string
+	BufferHighWaterPercent     uint32
+	FlushBatchSize             uint32
+	FlushBatchBytes            uint32
+}
 
-	overrideWithEnvBool("NOZZLE_INSECURESSLSKIPVERIFY", &config.InsecureSSLSkipVerify)
-	overrideWithEnvVar("NOZZLE_METRICPREFIX", &config.MetricPrefix)
+// OutputConfig describes one of several outputs the nozzle writes to at
+// the same time. Type is one of the Output constants and selects which of
+// the backend settings apply.
+type OutputConfig struct {
+	Name                       string
+	Type                       string
+	OpenTSDBURL                string
+	UseTelnetAPI               bool
+	GraphiteAddress            string
+	GraphiteFormat             string
+	GraphiteTagStyle           string
+	InfluxDBURL                string
+	InfluxDBDatabase           string
+	InfluxDBRetentionPolicy    string
+	InfluxDBOrganization       string
+	InfluxDBBucket             string
+	InfluxDBToken              string
+	RemoteWriteURL             string
+	IncludeMetrics             []string
+	ExcludeMetrics             []string
+	QueueSize                  uint32
+	MaxRetries                 uint32
+	RetryDelay                 time.Duration
+	OpenTSDBURLs               []string
+	OpenTSDBBalancing          string
+	OpenTSDBEjectAfter         uint32
+	OpenTSDBEjectCooldown      time.Duration
+	OpenTSDBCACertFile         string
+	OpenTSDBClientCertFile     string
+	OpenTSDBClientKeyFile      string
+	OpenTSDBInsecureSkipVerify bool
+	OpenTSDBUsername           string
+	OpenTSDBPassword           string
+	OpenTSDBBearerToken        string
+	OpenTSDBHeaders            map[string]string
+	OpenTSDBConnectTimeout     time.Duration
+	OpenTSDBRequestTimeout     time.Duration
+	OpenTSDBIdleConnTimeout    time.Duration
+	OpenTSDBMaxIdleConns       uint32
+	OpenTSDBTelnetTLS          bool
+	OpenTSDBCompression        string
+	OpenTSDBCompressionLevel   int
+	OpenTSDBPasswordFile       string
+	OpenTSDBBearerTokenFile    string
+}
 
-	overrideWithEnvVar("NOZZLE_DEPLOYMENT", &config.Deployment)
-	overrideWithEnvBool("NOZZLE_DISABLEACCESSCONTROL", &config.DisableAccessControl)
-	overrideWithEnvBool("NOZZLE_USETELNETAPI", &config.UseTelnetAPI)
-	overrideWithEnvVar("NOZZLE_JOB", &config.Job)
-	overrideWithEnvVar("NOZZLE_INDEX", &config.Index)
-	overrideWithEnvUint32("NOZZLE_IDLETIMEOUTSECONDS", &config.IdleTimeoutSeconds)
-	overrideWithEnvDuration("NOZZLE_FIREHOSERECONNECTDELAY", &config.FirehoseReconnectDelay)
-	return &config, nil
+// Parse loads the config file without command line flags, see Load.
+func Parse(configPath string) (*NozzleConfig, error) {
+	return Load(configPath, nil)
 }
 
-func overrideWithEnvVar(name string, value *string) {
-	envValue := os.Getenv(name)
-	if envValue != "" {
-		*value = envValue
+// PrimaryOutput describes the single output configured by the top level
+// settings, used when no Outputs are configured.
+func (c *NozzleConfig) PrimaryOutput() OutputConfig {
+	output := c.Output
+	if output == "" {
+		output = OpenTSDBOutput
+	}
+	return OutputConfig{
+		Name:                       output,
+		Type:                       output,
+		OpenTSDBURL:                c.OpenTSDBURL,
+		UseTelnetAPI:               c.UseTelnetAPI,
+		GraphiteAddress:            c.GraphiteAddress,
+		GraphiteFormat:             c.GraphiteFormat,
+		GraphiteTagStyle:           c.GraphiteTagStyle,
+		InfluxDBURL:                c.InfluxDBURL,
+		InfluxDBDatabase:           c.InfluxDBDatabase,
+		InfluxDBRetentionPolicy:    c.InfluxDBRetentionPolicy,
+		InfluxDBOrganization:       c.InfluxDBOrganization,
+		InfluxDBBucket:             c.InfluxDBBucket,
+		InfluxDBToken:              c.InfluxDBToken,
+		RemoteWriteURL:             c.RemoteWriteURL,
+		OpenTSDBURLs:               c.OpenTSDBURLs,
+		OpenTSDBBalancing:          c.OpenTSDBBalancing,
+		OpenTSDBEjectAfter:         c.OpenTSDBEjectAfter,
+		OpenTSDBEjectCooldown:      c.OpenTSDBEjectCooldown,
+		OpenTSDBCACertFile:         c.OpenTSDBCACertFile,
+		OpenTSDBClientCertFile:     c.OpenTSDBClientCertFile,
+		OpenTSDBClientKeyFile:      c.OpenTSDBClientKeyFile,
+		OpenTSDBInsecureSkipVerify: c.OpenTSDBInsecureSkipVerify,
+		OpenTSDBUsername:           c.OpenTSDBUsername,
+		OpenTSDBPassword:           c.OpenTSDBPassword,
+		OpenTSDBBearerToken:        c.OpenTSDBBearerToken,
+		OpenTSDBHeaders:            c.OpenTSDBHeaders,
+		OpenTSDBConnectTimeout:     c.OpenTSDBConnectTimeout,
+		OpenTSDBRequestTimeout:     c.OpenTSDBRequestTimeout,
+		OpenTSDBIdleConnTimeout:    c.OpenTSDBIdleConnTimeout,
+		OpenTSDBMaxIdleConns:       c.OpenTSDBMaxIdleConns,
+		OpenTSDBTelnetTLS:          c.OpenTSDBTelnetTLS,
+		OpenTSDBCompression:        c.OpenTSDBCompression,
+		OpenTSDBCompressionLevel:   c.OpenTSDBCompressionLevel,
 	}
 }
 
-func overrideWithEnvUint32(name string, value *uint32) {
-	envValue := os.Getenv(name)
-	if envValue != "" {
-		tmpValue, err := strconv.Atoi(envValue)
-		if err != nil {
-			panic(err)
-		}
-		*value = uint32(tmpValue)
+// HTTPClientConfig describes the HTTP client for the OpenTSDB HTTP API.
+func (o OutputConfig) HTTPClientConfig() poster.HTTPClientConfig {
+	return poster.HTTPClientConfig{
+		CACertFile:          o.OpenTSDBCACertFile,
+		ClientCertFile:      o.OpenTSDBClientCertFile,
+		ClientKeyFile:       o.OpenTSDBClientKeyFile,
+		InsecureSkipVerify:  o.OpenTSDBInsecureSkipVerify,
+		Username:            o.OpenTSDBUsername,
+		Password:            o.OpenTSDBPassword,
+		BearerToken:         o.OpenTSDBBearerToken,
+		Headers:             o.OpenTSDBHeaders,
+		ConnectTimeout:      o.OpenTSDBConnectTimeout,
+		RequestTimeout:      o.OpenTSDBRequestTimeout,
+		IdleConnTimeout:     o.OpenTSDBIdleConnTimeout,
+		MaxIdleConnsPerHost: int(o.OpenTSDBMaxIdleConns),
 	}
 }
 
-func overrideWithEnvDuration(name string, value *time.Duration) {
-	envValue := os.Getenv(name)
-	if envValue != "" {
-		tmpValue, err := time.ParseDuration(envValue)
-		if err != nil {
-			panic(err)
-		}
-		*value = tmpValue
+// TelnetTLSConfig returns the TLS settings of the OpenTSDB telnet API, or
+// nil when OpenTSDBTelnetTLS is not set.
+func (o OutputConfig) TelnetTLSConfig() (*tls.Config, error) {
+	if !o.OpenTSDBTelnetTLS {
+		return nil, nil
 	}
+	return poster.NewTLSConfig(o.OpenTSDBCACertFile, o.OpenTSDBClientCertFile, o.OpenTSDBClientKeyFile, o.OpenTSDBInsecureSkipVerify)
 }
 
-func overrideWithEnvBool(name string, value *bool) {
-	envValue := os.Getenv(name)
-	if envValue != "" {
-		var err error
-		*value, err = strconv.ParseBool(envValue)
-		if err != nil {
-			panic(err)
-		}
+func (c *NozzleConfig) InstanceIndex() string {
+	if c.Index != "" {
+		return c.Index
 	}
+	return os.Getenv("CF_INSTANCE_INDEX")
 }
@@ -22,7 +22,7 @@ var _ = Describe("NozzleConfig", func() {
 		Expect(conf.Password).To(Equal("secret"))
 		Expect(conf.TrafficControllerURL).To(Equal("wss://doppler.pilsner.pcf-metrics.com:4443"))
 		Expect(conf.FirehoseSubscriptionID).To(Equal("opentsdb-nozzle"))
-		Expect(conf.OpenTSDBURL).To(Equal("http://localhost"))
+		Expect(conf.OpenTSDBURL).To(Equal("localhost:4242"))
 		Expect(conf.FlushDurationSeconds).To(BeEquivalentTo(15))
 		Expect(conf.InsecureSSLSkipVerify).To(Equal(true))
 		Expect(conf.MetricPrefix).To(Equal("opentsdbclient"))
@@ -33,6 +33,7 @@ var _ = Describe("NozzleConfig", func() {
 		Expect(conf.Index).To(BeEquivalentTo("SOME-GUID"))
 		Expect(conf.IdleTimeoutSeconds).To(BeEquivalentTo(60))
 		Expect(conf.FirehoseReconnectDelay).To(Equal(100 * time.Millisecond))
+		Expect(conf.TimestampPrecision).To(Equal("seconds"))
 	})
 
 	It("successfully overwrites file config values with environmental variables", func() {
@@ -52,6 +53,48 @@ var _ = Describe("NozzleConfig", func() {
 		os.Setenv("NOZZLE_INDEX", "SOME-GUID-2")
 		os.Setenv("NOZZLE_IDLETIMEOUTSECONDS", "50")
 		os.Setenv("NOZZLE_FIREHOSERECONNECTDELAY", "2s")
+		os.Setenv("NOZZLE_TIMESTAMPPRECISION", "milliseconds")
+		os.Setenv("NOZZLE_FORWARDAPPMETRICS", "true")
+		os.Setenv("NOZZLE_CLOUDCONTROLLERURL", "https://api.walnut-env.cf-app.com")
+		os.Setenv("NOZZLE_APPCACHETTLSECONDS", "600")
+		os.Setenv("NOZZLE_NOZZLEINSTANCETAG", "nozzle_index")
+		os.Setenv("NOZZLE_INPUT", "rlp-gateway")
+		os.Setenv("NOZZLE_RLPGATEWAYURL", "https://log-stream.walnut-env.cf-app.com")
+		os.Setenv("NOZZLE_RLPGATEWAYSELECTORS", "gauge,counter")
+		os.Setenv("NOZZLE_UDPLISTENADDRESS", "127.0.0.1:3457")
+		os.Setenv("NOZZLE_RECORDFILE", "/tmp/record.bin")
+		os.Setenv("NOZZLE_REPLAYFILE", "/tmp/replay.bin")
+		os.Setenv("NOZZLE_REPLAYREALTIME", "true")
+		os.Setenv("NOZZLE_REPLAYREWRITETIMESTAMPS", "true")
+		os.Setenv("NOZZLE_DRYRUN", "true")
+		os.Setenv("NOZZLE_DRYRUNFILE", "/tmp/dry-run.txt")
+		os.Setenv("NOZZLE_OUTPUT", "graphite")
+		os.Setenv("NOZZLE_GRAPHITEADDRESS", "graphite.example.com:2004")
+		os.Setenv("NOZZLE_GRAPHITEFORMAT", "pickle")
+		os.Setenv("NOZZLE_GRAPHITETAGSTYLE", "tagged")
+		os.Setenv("NOZZLE_INFLUXDBURL", "udp://influxdb.example.com:8089")
+		os.Setenv("NOZZLE_INFLUXDBDATABASE", "firehose")
+		os.Setenv("NOZZLE_INFLUXDBRETENTIONPOLICY", "two_weeks")
+		os.Setenv("NOZZLE_REMOTEWRITEURL", "https://prometheus.example.com/api/v1/write")
+		os.Setenv("NOZZLE_OPENTSDBURLS", "http://tsd-0:4242, http://tsd-1:4242")
+		os.Setenv("NOZZLE_OPENTSDBBALANCING", "consistent-hash")
+		os.Setenv("NOZZLE_OPENTSDBEJECTAFTER", "5")
+		os.Setenv("NOZZLE_OPENTSDBEJECTCOOLDOWN", "1m")
+		os.Setenv("NOZZLE_OPENTSDBCACERTFILE", "/etc/ssl/ca.crt")
+		os.Setenv("NOZZLE_OPENTSDBCLIENTCERTFILE", "/etc/ssl/client.crt")
+		os.Setenv("NOZZLE_OPENTSDBCLIENTKEYFILE", "/etc/ssl/client.key")
+		os.Setenv("NOZZLE_OPENTSDBINSECURESKIPVERIFY", "true")
+		os.Setenv("NOZZLE_OPENTSDBUSERNAME", "tsd-user")
+		os.Setenv("NOZZLE_OPENTSDBPASSWORD", "tsd-secret")
+		os.Setenv("NOZZLE_OPENTSDBBEARERTOKEN", "tsd-token")
+		os.Setenv("NOZZLE_OPENTSDBHEADERS", `{"X-Scope-OrgID": "cf"}`)
+		os.Setenv("NOZZLE_OPENTSDBCONNECTTIMEOUT", "2s")
+		os.Setenv("NOZZLE_OPENTSDBREQUESTTIMEOUT", "20s")
+		os.Setenv("NOZZLE_OPENTSDBIDLECONNTIMEOUT", "1m")
+		os.Setenv("NOZZLE_OPENTSDBMAXIDLECONNS", "4")
+		os.Setenv("NOZZLE_OPENTSDBTELNETTLS", "true")
+		os.Setenv("NOZZLE_OPENTSDBCOMPRESSION", "deflate")
+		os.Setenv("NOZZLE_OPENTSDBCOMPRESSIONLEVEL", "9")
 
 
 		conf, err := nozzleconfig.Parse("../config/opentsdb-firehose-nozzle.json")
@@ -72,5 +115,87 @@ var _ = Describe("NozzleConfig", func() {
 		Expect(conf.Index).To(BeEquivalentTo("SOME-GUID-2"))
 		Expect(conf.IdleTimeoutSeconds).To(BeEquivalentTo(50))
 		Expect(conf.FirehoseReconnectDelay).To(Equal(2 * time.Second))
+		Expect(conf.TimestampPrecision).To(Equal("milliseconds"))
+		Expect(conf.ForwardAppMetrics).To(Equal(true))
+		Expect(conf.CloudControllerURL).To(Equal("https://api.walnut-env.cf-app.com"))
+		Expect(conf.AppCacheTTLSeconds).To(BeEquivalentTo(600))
+		Expect(conf.NozzleInstanceTag).To(Equal("nozzle_index"))
+		Expect(conf.Input).To(Equal("rlp-gateway"))
+		Expect(conf.RLPGatewayURL).To(Equal("https://log-stream.walnut-env.cf-app.com"))
+		Expect(conf.RLPGatewaySelectors).To(Equal("gauge,counter"))
+		Expect(conf.UDPListenAddress).To(Equal("127.0.0.1:3457"))
+		Expect(conf.RecordFile).To(Equal("/tmp/record.bin"))
+		Expect(conf.ReplayFile).To(Equal("/tmp/replay.bin"))
+		Expect(conf.ReplayRealTime).To(Equal(true))
+		Expect(conf.ReplayRewriteTimestamps).To(Equal(true))
+		Expect(conf.DryRun).To(Equal(true))
+		Expect(conf.DryRunFile).To(Equal("/tmp/dry-run.txt"))
+		Expect(conf.Output).To(Equal("graphite"))
+		Expect(conf.GraphiteAddress).To(Equal("graphite.example.com:2004"))
+		Expect(conf.GraphiteFormat).To(Equal("pickle"))
+		Expect(conf.GraphiteTagStyle).To(Equal("tagged"))
+		Expect(conf.InfluxDBURL).To(Equal("udp://influxdb.example.com:8089"))
+		Expect(conf.InfluxDBDatabase).To(Equal("firehose"))
+		Expect(conf.InfluxDBRetentionPolicy).To(Equal("two_weeks"))
+		Expect(conf.RemoteWriteURL).To(Equal("https://prometheus.example.com/api/v1/write"))
+		Expect(conf.OpenTSDBURLs).To(Equal([]string{"http://tsd-0:4242", "http://tsd-1:4242"}))
+		Expect(conf.OpenTSDBBalancing).To(Equal("consistent-hash"))
+		Expect(conf.OpenTSDBEjectAfter).To(BeEquivalentTo(5))
+		Expect(conf.OpenTSDBEjectCooldown).To(Equal(time.Minute))
+		Expect(conf.OpenTSDBCACertFile).To(Equal("/etc/ssl/ca.crt"))
+		Expect(conf.OpenTSDBClientCertFile).To(Equal("/etc/ssl/client.crt"))
+		Expect(conf.OpenTSDBClientKeyFile).To(Equal("/etc/ssl/client.key"))
+		Expect(conf.OpenTSDBInsecureSkipVerify).To(BeTrue())
+		Expect(conf.OpenTSDBUsername).To(Equal("tsd-user"))
+		Expect(conf.OpenTSDBPassword).To(Equal("tsd-secret"))
+		Expect(conf.OpenTSDBBearerToken).To(Equal("tsd-token"))
+		Expect(conf.OpenTSDBHeaders).To(Equal(map[string]string{"X-Scope-OrgID": "cf"}))
+		Expect(conf.OpenTSDBConnectTimeout).To(Equal(2 * time.Second))
+		Expect(conf.OpenTSDBRequestTimeout).To(Equal(20 * time.Second))
+		Expect(conf.OpenTSDBIdleConnTimeout).To(Equal(time.Minute))
+		Expect(conf.OpenTSDBMaxIdleConns).To(BeEquivalentTo(4))
+		Expect(conf.OpenTSDBTelnetTLS).To(BeTrue())
+		Expect(conf.OpenTSDBCompression).To(Equal("deflate"))
+		Expect(conf.OpenTSDBCompressionLevel).To(Equal(9))
+	})
+
+	It("parses the outputs from the environment", func() {
+		os.Setenv("NOZZLE_OUTPUTS", `[
+			{"Name": "old-cluster", "Type": "opentsdb", "OpenTSDBURL": "http://old:4242", "ExcludeMetrics": ["app.*"]},
+			{"Type": "graphite", "GraphiteAddress": "graphite:2003", "QueueSize": 20, "MaxRetries": 5, "RetryDelay": 2000000000}
+		]`)
+
+		conf, err := nozzleconfig.Parse("../config/opentsdb-firehose-nozzle.json")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.Outputs).To(Equal([]nozzleconfig.OutputConfig{
+			{Name: "old-cluster", Type: "opentsdb", OpenTSDBURL: "http://old:4242", ExcludeMetrics: []string{"app.*"}},
+			{Type: "graphite", GraphiteAddress: "graphite:2003", QueueSize: 20, MaxRetries: 5, RetryDelay: 2 * time.Second},
+		}))
+	})
+
+	Describe("PrimaryOutput", func() {
+		It("describes the output of the top level settings", func() {
+			conf := &nozzleconfig.NozzleConfig{OpenTSDBURL: "localhost:4242", UseTelnetAPI: true}
+			Expect(conf.PrimaryOutput()).To(Equal(nozzleconfig.OutputConfig{
+				Name:         "opentsdb",
+				Type:         "opentsdb",
+				OpenTSDBURL:  "localhost:4242",
+				UseTelnetAPI: true,
+			}))
+		})
+	})
+
+	Describe("InstanceIndex", func() {
+		It("uses the configured index", func() {
+			os.Setenv("CF_INSTANCE_INDEX", "3")
+			conf := &nozzleconfig.NozzleConfig{Index: "SOME-GUID"}
+			Expect(conf.InstanceIndex()).To(Equal("SOME-GUID"))
+		})
+
+		It("falls back to the CF instance index", func() {
+			os.Setenv("CF_INSTANCE_INDEX", "3")
+			conf := &nozzleconfig.NozzleConfig{}
+			Expect(conf.InstanceIndex()).To(Equal("3"))
+		})
 	})
 })
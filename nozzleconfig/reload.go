@@ -0,0 +1,103 @@
+package nozzleconfig
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Change describes a setting that differs between two configurations.
+type Change struct {
+	Setting string
+	Old     interface{}
+	New     interface{}
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s from %v to %v", c.Setting, c.Old, c.New)
+}
+
+// ReloadDiff compares a running configuration with a new one. Reloadable
+// lists the changes that can be applied while the nozzle runs: the metric
+// prefix, the flush interval, the log level and the metric filters of the
+// outputs.
+// RestartRequired names the other settings that differ; they only take
+// effect after a restart.
+func ReloadDiff(running *NozzleConfig, next *NozzleConfig) (reloadable []Change, restartRequired []string) {
+	if running.MetricPrefix != next.MetricPrefix {
+		reloadable = append(reloadable, Change{"MetricPrefix", fmt.Sprintf("%q", running.MetricPrefix), fmt.Sprintf("%q", next.MetricPrefix)})
+	}
+	if running.FlushDurationSeconds != next.FlushDurationSeconds {
+		reloadable = append(reloadable, Change{"FlushDurationSeconds", running.FlushDurationSeconds, next.FlushDurationSeconds})
+	}
+	if running.LogLevel != next.LogLevel {
+		reloadable = append(reloadable, Change{"LogLevel", fmt.Sprintf("%q", running.LogLevel), fmt.Sprintf("%q", next.LogLevel)})
+	}
+
+	outputsComparable := len(running.Outputs) == len(next.Outputs)
+	if outputsComparable {
+		for i := range running.Outputs {
+			prefix := fmt.Sprintf("Outputs[%d].", i)
+			if !equalPatterns(running.Outputs[i].IncludeMetrics, next.Outputs[i].IncludeMetrics) {
+				reloadable = append(reloadable, Change{prefix + "IncludeMetrics", running.Outputs[i].IncludeMetrics, next.Outputs[i].IncludeMetrics})
+			}
+			if !equalPatterns(running.Outputs[i].ExcludeMetrics, next.Outputs[i].ExcludeMetrics) {
+				reloadable = append(reloadable, Change{prefix + "ExcludeMetrics", running.Outputs[i].ExcludeMetrics, next.Outputs[i].ExcludeMetrics})
+			}
+			restartRequired = append(restartRequired, differentFields(prefix, reloadableOutput(running.Outputs[i]), reloadableOutput(next.Outputs[i]))...)
+		}
+	}
+
+	runningRest, nextRest := *running, *next
+	runningRest.MetricPrefix, nextRest.MetricPrefix = "", ""
+	runningRest.FlushDurationSeconds, nextRest.FlushDurationSeconds = 0, 0
+	runningRest.LogLevel, nextRest.LogLevel = "", ""
+	if outputsComparable {
+		runningRest.Outputs, nextRest.Outputs = nil, nil
+	}
+	restartRequired = append(differentFields("", runningRest, nextRest), restartRequired...)
+	return reloadable, restartRequired
+}
+
+// Reloaded returns a copy of the running configuration with the reloadable
+// settings of next applied.
+func Reloaded(running *NozzleConfig, next *NozzleConfig) *NozzleConfig {
+	reloaded := *running
+	reloaded.MetricPrefix = next.MetricPrefix
+	reloaded.FlushDurationSeconds = next.FlushDurationSeconds
+	reloaded.LogLevel = next.LogLevel
+	if len(running.Outputs) == len(next.Outputs) {
+		reloaded.Outputs = make([]OutputConfig, len(running.Outputs))
+		for i, output := range running.Outputs {
+			output.IncludeMetrics = next.Outputs[i].IncludeMetrics
+			output.ExcludeMetrics = next.Outputs[i].ExcludeMetrics
+			reloaded.Outputs[i] = output
+		}
+	}
+	return &reloaded
+}
+
+func reloadableOutput(output OutputConfig) OutputConfig {
+	output.IncludeMetrics = nil
+	output.ExcludeMetrics = nil
+	return output
+}
+
+func equalPatterns(a []string, b []string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// differentFields names the fields of two structs of the same type that
+// are not equal.
+func differentFields(prefix string, a interface{}, b interface{}) []string {
+	aValue, bValue := reflect.ValueOf(a), reflect.ValueOf(b)
+	var fields []string
+	for i := 0; i < aValue.NumField(); i++ {
+		if !reflect.DeepEqual(aValue.Field(i).Interface(), bValue.Field(i).Interface()) {
+			fields = append(fields, prefix+aValue.Type().Field(i).Name)
+		}
+	}
+	return fields
+}
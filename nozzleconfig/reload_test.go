@@ -0,0 +1,82 @@
+package nozzleconfig_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/nozzleconfig"
+)
+
+var _ = Describe("ReloadDiff", func() {
+	var running, next *nozzleconfig.NozzleConfig
+
+	BeforeEach(func() {
+		running = &nozzleconfig.NozzleConfig{
+			MetricPrefix:         "opentsdb.nozzle.",
+			FlushDurationSeconds: 15,
+			UAAURL:               "https://uaa.example.com",
+			Outputs: []nozzleconfig.OutputConfig{
+				{Name: "primary", OpenTSDBURL: "http://tsd.example.com:4242"},
+				{Name: "routers", OpenTSDBURL: "http://other.example.com:4242", IncludeMetrics: []string{"*.router.*"}},
+			},
+		}
+		copied := *running
+		copied.Outputs = append([]nozzleconfig.OutputConfig{}, running.Outputs...)
+		next = &copied
+	})
+
+	It("finds nothing when the configs are equal", func() {
+		reloadable, restartRequired := nozzleconfig.ReloadDiff(running, next)
+		Expect(reloadable).To(BeEmpty())
+		Expect(restartRequired).To(BeEmpty())
+	})
+
+	It("lists the reloadable changes", func() {
+		next.MetricPrefix = "cf."
+		next.FlushDurationSeconds = 30
+		next.LogLevel = "debug"
+		next.Outputs[1].IncludeMetrics = nil
+		next.Outputs[1].ExcludeMetrics = []string{"*.router.*"}
+
+		reloadable, restartRequired := nozzleconfig.ReloadDiff(running, next)
+		Expect(restartRequired).To(BeEmpty())
+		var changes []string
+		for _, change := range reloadable {
+			changes = append(changes, change.String())
+		}
+		Expect(changes).To(Equal([]string{
+			`MetricPrefix from "opentsdb.nozzle." to "cf."`,
+			"FlushDurationSeconds from 15 to 30",
+			`LogLevel from "" to "debug"`,
+			"Outputs[1].IncludeMetrics from [*.router.*] to []",
+			"Outputs[1].ExcludeMetrics from [] to [*.router.*]",
+		}))
+	})
+
+	It("names the settings that need a restart", func() {
+		next.UAAURL = "https://other-uaa.example.com"
+		next.Outputs[0].OpenTSDBURL = "http://new.example.com:4242"
+
+		reloadable, restartRequired := nozzleconfig.ReloadDiff(running, next)
+		Expect(reloadable).To(BeEmpty())
+		Expect(restartRequired).To(Equal([]string{"UAAURL", "Outputs[0].OpenTSDBURL"}))
+	})
+
+	It("needs a restart when outputs are added or removed", func() {
+		next.Outputs = next.Outputs[:1]
+
+		_, restartRequired := nozzleconfig.ReloadDiff(running, next)
+		Expect(restartRequired).To(Equal([]string{"Outputs"}))
+	})
+
+	It("applies only the reloadable settings", func() {
+		next.MetricPrefix = "cf."
+		next.UAAURL = "https://other-uaa.example.com"
+		next.Outputs[1].IncludeMetrics = []string{"*.doppler.*"}
+
+		reloaded := nozzleconfig.Reloaded(running, next)
+		Expect(reloaded.MetricPrefix).To(Equal("cf."))
+		Expect(reloaded.UAAURL).To(Equal("https://uaa.example.com"))
+		Expect(reloaded.Outputs[1].IncludeMetrics).To(Equal([]string{"*.doppler.*"}))
+		Expect(running.Outputs[1].IncludeMetrics).To(Equal([]string{"*.router.*"}))
+	})
+})
@@ -0,0 +1,85 @@
+package nozzleconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+type vcapService struct {
+	Name        string                 `json:"name"`
+	Credentials map[string]interface{} `json:"credentials"`
+}
+
+// applyServiceCredentials sets the settings found in the credentials of
+// the service named by CredentialsService in VCAP_SERVICES, usually a
+// user-provided service bound to the nozzle app. Its keys are setting
+// names, like Password or OpenTSDBBearerToken.
+func (c *NozzleConfig) applyServiceCredentials() []string {
+	if c.CredentialsService == "" {
+		return nil
+	}
+
+	vcapServices := os.Getenv("VCAP_SERVICES")
+	if vcapServices == "" {
+		return []string{fmt.Sprintf("CredentialsService is %q but VCAP_SERVICES is not set", c.CredentialsService)}
+	}
+	decoder := json.NewDecoder(strings.NewReader(vcapServices))
+	decoder.UseNumber()
+	var services map[string][]vcapService
+	if err := decoder.Decode(&services); err != nil {
+		return []string{fmt.Sprintf("VCAP_SERVICES: invalid JSON: %s", err)}
+	}
+
+	for _, instances := range services {
+		for _, service := range instances {
+			if service.Name != c.CredentialsService {
+				continue
+			}
+			// a shared service can hold credentials for other apps as well
+			credentials := make(map[string]interface{})
+			for key, value := range service.Credentials {
+				if _, ok := fieldNamed(reflect.TypeOf(*c), key); ok {
+					credentials[key] = value
+				}
+			}
+			var problems []string
+			for _, problem := range decodeValue("", credentials, reflect.ValueOf(c).Elem()) {
+				problems = append(problems, fmt.Sprintf("credentials of service %s: %s", service.Name, problem))
+			}
+			return problems
+		}
+	}
+	return []string{fmt.Sprintf("CredentialsService %q is not bound to the app", c.CredentialsService)}
+}
+
+// readSecretFiles replaces the secrets whose *File setting names a file,
+// like a mounted Kubernetes or BOSH secret, with the contents of the file.
+func (c *NozzleConfig) readSecretFiles() []string {
+	var problems []string
+	read := func(name string, secretFile string, secret *string) {
+		if secretFile == "" {
+			return
+		}
+		contents, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: can not read the secret: %s", name, err))
+			return
+		}
+		*secret = strings.TrimRight(string(contents), "\r\n")
+	}
+
+	read("PasswordFile", c.PasswordFile, &c.Password)
+	read("UAAClientSecretFile", c.UAAClientSecretFile, &c.UAAClientSecret)
+	read("OpenTSDBPasswordFile", c.OpenTSDBPasswordFile, &c.OpenTSDBPassword)
+	read("OpenTSDBBearerTokenFile", c.OpenTSDBBearerTokenFile, &c.OpenTSDBBearerToken)
+	for i := range c.Outputs {
+		prefix := fmt.Sprintf("Outputs[%d].", i)
+		read(prefix+"OpenTSDBPasswordFile", c.Outputs[i].OpenTSDBPasswordFile, &c.Outputs[i].OpenTSDBPassword)
+		read(prefix+"OpenTSDBBearerTokenFile", c.Outputs[i].OpenTSDBBearerTokenFile, &c.Outputs[i].OpenTSDBBearerToken)
+	}
+	return problems
+}
@@ -0,0 +1,260 @@
+package nozzleconfig
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/opentsdbclient"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/rlpgateway"
+)
+
+const maxFirehoseReconnectDelay = 10 * time.Minute
+
+// ValidationError lists every problem found in a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  - %s", strings.Join(e.Problems, "\n  - "))
+}
+
+// Validate checks the configuration and returns a *ValidationError listing
+// every problem, or nil.
+func (c *NozzleConfig) Validate() error {
+	if problems := c.validationProblems(); len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) addf(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) required(name string, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		v.addf("%s is required", name)
+		return false
+	}
+	return true
+}
+
+func (v *validator) url(name string, value string, schemes ...string) {
+	if !v.required(name, value) {
+		return
+	}
+	parsed, err := url.Parse(value)
+	if err != nil {
+		v.addf("%s is not a valid URL", name)
+		return
+	}
+	for _, scheme := range schemes {
+		if parsed.Scheme == scheme {
+			if parsed.Host == "" {
+				v.addf("%s %q has no host", name, MaskURL(value))
+			}
+			return
+		}
+	}
+	v.addf("%s %q must start with %s://", name, MaskURL(value), strings.Join(schemes, ":// or "))
+}
+
+func (v *validator) address(name string, value string) {
+	if !v.required(name, value) {
+		return
+	}
+	if strings.Contains(value, "://") {
+		v.addf("%s %q must be a host:port address without a scheme", name, value)
+		return
+	}
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		v.addf("%s %q must be a host:port address", name, value)
+	}
+}
+
+func (v *validator) notNegative(name string, value time.Duration) {
+	if value < 0 {
+		v.addf("%s must not be negative, got %s", name, value)
+	}
+}
+
+func (v *validator) check(err error, name string) {
+	if err != nil {
+		v.addf("%s: %s", name, err)
+	}
+}
+
+func (c *NozzleConfig) validationProblems() []string {
+	v := &validator{}
+
+	switch c.Input {
+	case "", FirehoseInput:
+		v.url("TrafficControllerURL", c.TrafficControllerURL, "ws", "wss")
+		v.required("FirehoseSubscriptionID", c.FirehoseSubscriptionID)
+		c.validateUAA(v)
+	case RLPGatewayInput:
+		v.url("RLPGatewayURL", c.RLPGatewayURL, "http", "https")
+		v.required("FirehoseSubscriptionID", c.FirehoseSubscriptionID)
+		_, err := rlpgateway.ParseSelectors(c.RLPGatewaySelectors)
+		v.check(err, "RLPGatewaySelectors")
+		c.validateUAA(v)
+	case UDPInput:
+		v.address("UDPListenAddress", c.UDPListenAddress)
+	case ReplayInput:
+		v.required("ReplayFile", c.ReplayFile)
+	default:
+		v.addf("Input %q is unknown, expected %q, %q, %q or %q", c.Input, FirehoseInput, RLPGatewayInput, UDPInput, ReplayInput)
+	}
+
+	if c.FlushDurationSeconds == 0 {
+		v.addf("FlushDurationSeconds must be positive")
+	}
+	v.notNegative("FirehoseReconnectDelay", c.FirehoseReconnectDelay)
+	if c.FirehoseReconnectDelay > maxFirehoseReconnectDelay {
+		v.addf("FirehoseReconnectDelay must be at most %s, got %s", maxFirehoseReconnectDelay, c.FirehoseReconnectDelay)
+	} else if c.FirehoseReconnectDelay > 0 && c.FirehoseReconnectDelay < time.Millisecond {
+		v.addf("FirehoseReconnectDelay is %s; numbers in the config file are nanoseconds, use \"%ds\" for %d seconds", c.FirehoseReconnectDelay, int64(c.FirehoseReconnectDelay), int64(c.FirehoseReconnectDelay))
+	}
+
+	v.notNegative("ConfigWatchInterval", c.ConfigWatchInterval)
+
+	_, err := logger.ParseLevel(c.LogLevel)
+	v.check(err, "LogLevel")
+	_, err = logger.ParseFormat(c.LogFormat)
+	v.check(err, "LogFormat")
+	v.notNegative("LogRateLimit", c.LogRateLimit)
+
+	_, err = opentsdbclient.ParseTimestampPrecision(c.TimestampPrecision)
+	v.check(err, "TimestampPrecision")
+	_, err = opentsdbclient.ParseOverflowPolicy(c.BufferOverflowPolicy)
+	v.check(err, "BufferOverflowPolicy")
+	if c.BufferHighWaterPercent > 100 {
+		v.addf("BufferHighWaterPercent must be at most 100, got %d", c.BufferHighWaterPercent)
+	}
+	v.check(opentsdbclient.ValidateAppTags(c.AppMetricTags), "AppMetricTags")
+	if c.CloudControllerURL != "" {
+		v.url("CloudControllerURL", c.CloudControllerURL, "http", "https")
+	}
+
+	if c.DryRun {
+		return v.problems
+	}
+	if len(c.Outputs) == 0 {
+		validateOutput(v, "", c.PrimaryOutput())
+		return v.problems
+	}
+	names := make(map[string]bool)
+	for i, output := range c.Outputs {
+		validateOutput(v, fmt.Sprintf("Outputs[%d].", i), output)
+		if output.Name != "" {
+			if names[output.Name] {
+				v.addf("Outputs[%d].Name %q is used by another output", i, output.Name)
+			}
+			names[output.Name] = true
+		}
+	}
+	return v.problems
+}
+
+func (c *NozzleConfig) validateUAA(v *validator) {
+	if c.DisableAccessControl {
+		return
+	}
+	v.url("UAAURL", c.UAAURL, "http", "https")
+	if c.UAAClientID == "" {
+		v.required("Username", c.Username)
+		v.required("Password", c.Password)
+		if len(c.UAAScopes) > 0 {
+			v.addf("UAAScopes can only be requested with UAAClientID")
+		}
+		return
+	}
+	v.required("UAAClientSecret", c.UAAClientSecret)
+	if c.Username != "" {
+		v.addf("UAAClientID and Username are mutually exclusive")
+	}
+}
+
+// validateOutput checks an output, naming its settings with prefix so that
+// the problems of each entry in Outputs can be told apart.
+func validateOutput(v *validator, prefix string, output OutputConfig) {
+	switch output.Type {
+	case "", OpenTSDBOutput:
+		validateOpenTSDBOutput(v, prefix, output)
+	case GraphiteOutput:
+		v.address(prefix+"GraphiteAddress", output.GraphiteAddress)
+		_, err := poster.ParseGraphiteFormat(output.GraphiteFormat)
+		v.check(err, prefix+"GraphiteFormat")
+		_, err = poster.ParseGraphiteTagStyle(output.GraphiteTagStyle)
+		v.check(err, prefix+"GraphiteTagStyle")
+	case InfluxDBOutput:
+		v.url(prefix+"InfluxDBURL", output.InfluxDBURL, "http", "https", "udp")
+		if strings.HasPrefix(output.InfluxDBURL, "udp://") {
+			break
+		}
+		if output.InfluxDBBucket != "" {
+			v.required(prefix+"InfluxDBOrganization", output.InfluxDBOrganization)
+		} else {
+			v.required(prefix+"InfluxDBDatabase", output.InfluxDBDatabase)
+		}
+	case RemoteWriteOutput:
+		v.url(prefix+"RemoteWriteURL", output.RemoteWriteURL, "http", "https")
+	default:
+		v.addf("%sType %q is unknown, expected %q, %q, %q or %q", prefix, output.Type, OpenTSDBOutput, GraphiteOutput, InfluxDBOutput, RemoteWriteOutput)
+	}
+
+	for _, pattern := range append(append([]string{}, output.IncludeMetrics...), output.ExcludeMetrics...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			v.addf("%sIncludeMetrics/ExcludeMetrics pattern %q is invalid: %s", prefix, pattern, err)
+		}
+	}
+	v.notNegative(prefix+"RetryDelay", output.RetryDelay)
+}
+
+func validateOpenTSDBOutput(v *validator, prefix string, output OutputConfig) {
+	urls := output.OpenTSDBURLs
+	name := prefix + "OpenTSDBURLs"
+	if len(urls) == 0 {
+		urls = []string{output.OpenTSDBURL}
+		name = prefix + "OpenTSDBURL"
+	}
+	for _, tsdURL := range urls {
+		if output.UseTelnetAPI && strings.Contains(tsdURL, "://") {
+			v.addf("%s %q is a URL but %sUseTelnetAPI is set; use host:port for the telnet API or unset UseTelnetAPI", name, MaskURL(tsdURL), prefix)
+		} else if output.UseTelnetAPI {
+			v.address(name, tsdURL)
+		} else {
+			v.url(name, tsdURL, "http", "https")
+		}
+	}
+
+	_, err := poster.ParseBalancing(output.OpenTSDBBalancing)
+	v.check(err, prefix+"OpenTSDBBalancing")
+	_, err = poster.ParseCompression(output.OpenTSDBCompression)
+	v.check(err, prefix+"OpenTSDBCompression")
+	if output.OpenTSDBCompressionLevel < 0 || output.OpenTSDBCompressionLevel > 9 {
+		v.addf("%sOpenTSDBCompressionLevel must be between 1 and 9, or 0 for the default, got %d", prefix, output.OpenTSDBCompressionLevel)
+	}
+	if (output.OpenTSDBClientCertFile == "") != (output.OpenTSDBClientKeyFile == "") {
+		v.addf("%sOpenTSDBClientCertFile and %sOpenTSDBClientKeyFile must be set together", prefix, prefix)
+	}
+	if output.OpenTSDBBearerToken != "" && output.OpenTSDBUsername != "" {
+		v.addf("%sOpenTSDBBearerToken and %sOpenTSDBUsername are mutually exclusive", prefix, prefix)
+	}
+
+	v.notNegative(prefix+"OpenTSDBEjectCooldown", output.OpenTSDBEjectCooldown)
+	v.notNegative(prefix+"OpenTSDBConnectTimeout", output.OpenTSDBConnectTimeout)
+	v.notNegative(prefix+"OpenTSDBRequestTimeout", output.OpenTSDBRequestTimeout)
+	v.notNegative(prefix+"OpenTSDBIdleConnTimeout", output.OpenTSDBIdleConnTimeout)
+}
@@ -0,0 +1,180 @@
+package nozzleconfig_test
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/nozzleconfig"
+)
+
+var _ = Describe("Validate", func() {
+	var conf *nozzleconfig.NozzleConfig
+
+	BeforeEach(func() {
+		os.Clearenv()
+		conf = &nozzleconfig.NozzleConfig{
+			UAAURL:                 "https://uaa.example.com",
+			Username:               "nozzle",
+			Password:               "secret",
+			TrafficControllerURL:   "wss://doppler.example.com:443",
+			FirehoseSubscriptionID: "opentsdb-nozzle",
+			OpenTSDBURL:            "http://tsd.example.com:4242",
+			FlushDurationSeconds:   15,
+			FirehoseReconnectDelay: 100 * time.Millisecond,
+		}
+	})
+
+	problems := func() []string {
+		err := conf.Validate()
+		if err == nil {
+			return nil
+		}
+		Expect(err).To(BeAssignableToTypeOf(&nozzleconfig.ValidationError{}))
+		return err.(*nozzleconfig.ValidationError).Problems
+	}
+
+	It("accepts a valid config", func() {
+		Expect(conf.Validate()).To(Succeed())
+	})
+
+	It("collects every problem", func() {
+		conf = &nozzleconfig.NozzleConfig{}
+		Expect(problems()).To(Equal([]string{
+			"TrafficControllerURL is required",
+			"FirehoseSubscriptionID is required",
+			"UAAURL is required",
+			"Username is required",
+			"Password is required",
+			"FlushDurationSeconds must be positive",
+			"OpenTSDBURL is required",
+		}))
+		Expect(conf.Validate().Error()).To(HavePrefix("invalid configuration:\n  - TrafficControllerURL is required\n  - FirehoseSubscriptionID is required\n"))
+	})
+
+	It("does not require UAA credentials when access control is disabled", func() {
+		conf.UAAURL = ""
+		conf.Username = ""
+		conf.Password = ""
+		conf.DisableAccessControl = true
+		Expect(conf.Validate()).To(Succeed())
+	})
+
+	It("requires a client secret instead of a password with a UAA client", func() {
+		conf.Password = ""
+		conf.UAAClientID = "opentsdb-nozzle"
+		conf.UAAScopes = []string{"doppler.firehose"}
+		Expect(problems()).To(ConsistOf("UAAClientSecret is required", "UAAClientID and Username are mutually exclusive"))
+
+		conf.Username = ""
+		conf.UAAClientSecret = "client-secret"
+		Expect(conf.Validate()).To(Succeed())
+
+		conf.UAAClientID = ""
+		conf.Username = "nozzle"
+		conf.Password = "secret"
+		Expect(problems()).To(ConsistOf("UAAScopes can only be requested with UAAClientID"))
+	})
+
+	It("checks that the OpenTSDB URL matches the protocol", func() {
+		conf.UseTelnetAPI = true
+		Expect(problems()).To(ConsistOf(`OpenTSDBURL "http://tsd.example.com:4242" is a URL but UseTelnetAPI is set; use host:port for the telnet API or unset UseTelnetAPI`))
+
+		conf.OpenTSDBURL = "tsd.example.com"
+		Expect(problems()).To(ConsistOf(`OpenTSDBURL "tsd.example.com" must be a host:port address`))
+
+		conf.UseTelnetAPI = false
+		Expect(problems()).To(ConsistOf(`OpenTSDBURL "tsd.example.com" must start with http:// or https://`))
+
+		conf.OpenTSDBURLs = []string{"https://tsd-0:4242", "tsd-1:4242"}
+		Expect(problems()).To(ConsistOf(`OpenTSDBURLs "tsd-1:4242" must start with http:// or https://`))
+	})
+
+	It("checks the URLs of the input", func() {
+		conf.TrafficControllerURL = "https://doppler.example.com"
+		conf.Input = "rlp-gateway"
+		Expect(problems()).To(ConsistOf(`RLPGatewayURL is required`))
+
+		conf.Input = "firehose"
+		Expect(problems()).To(ConsistOf(`TrafficControllerURL "https://doppler.example.com" must start with ws:// or wss://`))
+
+		conf.Input = "kafka"
+		Expect(problems()).To(ConsistOf(`Input "kafka" is unknown, expected "firehose", "rlp-gateway", "udp" or "replay"`))
+	})
+
+	It("bounds the reconnect delay", func() {
+		conf.FirehoseReconnectDelay = -time.Second
+		Expect(problems()).To(ConsistOf("FirehoseReconnectDelay must not be negative, got -1s"))
+
+		conf.FirehoseReconnectDelay = time.Hour
+		Expect(problems()).To(ConsistOf("FirehoseReconnectDelay must be at most 10m0s, got 1h0m0s"))
+
+		conf.FirehoseReconnectDelay = 5
+		Expect(problems()).To(ConsistOf(`FirehoseReconnectDelay is 5ns; numbers in the config file are nanoseconds, use "5s" for 5 seconds`))
+	})
+
+	It("checks the metrics buffer settings", func() {
+		conf.BufferOverflowPolicy = "drop-everything"
+		conf.BufferHighWaterPercent = 150
+		Expect(problems()).To(Equal([]string{
+			`BufferOverflowPolicy: unknown overflow policy "drop-everything", expected "drop-oldest", "drop-newest" or "block"`,
+			"BufferHighWaterPercent must be at most 100, got 150",
+		}))
+	})
+
+	It("checks the app metric tags", func() {
+		conf.AppMetricTags = []string{"app_name", "app_guid"}
+		Expect(problems()).To(ConsistOf(`AppMetricTags: unknown app tag "app_guid", expected one of app_id, instance_index, app_name, space_name, org_name`))
+	})
+
+	It("requires the organization of an InfluxDB 2 bucket instead of a database", func() {
+		conf.Output = "influxdb"
+		conf.InfluxDBURL = "http://influxdb:8086"
+		conf.InfluxDBBucket = "firehose"
+		Expect(problems()).To(ConsistOf("InfluxDBOrganization is required"))
+
+		conf.InfluxDBOrganization = "my-org"
+		Expect(problems()).To(BeEmpty())
+	})
+
+	It("names the output of each problem", func() {
+		conf.Outputs = []nozzleconfig.OutputConfig{
+			{Name: "tsd", Type: "opentsdb", OpenTSDBURL: "tsd:4242", OpenTSDBClientCertFile: "client.crt"},
+			{Name: "tsd", Type: "influxdb", InfluxDBURL: "http://influxdb:8086", IncludeMetrics: []string{"[app"}},
+			{Type: "graphite", GraphiteAddress: "graphite", RetryDelay: -time.Second},
+		}
+		Expect(problems()).To(Equal([]string{
+			`Outputs[0].OpenTSDBURL "tsd:4242" must start with http:// or https://`,
+			"Outputs[0].OpenTSDBClientCertFile and Outputs[0].OpenTSDBClientKeyFile must be set together",
+			"Outputs[1].InfluxDBDatabase is required",
+			`Outputs[1].IncludeMetrics/ExcludeMetrics pattern "[app" is invalid: syntax error in pattern`,
+			`Outputs[1].Name "tsd" is used by another output`,
+			`Outputs[2].GraphiteAddress "graphite" must be a host:port address`,
+			"Outputs[2].RetryDelay must not be negative, got -1s",
+		}))
+	})
+
+	It("skips the outputs in dry run mode", func() {
+		conf.OpenTSDBURL = ""
+		conf.DryRun = true
+		Expect(conf.Validate()).To(Succeed())
+	})
+
+	Describe("Parse", func() {
+		It("returns the invalid environment variables and the validation problems together", func() {
+			os.Setenv("NOZZLE_FLUSHDURATIONSECONDS", "often")
+			os.Setenv("NOZZLE_USETELNETAPI", "yes please")
+			os.Setenv("NOZZLE_FIREHOSERECONNECTDELAY", "100")
+			os.Setenv("NOZZLE_OPENTSDBURL", "")
+			os.Setenv("NOZZLE_TIMESTAMPPRECISION", "minutes")
+
+			_, err := nozzleconfig.Parse("../config/opentsdb-firehose-nozzle.json")
+			Expect(err).To(MatchError(`invalid configuration:
+  - NOZZLE_FLUSHDURATIONSECONDS: "often" is not a non-negative number
+  - NOZZLE_USETELNETAPI: "yes please" is not true or false
+  - NOZZLE_FIREHOSERECONNECTDELAY: "100" is not a duration like 500ms or 2m
+  - TimestampPrecision: unknown timestamp precision "minutes", expected "seconds" or "milliseconds"`))
+		})
+	})
+})
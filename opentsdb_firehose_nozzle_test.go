@@ -19,6 +19,7 @@ import (
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/util"
@@ -157,7 +158,7 @@ var _ = Describe("OpentsdbFirehoseNozzle", func() {
 			var receivedBytes []byte
 			Eventually(fakeOpenTSDBChan).Should(Receive(&receivedBytes))
 			receivedMetrics := strings.Split(string(receivedBytes), "\n")
-			Expect(receivedMetrics).To(HaveLen(7))
+			Expect(receivedMetrics).To(HaveLen(20))
 			Expect(receivedMetrics).To(ContainElement(fmt.Sprintf("put origin.metricName %d %f deployment=deployment-name index=SOME-METRIC-GUID job=doppler", 1, 5.0)))
 			Expect(receivedMetrics).To(ContainElement(fmt.Sprintf("put origin.metricName %d %f deployment=deployment-name index=SOME-METRIC-GUID-2 job=gorouter", 2, 10.0)))
 			Expect(receivedMetrics).To(ContainElement(fmt.Sprintf("put origin.counterName %d %f deployment=deployment-name index=SOME-METRIC-GUID-3 job=doppler", 3, 15.0)))
@@ -167,6 +168,28 @@ var _ = Describe("OpentsdbFirehoseNozzle", func() {
 
 	})
 
+	Context("with the dry-run flag", func() {
+		BeforeEach(func() {
+			var err error
+			nozzleCommand := exec.Command(pathToNozzleExecutable, "-config", "fixtures/telnet-test-config.json", "-dry-run")
+			nozzleSession, err = gexec.Start(
+				nozzleCommand,
+				gexec.NewPrefixedWriter("[o][nozzle] ", GinkgoWriter),
+				gexec.NewPrefixedWriter("[e][nozzle] ", GinkgoWriter),
+			)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("writes the metrics to stdout instead of posting them", func(done Done) {
+			sendEventsThroughFirehose(fakeFirehoseInputChan)
+
+			Eventually(nozzleSession.Out, "2s").Should(gbytes.Say(fmt.Sprintf("put origin.metricName %d %f deployment=deployment-name index=SOME-METRIC-GUID job=doppler", 1, 5.0)))
+			Consistently(fakeOpenTSDBChan).ShouldNot(Receive())
+
+			close(done)
+		}, 4.0)
+	})
+
 })
 
 func sendEventsThroughFirehose(fakeFirehoseInputChan chan *events.Envelope) {
@@ -296,7 +319,7 @@ func fakeOpenTSDBTelnetListener() *net.TCPListener {
 func handleRequest(conn net.Conn) {
 
 	// Make a buffer to hold incoming data.
-	buf := make([]byte, 1024)
+	buf := make([]byte, 4096)
 	// Read the incoming connection into the buffer.
 	if conn != nil {
 		_, err := conn.Read(buf)
@@ -0,0 +1,134 @@
+package opentsdbclient
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/cloudcontroller"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+)
+
+// AppTags are the tags app metrics can carry. OpenTSDB stores at most 8
+// tags per point by default (tsd.storage.max_tags), which the 4 envelope
+// tags, all app tags and a nozzle instance tag would exceed, so
+// DefaultAppTags leaves out the space and org names.
+var (
+	AppTags        = []string{"app_id", "instance_index", "app_name", "space_name", "org_name"}
+	DefaultAppTags = []string{"app_id", "instance_index", "app_name"}
+)
+
+func ValidateAppTags(tags []string) error {
+	for _, tag := range tags {
+		if !containsString(AppTags, tag) {
+			return fmt.Errorf("unknown app tag %q, expected one of %s", tag, strings.Join(AppTags, ", "))
+		}
+	}
+	return nil
+}
+
+type AppMetadataResolver interface {
+	Lookup(appGUID string) (cloudcontroller.AppMetadata, bool)
+}
+
+func (c *Client) SetForwardAppMetrics(forward bool) {
+	c.forwardAppMetrics = forward
+}
+
+// SetAppTags selects which of AppTags app metrics are tagged with; an
+// empty list selects DefaultAppTags.
+func (c *Client) SetAppTags(tags []string) {
+	if len(tags) == 0 {
+		tags = DefaultAppTags
+	}
+	c.appTagNames = tags
+}
+
+func (c *Client) SetAppMetadataResolver(resolver AppMetadataResolver) {
+	c.appMetadata = resolver
+}
+
+func (c *Client) addContainerMetrics(envelope *events.Envelope) {
+	containerMetric := envelope.GetContainerMetric()
+	tags := c.appTags(envelope, containerMetric.GetApplicationId(), containerMetric.GetInstanceIndex())
+
+	c.addMetric(envelope, "app.cpuPercentage", containerMetric.GetCpuPercentage(), tags)
+	c.addMetric(envelope, "app.memoryBytes", float64(containerMetric.GetMemoryBytes()), tags)
+	c.addMetric(envelope, "app.diskBytes", float64(containerMetric.GetDiskBytes()), tags)
+}
+
+func (c *Client) addHTTPMetric(envelope *events.Envelope) {
+	httpStartStop := envelope.GetHttpStartStop()
+	if httpStartStop.GetApplicationId() == nil {
+		return
+	}
+	tags := c.appTags(envelope, formatUUID(httpStartStop.GetApplicationId()), httpStartStop.GetInstanceIndex())
+
+	responseTime := httpStartStop.GetStopTimestamp() - httpStartStop.GetStartTimestamp()
+	c.addMetric(envelope, "app.http.responseTimeMs", float64(responseTime)/float64(time.Millisecond), tags)
+}
+
+func (c *Client) appTags(envelope *events.Envelope, appGUID string, instanceIndex int32) poster.Tags {
+	appTags := map[string]string{
+		"app_id":         appGUID,
+		"instance_index": strconv.Itoa(int(instanceIndex)),
+	}
+	if c.appMetadata != nil {
+		if metadata, found := c.appMetadata.Lookup(appGUID); found {
+			setTagIfPresent(appTags, "app_name", metadata.AppName)
+			setTagIfPresent(appTags, "space_name", metadata.SpaceName)
+			setTagIfPresent(appTags, "org_name", metadata.OrgName)
+		}
+	}
+
+	tags := c.envelopeTags(envelope)
+	extra := make(map[string]string, len(tags.Extra)+len(c.appTagNames))
+	for key, value := range tags.Extra {
+		extra[key] = value
+	}
+	for _, key := range c.appTagNames {
+		if value, ok := appTags[key]; ok {
+			extra[key] = value
+		}
+	}
+	tags.Extra = extra
+	return tags
+}
+
+func setTagIfPresent(tags map[string]string, key string, value string) {
+	value = sanitizeTagValue(value)
+	if value != "" {
+		tags[key] = value
+	}
+}
+
+// sanitizeTagValue replaces the characters OpenTSDB does not accept in tag
+// values, such as spaces in app names.
+func sanitizeTagValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_./", r) {
+			return r
+		}
+		return '_'
+	}, value)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func formatUUID(uuid *events.UUID) string {
+	var uuidBytes [16]byte
+	binary.LittleEndian.PutUint64(uuidBytes[:8], uuid.GetLow())
+	binary.LittleEndian.PutUint64(uuidBytes[8:], uuid.GetHigh())
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuidBytes[0:4], uuidBytes[4:6], uuidBytes[6:8], uuidBytes[8:10], uuidBytes[10:])
+}
@@ -0,0 +1,178 @@
+package opentsdbclient
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+)
+
+// OverflowPolicy decides what happens to a point that does not fit in the
+// metrics buffer.
+type OverflowPolicy int
+
+const (
+	// DropOldest makes room by dropping the oldest buffered points.
+	DropOldest OverflowPolicy = iota
+	// DropNewest drops the points that do not fit.
+	DropNewest
+	// Block keeps the points, also when a post fails; BufferFull tells
+	// the caller to stop adding points until the buffer was posted.
+	Block
+)
+
+func ParseOverflowPolicy(policy string) (OverflowPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "", "drop-oldest":
+		return DropOldest, nil
+	case "drop-newest":
+		return DropNewest, nil
+	case "block":
+		return Block, nil
+	default:
+		return DropOldest, fmt.Errorf("unknown overflow policy %q, expected \"drop-oldest\", \"drop-newest\" or \"block\"", policy)
+	}
+}
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case Block:
+		return "block"
+	default:
+		return "drop-oldest"
+	}
+}
+
+// BufferLimits caps the points buffered between two posts. Zero means no
+// limit. Bytes are the approximate memory the points take. A warning
+// is logged when the buffer goes above HighWaterPercent of a limit.
+type BufferLimits struct {
+	MaxPoints        int
+	MaxBytes         int
+	Policy           OverflowPolicy
+	HighWaterPercent int
+}
+
+// pointOverhead approximates the JSON of a point without its strings.
+const pointOverhead = 80
+
+// timestampKeyOverhead approximates the memory of an entry in the map of
+// timestamp keys, besides the key itself.
+const timestampKeyOverhead = 48
+
+// bufferedSize is the approximate memory a buffered point takes, with its
+// timestamp key.
+func bufferedSize(metric poster.Metric, key string) int {
+	size := pointSize(metric)
+	if key != "" {
+		size += len(key) + timestampKeyOverhead
+	}
+	return size
+}
+
+func pointSize(metric poster.Metric) int {
+	size := pointOverhead + len(metric.Metric) + len(metric.Tags.Deployment) + len(metric.Tags.Job) + len(metric.Tags.Index) + len(metric.Tags.IP)
+	for key, value := range metric.Tags.Extra {
+		size += len(key) + len(value) + 6
+	}
+	return size
+}
+
+func (c *Client) SetBufferLimits(limits BufferLimits) {
+	c.bufferLimits = limits
+}
+
+// BufferFull reports whether a buffer with the Block policy has reached
+// one of its limits, so that it must be posted before more points are
+// added. With the other policies the buffer makes room by itself.
+func (c *Client) BufferFull() bool {
+	limits := c.bufferLimits
+	if limits.Policy != Block {
+		return false
+	}
+	return (limits.MaxPoints > 0 && len(c.metrics) >= limits.MaxPoints) ||
+		(limits.MaxBytes > 0 && c.bufferedBytes >= limits.MaxBytes)
+}
+
+// SetFlushThresholds sets the number of points and their approximate size
+// at which BatchReady reports a batch worth posting. Zero disables a
+// threshold.
+func (c *Client) SetFlushThresholds(points int, bytes int) {
+	c.flushPoints = points
+	c.flushBytes = bytes
+}
+
+// BatchReady reports whether the buffer has reached a flush threshold.
+func (c *Client) BatchReady() bool {
+	return (c.flushPoints > 0 && len(c.metrics) >= c.flushPoints) ||
+		(c.flushBytes > 0 && c.bufferedBytes >= c.flushBytes)
+}
+
+func (c *Client) fits(size int) bool {
+	limits := c.bufferLimits
+	return (limits.MaxPoints == 0 || len(c.metrics)+1 <= limits.MaxPoints) &&
+		(limits.MaxBytes == 0 || c.bufferedBytes+size <= limits.MaxBytes)
+}
+
+// buffer adds a point to the buffer, applying the overflow policy. The
+// timestamp keys of the buffered points count towards MaxBytes, and only
+// the buffered points are tracked, so that the keys can not outgrow the
+// limits either.
+func (c *Client) buffer(metric poster.Metric) {
+	key := c.timestampKey(metric)
+	size := bufferedSize(metric, key)
+	if c.bufferLimits.Policy == DropOldest {
+		for len(c.metrics) > 0 && !c.fits(size) {
+			c.dropOldest()
+		}
+	}
+	// with the block policy the caller stops adding points to a full
+	// buffer, so dropping here only keeps the buffer bounded
+	if !c.fits(size) {
+		c.totalMetricsDroppedOnOverflow++
+		return
+	}
+
+	c.rememberTimestamp(key)
+	c.metrics = append(c.metrics, metric)
+	c.bufferedBytes += size
+	c.checkHighWater()
+}
+
+func (c *Client) dropOldest() {
+	oldest := c.metrics[0]
+	key := c.timestampKey(oldest)
+	c.forgetTimestamp(key)
+	c.bufferedBytes -= bufferedSize(oldest, key)
+	c.metrics = c.metrics[1:]
+	c.totalMetricsDroppedOnOverflow++
+}
+
+func (c *Client) checkHighWater() {
+	limits := c.bufferLimits
+	if c.aboveHighWater || limits.HighWaterPercent == 0 {
+		return
+	}
+	above := (limits.MaxPoints > 0 && len(c.metrics)*100 >= limits.MaxPoints*limits.HighWaterPercent) ||
+		(limits.MaxBytes > 0 && c.bufferedBytes*100 >= limits.MaxBytes*limits.HighWaterPercent)
+	if !above {
+		return
+	}
+	c.aboveHighWater = true
+	logger.Warn("The metrics buffer is above its high-water mark", logger.Fields{
+		"points":     len(c.metrics),
+		"bytes":      c.bufferedBytes,
+		"max_points": limits.MaxPoints,
+		"max_bytes":  limits.MaxBytes,
+		"policy":     limits.Policy,
+	})
+}
+
+func (c *Client) resetBuffer() {
+	c.metrics = nil
+	c.bufferedBytes = 0
+	c.aboveHighWater = false
+}
@@ -0,0 +1,21 @@
+package opentsdbclient
+
+import "github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+
+// BytesSentReporter is implemented by posters that know how many bytes
+// they sent, before and after compression.
+type BytesSentReporter interface {
+	BytesSent() (uncompressed uint64, compressed uint64)
+}
+
+func (c *Client) populateBytesSentMetrics(sendingQueue []poster.Metric) []poster.Metric {
+	reporter, ok := c.transporter.(BytesSentReporter)
+	if !ok {
+		return sendingQueue
+	}
+
+	uncompressed, compressed := reporter.BytesSent()
+	sendingQueue = c.addInternalMetric("totalUncompressedBytesSent", float64(uncompressed), sendingQueue)
+	sendingQueue = c.addInternalMetric("totalCompressedBytesSent", float64(compressed), sendingQueue)
+	return sendingQueue
+}
@@ -1,11 +1,12 @@
 package opentsdbclient
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
-	"log"
 )
 
 const DefaultAPIURL = "http://locahost/api"
@@ -22,9 +23,30 @@ type Client struct {
 	job                      string
 	index                    string
 	ip                       string
+	precision                TimestampPrecision
+	forwardAppMetrics        bool
+	appMetadata              AppMetadataResolver
+	appTagNames              []string
+	forwardEnvelopeTags      bool
+	instanceTagName          string
+	instanceTagValue         string
+	seenTimestamps           map[string]int
 	totalMessagesReceived    float64
 	totalMetricsSent         float64
 	totalFirehoseDisconnects float64
+	totalTimestampCollisions float64
+	totalEnvelopesFiltered   float64
+	envelopesReceived        map[events.Envelope_EventType]float64
+	postFailures             map[string]float64
+	lastPostDuration         time.Duration
+	tokenRefreshes           TokenRefreshReporter
+
+	bufferLimits                  BufferLimits
+	bufferedBytes                 int
+	aboveHighWater                bool
+	totalMetricsDroppedOnOverflow float64
+	flushPoints                   int
+	flushBytes                    int
 }
 
 func New(transporter Poster, prefix string, deployment string, job string, index string, ip string) *Client {
@@ -35,61 +57,188 @@ func New(transporter Poster, prefix string, deployment string, job string, index
 		job:         job,
 		index:       index,
 		ip:          ip,
+		precision:   SecondsPrecision,
+		appTagNames: DefaultAppTags,
 	}
 }
 
+// SetPrefix changes the prefix of the metrics added from now on. Metrics
+// already waiting to be posted keep the old prefix.
+func (c *Client) SetPrefix(prefix string) {
+	c.prefix = prefix
+}
+
+func (c *Client) SetTimestampPrecision(precision TimestampPrecision) {
+	c.precision = precision
+}
+
+func (c *Client) SetForwardEnvelopeTags(forward bool) {
+	c.forwardEnvelopeTags = forward
+}
+
+func (c *Client) SetInstanceTag(name string, value string) {
+	c.instanceTagName = name
+	c.instanceTagValue = value
+}
+
 func (c *Client) AddMetric(envelope *events.Envelope) {
 	c.totalMessagesReceived++
-	if envelope.GetEventType() != events.Envelope_ValueMetric && envelope.GetEventType() != events.Envelope_CounterEvent {
+	c.countEnvelope(envelope.GetEventType())
+	switch envelope.GetEventType() {
+	case events.Envelope_ValueMetric, events.Envelope_CounterEvent:
+		c.addMetric(envelope, getName(envelope), getValue(envelope), c.envelopeTags(envelope))
 		return
+	case events.Envelope_ContainerMetric:
+		if c.forwardAppMetrics {
+			c.addContainerMetrics(envelope)
+			return
+		}
+	case events.Envelope_HttpStartStop:
+		if c.forwardAppMetrics {
+			c.addHTTPMetric(envelope)
+			return
+		}
 	}
+	c.totalEnvelopesFiltered++
+}
+
+func (c *Client) addMetric(envelope *events.Envelope, name string, value float64, tags poster.Tags) {
 	metric := poster.Metric{
-		Value:     getValue(envelope),
-		Timestamp: envelope.GetTimestamp() / int64(time.Second),
-		Metric:    c.prefix + getName(envelope),
-		Tags:      getTags(envelope),
+		Value:     value,
+		Timestamp: c.precision.FromNanos(envelope.GetTimestamp()),
+		Metric:    c.prefix + name,
+		Tags:      c.withInstanceTag(tags),
+	}
+
+	c.buffer(metric)
+}
+
+// timestampKey identifies the series and second of a point, to count the
+// points that collide within one batch, since OpenTSDB keeps only one of
+// them. It is empty with millisecond precision, where that is not tracked.
+func (c *Client) timestampKey(metric poster.Metric) string {
+	if c.precision != SecondsPrecision {
+		return ""
 	}
+	return fmt.Sprintf("%s %d %+v", metric.Metric, metric.Timestamp, metric.Tags)
+}
 
-	c.metrics = append(c.metrics, metric)
+// rememberTimestamp counts the buffered points of each key and the
+// collisions between them.
+func (c *Client) rememberTimestamp(key string) {
+	if key == "" {
+		return
+	}
+	if c.seenTimestamps == nil {
+		c.seenTimestamps = make(map[string]int)
+	}
+	if c.seenTimestamps[key] > 0 {
+		c.totalTimestampCollisions++
+	}
+	c.seenTimestamps[key]++
+}
+
+func (c *Client) forgetTimestamp(key string) {
+	if key == "" {
+		return
+	}
+	if c.seenTimestamps[key] <= 1 {
+		delete(c.seenTimestamps, key)
+		return
+	}
+	c.seenTimestamps[key]--
 }
 
 func (c *Client) addInternalMetric(name string, value float64, sendingQueue []poster.Metric) []poster.Metric {
+	return c.addInternalMetricWithTags(name, value, c.internalTags(), sendingQueue)
+}
+
+func (c *Client) addInternalMetricWithTags(name string, value float64, tags poster.Tags, sendingQueue []poster.Metric) []poster.Metric {
 	internalMetric := poster.Metric{
 		Metric:    c.prefix + name,
 		Value:     value,
-		Timestamp: time.Now().Unix(),
-		Tags: poster.Tags{
-			Deployment: c.deployment,
-			IP:         c.ip,
-			Job:        c.job,
-			Index:      c.index,
-		},
+		Timestamp: c.precision.FromTime(time.Now()),
+		Tags:      tags,
 	}
 
 	return append(sendingQueue, internalMetric)
 }
 
+func (c *Client) internalTags() poster.Tags {
+	return c.withInstanceTag(poster.Tags{
+		Deployment: c.deployment,
+		IP:         c.ip,
+		Job:        c.job,
+		Index:      c.index,
+	})
+}
+
+func (c *Client) withInstanceTag(tags poster.Tags) poster.Tags {
+	if c.instanceTagName == "" || c.instanceTagValue == "" {
+		return tags
+	}
+	return tags.WithExtra(c.instanceTagName, c.instanceTagValue)
+}
+
+// PostMetrics posts the buffered points with the internal metrics. When
+// the post fails the points are dropped, except with the Block policy,
+// which keeps them for the next post.
 func (c *Client) PostMetrics() error {
-	sendingQueue := c.metrics
-	c.metrics = nil
+	sendingQueue := make([]poster.Metric, len(c.metrics))
+	copy(sendingQueue, c.metrics)
+	keep := c.bufferLimits.Policy == Block
+	if !keep {
+		c.resetBuffer()
+		c.seenTimestamps = nil
+	}
 
 	sendingQueue = c.populateInternalMetrics(sendingQueue)
 	numMetrics := len(sendingQueue)
 
-	err := c.transporter.Post(sendingQueue)
+	err := c.post(sendingQueue)
 	if err != nil {
-		log.Printf("Could not write to maximus VM.  Dropping %d messages.", numMetrics)
+		if keep {
+			logger.Error("Could not post metrics, keeping them for the next post", logger.Fields{"batch_size": numMetrics, "buffered": len(c.metrics), "error": err})
+		} else {
+			logger.Error("Could not post metrics, dropping them", logger.Fields{"batch_size": numMetrics, "error": err})
+		}
 		return err
 	}
+	if keep {
+		c.resetBuffer()
+		c.seenTimestamps = nil
+	}
 
-	c.totalMetricsSent += float64(numMetrics)
+	if !c.postsPerOutput() {
+		c.totalMetricsSent += float64(numMetrics)
+	}
 	return nil
 }
 
+// postsPerOutput tells whether the poster only queues the metrics for
+// several outputs, which then report what they delivered in their
+// OutputStats; a successful Post does not mean the metrics were sent.
+func (c *Client) postsPerOutput() bool {
+	_, ok := c.transporter.(OutputStatsReporter)
+	return ok
+}
+
 func (c *Client) populateInternalMetrics(sendingQueue []poster.Metric) []poster.Metric {
+	buffered := len(sendingQueue)
 	sendingQueue = c.addInternalMetric("totalMessagesReceived", c.totalMessagesReceived, sendingQueue)
-	sendingQueue = c.addInternalMetric("totalMetricsSent", c.totalMetricsSent, sendingQueue)
-	return c.addInternalMetric("totalFirehoseDisconnects", c.totalFirehoseDisconnects, sendingQueue)
+	if !c.postsPerOutput() {
+		sendingQueue = c.addInternalMetric("totalMetricsSent", c.totalMetricsSent, sendingQueue)
+	}
+	sendingQueue = c.addInternalMetric("totalTimestampCollisions", c.totalTimestampCollisions, sendingQueue)
+	sendingQueue = c.addInternalMetric("totalFirehoseDisconnects", c.totalFirehoseDisconnects, sendingQueue)
+	if c.bufferLimits.MaxPoints > 0 || c.bufferLimits.MaxBytes > 0 {
+		sendingQueue = c.addInternalMetric("totalMetricsDroppedOnOverflow", c.totalMetricsDroppedOnOverflow, sendingQueue)
+	}
+	sendingQueue = c.populateEnvelopeMetrics(sendingQueue, buffered)
+	sendingQueue = c.populatePostMetrics(sendingQueue)
+	sendingQueue = c.populateProcessMetrics(sendingQueue)
+	sendingQueue = c.populateBytesSentMetrics(sendingQueue)
+	return c.populateOutputMetrics(sendingQueue)
 }
 
 func getName(envelope *events.Envelope) string {
@@ -114,6 +263,27 @@ func getValue(envelope *events.Envelope) float64 {
 	}
 }
 
+func (c *Client) envelopeTags(envelope *events.Envelope) poster.Tags {
+	tags := getTags(envelope)
+	if !c.forwardEnvelopeTags {
+		return tags
+	}
+
+	for key, value := range envelope.GetTags() {
+		// OpenTSDB restricts tag keys to the same characters as values
+		key = sanitizeTagValue(key)
+		value = sanitizeTagValue(value)
+		if key == "" || value == "" {
+			continue
+		}
+		if tags.Extra == nil {
+			tags.Extra = make(map[string]string)
+		}
+		tags.Extra[key] = value
+	}
+	return tags
+}
+
 func getTags(envelope *events.Envelope) poster.Tags {
 	ret := poster.Tags{
 		Deployment: envelope.GetDeployment(),
@@ -1,10 +1,13 @@
 package opentsdbclient_test
 
 import (
+	"errors"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
 
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/cloudcontroller"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/matcher"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/opentsdbclient"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
@@ -18,6 +21,7 @@ import (
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 )
 
 var bodyChan chan []byte
@@ -79,9 +83,10 @@ var _ = Describe("OpentsdbClient", func() {
 		var metrics []poster.Metric
 		err = json.Unmarshal(util.UnzipIgnoreError(receivedBytes), &metrics)
 		Expect(err).NotTo(HaveOccurred())
-		Expect(metrics).To(HaveLen(3))
+		Expect(metrics).To(HaveLen(17))
 
 		validateMetrics(metrics, 2, 0)
+		Expect(getMetric(metrics, "opentsdb.nozzle.totalEnvelopesFiltered").Value).To(BeEquivalentTo(2))
 
 	})
 
@@ -95,12 +100,24 @@ var _ = Describe("OpentsdbClient", func() {
 		var metrics []poster.Metric
 		err = json.Unmarshal(util.UnzipIgnoreError(receivedBytes), &metrics)
 		Expect(err).NotTo(HaveOccurred())
-		Expect(metrics).To(HaveLen(3))
+		Expect(metrics).To(HaveLen(15))
 
 		for _, metric := range metrics {
 			Expect(metric.Metric).To(matcher.BeContainedIn("opentsdb.nozzle.totalMessagesReceived",
 				"opentsdb.nozzle.totalMetricsSent",
-				"opentsdb.nozzle.totalFirehoseDisconnects"))
+				"opentsdb.nozzle.totalTimestampCollisions",
+				"opentsdb.nozzle.totalFirehoseDisconnects",
+				"opentsdb.nozzle.totalEnvelopesFiltered",
+				"opentsdb.nozzle.metricsBuffered",
+				"opentsdb.nozzle.postDurationSeconds",
+				"opentsdb.nozzle.process.goroutines",
+				"opentsdb.nozzle.process.heapAllocBytes",
+				"opentsdb.nozzle.process.heapInuseBytes",
+				"opentsdb.nozzle.process.gcRuns",
+				"opentsdb.nozzle.process.gcPauseTotalSeconds",
+				"opentsdb.nozzle.process.lastGCPauseSeconds",
+				"opentsdb.nozzle.totalUncompressedBytesSent",
+				"opentsdb.nozzle.totalCompressedBytesSent"))
 			Expect(metric.Tags).To(Equal(poster.Tags{
 				Deployment: "test-deployment",
 				Job:        "test-job",
@@ -122,7 +139,7 @@ var _ = Describe("OpentsdbClient", func() {
 		var metrics []poster.Metric
 		err = json.Unmarshal(util.UnzipIgnoreError(receivedBytes), &metrics)
 		Expect(err).NotTo(HaveOccurred())
-		Expect(metrics).To(HaveLen(3))
+		Expect(metrics).To(HaveLen(15))
 
 		metric := getDisconnectMetric(metrics)
 		Expect(metric.Metric).To(Equal("opentsdb.nozzle.totalFirehoseDisconnects"))
@@ -334,7 +351,335 @@ var _ = Describe("OpentsdbClient", func() {
 		Eventually(bodyChan).Should(Receive(&receivedBytes))
 		err = json.Unmarshal(util.UnzipIgnoreError(receivedBytes), &metrics)
 		Expect(err).NotTo(HaveOccurred())
-		validateMetrics(metrics, 2, 5)
+		validateMetrics(metrics, 2, 18)
+	})
+
+	Context("when forwarding app metrics", func() {
+		BeforeEach(func() {
+			client = opentsdbclient.New(opentsdbPoster, "", "test-deployment", "test-job", "SOME-GUID", "dummy-ip")
+			client.SetForwardAppMetrics(true)
+		})
+
+		It("posts ContainerMetrics tagged with the app GUID and instance", func() {
+			client.AddMetric(containerMetricEnvelope())
+
+			metrics := postAndReceiveMetrics(client)
+			Expect(metrics).To(ContainElement(
+				poster.Metric{
+					Metric:    "app.cpuPercentage",
+					Value:     20,
+					Timestamp: 1,
+					Tags: poster.Tags{
+						Deployment: "deployment-name",
+						Job:        "diego_cell",
+						Index:      "SOME-METRIC-GUID",
+						Extra: map[string]string{
+							"app_id":         "app-guid",
+							"instance_index": "4",
+						},
+					},
+				}))
+			Expect(getMetric(metrics, "app.memoryBytes").Value).To(BeEquivalentTo(19939949))
+			Expect(getMetric(metrics, "app.diskBytes").Value).To(BeEquivalentTo(29488929))
+		})
+
+		It("posts the response time of HttpStartStop events for apps", func() {
+			client.AddMetric(&events.Envelope{
+				Origin:    proto.String("gorouter"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_HttpStartStop.Enum(),
+				HttpStartStop: &events.HttpStartStop{
+					StartTimestamp: proto.Int64(1000000000),
+					StopTimestamp:  proto.Int64(1250000000),
+					ApplicationId: &events.UUID{
+						Low:  proto.Uint64(0x7243cc580bc17af4),
+						High: proto.Uint64(0x79d4c3b2020e67a5),
+					},
+					InstanceIndex: proto.Int32(1),
+				},
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("router"),
+			})
+
+			metrics := postAndReceiveMetrics(client)
+			Expect(metrics).To(ContainElement(
+				poster.Metric{
+					Metric:    "app.http.responseTimeMs",
+					Value:     250,
+					Timestamp: 1,
+					Tags: poster.Tags{
+						Deployment: "deployment-name",
+						Job:        "router",
+						Extra: map[string]string{
+							"app_id":         "f47ac10b-58cc-4372-a567-0e02b2c3d479",
+							"instance_index": "1",
+						},
+					},
+				}))
+		})
+
+		It("adds the app name when it is resolved", func() {
+			client.SetAppMetadataResolver(fakeResolver{
+				"app-guid": {AppName: "my app", SpaceName: "my-space", OrgName: "my-org"},
+			})
+			client.AddMetric(containerMetricEnvelope())
+
+			metrics := postAndReceiveMetrics(client)
+			Expect(getMetric(metrics, "app.cpuPercentage").Tags.Extra).To(Equal(map[string]string{
+				"app_id":         "app-guid",
+				"instance_index": "4",
+				"app_name":       "my_app",
+			}))
+		})
+
+		It("stays within the default OpenTSDB limit of 8 tags with a nozzle instance tag", func() {
+			client.SetAppMetadataResolver(fakeResolver{
+				"app-guid": {AppName: "my-app", SpaceName: "my-space", OrgName: "my-org"},
+			})
+			client.SetInstanceTag("nozzle_index", "2")
+			envelope := containerMetricEnvelope()
+			envelope.Ip = proto.String("10.0.0.1")
+			client.AddMetric(envelope)
+
+			tags := getMetric(postAndReceiveMetrics(client), "app.cpuPercentage").Tags
+			Expect(tags.Deployment).NotTo(BeEmpty())
+			Expect(tags.Job).NotTo(BeEmpty())
+			Expect(tags.Index).NotTo(BeEmpty())
+			Expect(tags.IP).NotTo(BeEmpty())
+			Expect(tags.Extra).To(HaveLen(4))
+		})
+
+		It("adds the selected app tags", func() {
+			client.SetAppTags([]string{"app_id", "space_name", "org_name"})
+			client.SetAppMetadataResolver(fakeResolver{
+				"app-guid": {AppName: "my app", SpaceName: "my-space", OrgName: "my-org"},
+			})
+			client.AddMetric(containerMetricEnvelope())
+
+			metrics := postAndReceiveMetrics(client)
+			Expect(getMetric(metrics, "app.cpuPercentage").Tags.Extra).To(Equal(map[string]string{
+				"app_id":     "app-guid",
+				"space_name": "my-space",
+				"org_name":   "my-org",
+			}))
+		})
+
+		It("adds the app, space and org names when all app tags are selected", func() {
+			client.SetAppTags(opentsdbclient.AppTags)
+			client.SetAppMetadataResolver(fakeResolver{
+				"app-guid": {AppName: "my app", SpaceName: "my-space", OrgName: "my-org"},
+			})
+			client.AddMetric(containerMetricEnvelope())
+
+			metrics := postAndReceiveMetrics(client)
+			Expect(getMetric(metrics, "app.cpuPercentage").Tags.Extra).To(Equal(map[string]string{
+				"app_id":         "app-guid",
+				"instance_index": "4",
+				"app_name":       "my_app",
+				"space_name":     "my-space",
+				"org_name":       "my-org",
+			}))
+		})
+
+		It("still posts app metrics when the app is not resolved yet", func() {
+			client.SetAppMetadataResolver(fakeResolver{})
+			client.AddMetric(containerMetricEnvelope())
+
+			metrics := postAndReceiveMetrics(client)
+			Expect(getMetric(metrics, "app.cpuPercentage").Tags.Extra).To(Equal(map[string]string{
+				"app_id":         "app-guid",
+				"instance_index": "4",
+			}))
+		})
+	})
+
+	Context("when forwarding envelope tags", func() {
+		BeforeEach(func() {
+			client.SetForwardEnvelopeTags(true)
+		})
+
+		It("adds the envelope tags to the metric tags", func() {
+			client.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("doppler"),
+				Tags: map[string]string{
+					"source_id": "doppler",
+					"placement": "az 1",
+					"empty":     "",
+				},
+			})
+
+			metrics := postAndReceiveMetrics(client)
+			Expect(getMetric(metrics, "opentsdb.nozzle.origin.metricName").Tags.Extra).To(Equal(map[string]string{
+				"source_id": "doppler",
+				"placement": "az_1",
+			}))
+		})
+
+		It("sanitizes the envelope tag keys", func() {
+			client.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+				Tags: map[string]string{
+					"instance group": "router",
+					"a=b":            "c",
+					"":               "no key",
+				},
+			})
+
+			metrics := postAndReceiveMetrics(client)
+			Expect(getMetric(metrics, "opentsdb.nozzle.origin.metricName").Tags.Extra).To(Equal(map[string]string{
+				"instance_group": "router",
+				"a_b":            "c",
+			}))
+		})
+	})
+
+	Context("with a nozzle instance tag", func() {
+		BeforeEach(func() {
+			client.SetInstanceTag("nozzle_index", "2")
+		})
+
+		It("tags forwarded and internal metrics with the nozzle instance", func() {
+			addValueMetric(client, 1000000000, 5)
+
+			metrics := postAndReceiveMetrics(client)
+			Expect(metrics).To(HaveLen(17))
+			for _, metric := range metrics {
+				Expect(metric.Tags.Extra).To(HaveKeyWithValue("nozzle_index", "2"))
+			}
+		})
+
+		It("keeps the app tags of forwarded app metrics", func() {
+			client.SetForwardAppMetrics(true)
+			client.AddMetric(containerMetricEnvelope())
+
+			metrics := postAndReceiveMetrics(client)
+			Expect(getMetric(metrics, "opentsdb.nozzle.app.cpuPercentage").Tags.Extra).To(Equal(map[string]string{
+				"app_id":         "app-guid",
+				"instance_index": "4",
+				"nozzle_index":   "2",
+			}))
+		})
+
+		It("does not add the tag when the instance is unknown", func() {
+			client.SetInstanceTag("nozzle_index", "")
+			addValueMetric(client, 1000000000, 5)
+
+			metrics := postAndReceiveMetrics(client)
+			for _, metric := range metrics {
+				Expect(metric.Tags.Extra).NotTo(HaveKey("nozzle_index"))
+			}
+		})
+	})
+
+	Context("with millisecond timestamp precision", func() {
+		BeforeEach(func() {
+			client.SetTimestampPrecision(opentsdbclient.MillisecondsPrecision)
+		})
+
+		It("keeps the millisecond part of the envelope timestamp", func() {
+			client.AddMetric(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1500000000123456789),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+				},
+				Deployment: proto.String("deployment-name"),
+				Job:        proto.String("doppler"),
+			})
+
+			err := client.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+
+			var receivedBytes []byte
+			Eventually(bodyChan).Should(Receive(&receivedBytes))
+
+			var metrics []poster.Metric
+			err = json.Unmarshal(util.UnzipIgnoreError(receivedBytes), &metrics)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metrics).To(ContainElement(
+				poster.Metric{
+					Metric:    "opentsdb.nozzle.origin.metricName",
+					Value:     5,
+					Timestamp: 1500000000123,
+					Tags: poster.Tags{
+						Deployment: "deployment-name",
+						Job:        "doppler",
+					},
+				}))
+		})
+
+		It("emits internal metrics with millisecond timestamps", func() {
+			err := client.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+
+			var receivedBytes []byte
+			Eventually(bodyChan).Should(Receive(&receivedBytes))
+
+			var metrics []poster.Metric
+			err = json.Unmarshal(util.UnzipIgnoreError(receivedBytes), &metrics)
+			Expect(err).NotTo(HaveOccurred())
+			for _, metric := range metrics {
+				Expect(metric.Timestamp).To(BeNumerically(">", time.Now().Add(-10*time.Second).UnixNano()/int64(time.Millisecond)))
+			}
+		})
+
+		It("does not count points within the same second as collisions", func() {
+			addValueMetric(client, 1000000000, 5)
+			addValueMetric(client, 1000000001, 6)
+
+			err := client.PostMetrics()
+			Expect(err).ToNot(HaveOccurred())
+
+			var receivedBytes []byte
+			Eventually(bodyChan).Should(Receive(&receivedBytes))
+
+			var metrics []poster.Metric
+			err = json.Unmarshal(util.UnzipIgnoreError(receivedBytes), &metrics)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(getMetric(metrics, "opentsdb.nozzle.totalTimestampCollisions").Value).To(BeEquivalentTo(0))
+		})
+	})
+
+	It("counts points of the same series that collide within one second", func() {
+		addValueMetric(client, 1000000000, 5)
+		addValueMetric(client, 1500000000, 6)
+		addValueMetric(client, 2000000000, 7)
+
+		err := client.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+
+		var receivedBytes []byte
+		Eventually(bodyChan).Should(Receive(&receivedBytes))
+
+		var metrics []poster.Metric
+		err = json.Unmarshal(util.UnzipIgnoreError(receivedBytes), &metrics)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(getMetric(metrics, "opentsdb.nozzle.totalTimestampCollisions").Value).To(BeEquivalentTo(1))
+
+		addValueMetric(client, 1000000000, 5)
+
+		err = client.PostMetrics()
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(bodyChan).Should(Receive(&receivedBytes))
+		err = json.Unmarshal(util.UnzipIgnoreError(receivedBytes), &metrics)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(getMetric(metrics, "opentsdb.nozzle.totalTimestampCollisions").Value).To(BeEquivalentTo(1))
 	})
 
 	It("returns an error when opentsdb responds with a non 200 response code", func() {
@@ -355,8 +700,271 @@ var _ = Describe("OpentsdbClient", func() {
 		Expect(err).ToNot(HaveOccurred())
 	})
 
+	It("emits the stats of each output when the poster reports them", func() {
+		reporter := &fakeOutputStatsReporter{stats: []opentsdbclient.OutputStats{
+			{Name: "primary", PostsSucceeded: 3, MetricsSent: 12},
+			{Name: "secondary", PostsFailed: 2, MetricsDropped: 4, QueuedBatches: 1, PostFailures: map[string]float64{"timeout": 2}},
+		}}
+		client = opentsdbclient.New(reporter, "opentsdb.nozzle.", "test-deployment", "dummy-job", "1", "127.0.0.1")
+		Expect(client.PostMetrics()).To(Succeed())
+
+		var outputMetrics []poster.Metric
+		for _, metric := range reporter.posted {
+			if metric.Tags.Extra["output"] != "" {
+				outputMetrics = append(outputMetrics, metric)
+			}
+		}
+		Expect(outputMetrics).To(HaveLen(15))
+		Expect(outputMetrics[0].Metric).To(Equal("opentsdb.nozzle.output.postsSucceeded"))
+		Expect(outputMetrics[0].Value).To(BeEquivalentTo(3))
+		Expect(outputMetrics[0].Tags.Extra).To(Equal(map[string]string{"output": "primary"}))
+		Expect(outputMetrics[0].Tags.Deployment).To(Equal("test-deployment"))
+		Expect(outputMetrics[10].Metric).To(Equal("opentsdb.nozzle.output.metricsDropped"))
+		Expect(outputMetrics[10].Value).To(BeEquivalentTo(4))
+		Expect(outputMetrics[11].Metric).To(Equal("opentsdb.nozzle.output.queuedBatches"))
+		Expect(outputMetrics[11].Tags.Extra["output"]).To(Equal("secondary"))
+		Expect(outputMetrics[14].Metric).To(Equal("opentsdb.nozzle.output.postFailures"))
+		Expect(outputMetrics[14].Value).To(BeEquivalentTo(2))
+		Expect(outputMetrics[14].Tags.Extra).To(Equal(map[string]string{"output": "secondary", "reason": "timeout"}))
+	})
+
+	It("leaves totalMetricsSent to the outputs when the poster only queues the metrics", func() {
+		reporter := &fakeOutputStatsReporter{stats: []opentsdbclient.OutputStats{{Name: "primary"}}}
+		client = opentsdbclient.New(reporter, "opentsdb.nozzle.", "test-deployment", "dummy-job", "1", "127.0.0.1")
+		Expect(client.PostMetrics()).To(Succeed())
+		Expect(client.PostMetrics()).To(Succeed())
+
+		for _, metric := range reporter.posted {
+			Expect(metric.Metric).NotTo(Equal("opentsdb.nozzle.totalMetricsSent"))
+		}
+		Expect(getMetric(reporter.posted, "opentsdb.nozzle.output.metricsSent").Tags.Extra).To(HaveKeyWithValue("output", "primary"))
+	})
+
+	It("emits the bytes sent when the poster counts them", func() {
+		reporter := &fakeBytesSentReporter{}
+		client = opentsdbclient.New(reporter, "opentsdb.nozzle.", "test-deployment", "dummy-job", "1", "127.0.0.1")
+		Expect(client.PostMetrics()).To(Succeed())
+
+		values := make(map[string]float64)
+		for _, metric := range reporter.posted {
+			values[metric.Metric] = metric.Value
+		}
+		Expect(values).To(HaveKeyWithValue("opentsdb.nozzle.totalUncompressedBytesSent", 1000.0))
+		Expect(values).To(HaveKeyWithValue("opentsdb.nozzle.totalCompressedBytesSent", 250.0))
+	})
+
+	It("emits the envelopes by type, the buffered points and the post failures by reason", func() {
+		addValueMetric(client, 1000000000, 5)
+		addValueMetric(client, 2000000000, 6)
+		client.AddMetric(containerMetricEnvelope())
+		client.SetTokenRefreshReporter(fakeTokenRefreshReporter(3))
+
+		responseCode = http.StatusServiceUnavailable
+		Expect(client.PostMetrics()).NotTo(Succeed())
+		<-bodyChan
+		responseCode = http.StatusOK
+		metrics := postAndReceiveMetrics(client)
+
+		received := getMetric(metrics, "opentsdb.nozzle.envelopesReceived")
+		Expect(received.Tags.Extra).To(Equal(map[string]string{"event_type": "ContainerMetric"}))
+		Expect(received.Value).To(BeEquivalentTo(1))
+		Expect(metrics).To(ContainElement(poster.Metric{
+			Metric:    "opentsdb.nozzle.envelopesReceived",
+			Value:     2,
+			Timestamp: received.Timestamp,
+			Tags:      received.Tags.WithExtra("event_type", "ValueMetric"),
+		}))
+		Expect(getMetric(metrics, "opentsdb.nozzle.totalEnvelopesFiltered").Value).To(BeEquivalentTo(1))
+		Expect(getMetric(metrics, "opentsdb.nozzle.metricsBuffered").Value).To(BeEquivalentTo(0))
+		Expect(getMetric(metrics, "opentsdb.nozzle.postDurationSeconds").Value).To(BeNumerically(">", 0))
+		Expect(getMetric(metrics, "opentsdb.nozzle.totalTokenRefreshes").Value).To(BeEquivalentTo(3))
+		Expect(getMetric(metrics, "opentsdb.nozzle.process.goroutines").Value).To(BeNumerically(">", 0))
+
+		failures := getMetric(metrics, "opentsdb.nozzle.postFailures")
+		Expect(failures.Value).To(BeEquivalentTo(1))
+		Expect(failures.Tags).To(Equal(poster.Tags{
+			Deployment: "test-deployment",
+			Job:        "test-job",
+			Index:      "SOME-GUID",
+			IP:         "dummy-ip",
+			Extra:      map[string]string{"reason": "http_5xx"},
+		}))
+	})
+
+	Context("with buffer limits", func() {
+		var recorder *fakeBytesSentReporter
+
+		BeforeEach(func() {
+			recorder = &fakeBytesSentReporter{}
+			client = opentsdbclient.New(recorder, "", "test-deployment", "test-job", "SOME-GUID", "dummy-ip")
+		})
+
+		bufferedValues := func() []float64 {
+			Expect(client.PostMetrics()).To(Succeed())
+			var values []float64
+			for _, metric := range recorder.posted {
+				if metric.Metric == "origin.metricName" {
+					values = append(values, metric.Value)
+				}
+			}
+			return values
+		}
+
+		It("drops the oldest points by default", func() {
+			client.SetBufferLimits(opentsdbclient.BufferLimits{MaxPoints: 2})
+			for i := 1; i <= 4; i++ {
+				addValueMetric(client, int64(i)*1000000000, float64(i))
+			}
+			Expect(client.BufferFull()).To(BeFalse())
+
+			Expect(bufferedValues()).To(Equal([]float64{3, 4}))
+			Expect(getMetric(recorder.posted, "totalMetricsDroppedOnOverflow").Value).To(BeEquivalentTo(2))
+		})
+
+		It("drops the newest points", func() {
+			client.SetBufferLimits(opentsdbclient.BufferLimits{MaxPoints: 2, Policy: opentsdbclient.DropNewest})
+			for i := 1; i <= 4; i++ {
+				addValueMetric(client, int64(i)*1000000000, float64(i))
+			}
+
+			Expect(bufferedValues()).To(Equal([]float64{1, 2}))
+			Expect(getMetric(recorder.posted, "totalMetricsDroppedOnOverflow").Value).To(BeEquivalentTo(2))
+		})
+
+		It("limits the approximate size of the buffer", func() {
+			// each point takes about 250 bytes with its timestamp key
+			client.SetBufferLimits(opentsdbclient.BufferLimits{MaxBytes: 500})
+			for i := 1; i <= 4; i++ {
+				addValueMetric(client, int64(i)*1000000000, float64(i))
+			}
+
+			Expect(bufferedValues()).To(Equal([]float64{3, 4}))
+		})
+
+		It("only counts collisions between the points it keeps", func() {
+			client.SetBufferLimits(opentsdbclient.BufferLimits{MaxPoints: 1})
+			addValueMetric(client, 1000000000, 1)
+			addValueMetric(client, 1000000000, 2)
+
+			Expect(bufferedValues()).To(Equal([]float64{2}))
+			Expect(getMetric(recorder.posted, "totalTimestampCollisions").Value).To(BeZero())
+			Expect(getMetric(recorder.posted, "totalMetricsDroppedOnOverflow").Value).To(BeEquivalentTo(1))
+		})
+
+		It("keeps every point and reports a full buffer with the block policy", func() {
+			client.SetBufferLimits(opentsdbclient.BufferLimits{MaxPoints: 2, Policy: opentsdbclient.Block})
+			addValueMetric(client, 1000000000, 1)
+			Expect(client.BufferFull()).To(BeFalse())
+			addValueMetric(client, 2000000000, 2)
+			Expect(client.BufferFull()).To(BeTrue())
+
+			Expect(bufferedValues()).To(Equal([]float64{1, 2}))
+			Expect(client.BufferFull()).To(BeFalse())
+			Expect(getMetric(recorder.posted, "totalMetricsDroppedOnOverflow").Value).To(BeZero())
+		})
+
+		It("keeps the points of a failed post and stays bounded with the block policy", func() {
+			client.SetBufferLimits(opentsdbclient.BufferLimits{MaxPoints: 2, Policy: opentsdbclient.Block})
+			addValueMetric(client, 1000000000, 1)
+			addValueMetric(client, 2000000000, 2)
+
+			recorder.err = errors.New("OpenTSDB unavailable")
+			Expect(client.PostMetrics()).NotTo(Succeed())
+			Expect(client.BufferFull()).To(BeTrue())
+			addValueMetric(client, 3000000000, 3)
+
+			recorder.err = nil
+			Expect(bufferedValues()).To(Equal([]float64{1, 2}))
+			Expect(getMetric(recorder.posted, "totalMetricsDroppedOnOverflow").Value).To(BeEquivalentTo(1))
+		})
+
+		It("warns once when the buffer goes above the high-water mark", func() {
+			logOutput := gbytes.NewBuffer()
+			log.SetOutput(logOutput)
+			defer log.SetOutput(ioutil.Discard)
+
+			client.SetBufferLimits(opentsdbclient.BufferLimits{MaxPoints: 4, HighWaterPercent: 50})
+			addValueMetric(client, 1000000000, 1)
+			Expect(logOutput.Contents()).To(BeEmpty())
+			addValueMetric(client, 2000000000, 2)
+			addValueMetric(client, 3000000000, 3)
+			Expect(logOutput).To(gbytes.Say("WARN The metrics buffer is above its high-water mark bytes=\\d+ max_bytes=0 max_points=4 points=2 policy=drop-oldest\n"))
+			Expect(logOutput).NotTo(gbytes.Say("high-water"))
+		})
+
+		It("reports a batch ready at the flush thresholds", func() {
+			client.SetFlushThresholds(2, 0)
+			addValueMetric(client, 1000000000, 1)
+			Expect(client.BatchReady()).To(BeFalse())
+			addValueMetric(client, 2000000000, 2)
+			Expect(client.BatchReady()).To(BeTrue())
+			Expect(bufferedValues()).To(Equal([]float64{1, 2}))
+			Expect(client.BatchReady()).To(BeFalse())
+
+			client.SetFlushThresholds(0, 600)
+			addValueMetric(client, 3000000000, 3)
+			Expect(client.BatchReady()).To(BeFalse())
+			addValueMetric(client, 4000000000, 4)
+			addValueMetric(client, 5000000000, 5)
+			Expect(client.BatchReady()).To(BeTrue())
+		})
+
+		It("does not report drops without limits", func() {
+			addValueMetric(client, 1000000000, 1)
+			Expect(bufferedValues()).To(Equal([]float64{1}))
+			for _, metric := range recorder.posted {
+				Expect(metric.Metric).NotTo(Equal("totalMetricsDroppedOnOverflow"))
+			}
+		})
+	})
+
+	It("counts the points waiting to be posted", func() {
+		addValueMetric(client, 1000000000, 5)
+		addValueMetric(client, 2000000000, 6)
+
+		metrics := postAndReceiveMetrics(client)
+		Expect(getMetric(metrics, "opentsdb.nozzle.metricsBuffered").Value).To(BeEquivalentTo(2))
+	})
+
 })
 
+type fakeBytesSentReporter struct {
+	posted []poster.Metric
+	err    error
+}
+
+func (f *fakeBytesSentReporter) Post(metrics []poster.Metric) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.posted = metrics
+	return nil
+}
+
+func (f *fakeBytesSentReporter) BytesSent() (uint64, uint64) {
+	return 1000, 250
+}
+
+type fakeTokenRefreshReporter uint64
+
+func (f fakeTokenRefreshReporter) TokenRefreshes() uint64 {
+	return uint64(f)
+}
+
+type fakeOutputStatsReporter struct {
+	stats  []opentsdbclient.OutputStats
+	posted []poster.Metric
+}
+
+func (f *fakeOutputStatsReporter) Post(metrics []poster.Metric) error {
+	f.posted = metrics
+	return nil
+}
+
+func (f *fakeOutputStatsReporter) OutputStats() []opentsdbclient.OutputStats {
+	return f.stats
+}
+
 func validateMetrics(metrics []poster.Metric, totalMessagesReceived int, totalMetricsSent int) {
 	totalMessagesReceivedFound := false
 	totalMetricsSentFound := false
@@ -400,6 +1008,67 @@ func handlePost(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(responseCode)
 }
 
+type fakeResolver map[string]cloudcontroller.AppMetadata
+
+func (f fakeResolver) Lookup(appGUID string) (cloudcontroller.AppMetadata, bool) {
+	metadata, found := f[appGUID]
+	return metadata, found
+}
+
+func containerMetricEnvelope() *events.Envelope {
+	return &events.Envelope{
+		Origin:    proto.String("rep"),
+		Timestamp: proto.Int64(1000000000),
+		Index:     proto.String("SOME-METRIC-GUID"),
+		EventType: events.Envelope_ContainerMetric.Enum(),
+		ContainerMetric: &events.ContainerMetric{
+			ApplicationId: proto.String("app-guid"),
+			InstanceIndex: proto.Int32(4),
+			CpuPercentage: proto.Float64(20.0),
+			MemoryBytes:   proto.Uint64(19939949),
+			DiskBytes:     proto.Uint64(29488929),
+		},
+		Deployment: proto.String("deployment-name"),
+		Job:        proto.String("diego_cell"),
+	}
+}
+
+func postAndReceiveMetrics(client *opentsdbclient.Client) []poster.Metric {
+	err := client.PostMetrics()
+	Expect(err).ToNot(HaveOccurred())
+
+	var receivedBytes []byte
+	Eventually(bodyChan).Should(Receive(&receivedBytes))
+
+	var metrics []poster.Metric
+	err = json.Unmarshal(util.UnzipIgnoreError(receivedBytes), &metrics)
+	Expect(err).NotTo(HaveOccurred())
+	return metrics
+}
+
+func addValueMetric(client *opentsdbclient.Client, timestamp int64, value float64) {
+	client.AddMetric(&events.Envelope{
+		Origin:    proto.String("origin"),
+		Timestamp: proto.Int64(timestamp),
+		EventType: events.Envelope_ValueMetric.Enum(),
+		ValueMetric: &events.ValueMetric{
+			Name:  proto.String("metricName"),
+			Value: proto.Float64(value),
+		},
+		Deployment: proto.String("deployment-name"),
+		Job:        proto.String("doppler"),
+	})
+}
+
+func getMetric(metrics []poster.Metric, name string) poster.Metric {
+	for _, metric := range metrics {
+		if metric.Metric == name {
+			return metric
+		}
+	}
+	return poster.Metric{}
+}
+
 func getDisconnectMetric(metrics []poster.Metric) poster.Metric {
 	for _, metric := range metrics {
 		if metric.Metric == "opentsdb.nozzle.totalFirehoseDisconnects" {
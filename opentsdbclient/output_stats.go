@@ -0,0 +1,56 @@
+package opentsdbclient
+
+import (
+	"sort"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+)
+
+type OutputStats struct {
+	Name           string
+	PostsSucceeded float64
+	PostsFailed    float64
+	MetricsSent    float64
+	MetricsDropped float64
+	QueuedBatches  float64
+	// MetricsFiltered counts the metrics left out by the output's filters.
+	MetricsFiltered float64
+	// PostDurationSeconds is how long the last post took.
+	PostDurationSeconds float64
+	// PostFailures counts the failed posts by poster.FailureReason.
+	PostFailures map[string]float64
+}
+
+// OutputStatsReporter is implemented by posters that write to several
+// outputs and report on each of them.
+type OutputStatsReporter interface {
+	OutputStats() []OutputStats
+}
+
+func (c *Client) populateOutputMetrics(sendingQueue []poster.Metric) []poster.Metric {
+	reporter, ok := c.transporter.(OutputStatsReporter)
+	if !ok {
+		return sendingQueue
+	}
+
+	for _, stats := range reporter.OutputStats() {
+		tags := c.internalTags().WithExtra("output", stats.Name)
+		sendingQueue = c.addInternalMetricWithTags("output.postsSucceeded", stats.PostsSucceeded, tags, sendingQueue)
+		sendingQueue = c.addInternalMetricWithTags("output.postsFailed", stats.PostsFailed, tags, sendingQueue)
+		sendingQueue = c.addInternalMetricWithTags("output.metricsSent", stats.MetricsSent, tags, sendingQueue)
+		sendingQueue = c.addInternalMetricWithTags("output.metricsDropped", stats.MetricsDropped, tags, sendingQueue)
+		sendingQueue = c.addInternalMetricWithTags("output.queuedBatches", stats.QueuedBatches, tags, sendingQueue)
+		sendingQueue = c.addInternalMetricWithTags("output.metricsFiltered", stats.MetricsFiltered, tags, sendingQueue)
+		sendingQueue = c.addInternalMetricWithTags("output.postDurationSeconds", stats.PostDurationSeconds, tags, sendingQueue)
+
+		reasons := make([]string, 0, len(stats.PostFailures))
+		for reason := range stats.PostFailures {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			sendingQueue = c.addInternalMetricWithTags("output.postFailures", stats.PostFailures[reason], tags.WithExtra("reason", reason), sendingQueue)
+		}
+	}
+	return sendingQueue
+}
@@ -0,0 +1,90 @@
+package opentsdbclient
+
+import (
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+)
+
+// TokenRefreshReporter is implemented by token fetchers that count the
+// tokens they fetched.
+type TokenRefreshReporter interface {
+	TokenRefreshes() uint64
+}
+
+func (c *Client) SetTokenRefreshReporter(reporter TokenRefreshReporter) {
+	c.tokenRefreshes = reporter
+}
+
+func (c *Client) countEnvelope(eventType events.Envelope_EventType) {
+	if c.envelopesReceived == nil {
+		c.envelopesReceived = make(map[events.Envelope_EventType]float64)
+	}
+	c.envelopesReceived[eventType]++
+}
+
+// post posts a batch, timing it and counting its failure by reason.
+func (c *Client) post(sendingQueue []poster.Metric) error {
+	start := time.Now()
+	err := c.transporter.Post(sendingQueue)
+	c.lastPostDuration = time.Since(start)
+	if err != nil {
+		if c.postFailures == nil {
+			c.postFailures = make(map[string]float64)
+		}
+		c.postFailures[poster.FailureReason(err)]++
+	}
+	return err
+}
+
+func (c *Client) populateEnvelopeMetrics(sendingQueue []poster.Metric, buffered int) []poster.Metric {
+	eventTypes := make([]string, 0, len(c.envelopesReceived))
+	counts := make(map[string]float64, len(c.envelopesReceived))
+	for eventType, count := range c.envelopesReceived {
+		eventTypes = append(eventTypes, eventType.String())
+		counts[eventType.String()] = count
+	}
+	sort.Strings(eventTypes)
+	for _, eventType := range eventTypes {
+		tags := c.internalTags().WithExtra("event_type", eventType)
+		sendingQueue = c.addInternalMetricWithTags("envelopesReceived", counts[eventType], tags, sendingQueue)
+	}
+
+	sendingQueue = c.addInternalMetric("totalEnvelopesFiltered", c.totalEnvelopesFiltered, sendingQueue)
+	return c.addInternalMetric("metricsBuffered", float64(buffered), sendingQueue)
+}
+
+func (c *Client) populatePostMetrics(sendingQueue []poster.Metric) []poster.Metric {
+	sendingQueue = c.addInternalMetric("postDurationSeconds", c.lastPostDuration.Seconds(), sendingQueue)
+
+	reasons := make([]string, 0, len(c.postFailures))
+	for reason := range c.postFailures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		tags := c.internalTags().WithExtra("reason", reason)
+		sendingQueue = c.addInternalMetricWithTags("postFailures", c.postFailures[reason], tags, sendingQueue)
+	}
+
+	if c.tokenRefreshes != nil {
+		sendingQueue = c.addInternalMetric("totalTokenRefreshes", float64(c.tokenRefreshes.TokenRefreshes()), sendingQueue)
+	}
+	return sendingQueue
+}
+
+func (c *Client) populateProcessMetrics(sendingQueue []poster.Metric) []poster.Metric {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	lastPause := memStats.PauseNs[(memStats.NumGC+255)%256]
+
+	sendingQueue = c.addInternalMetric("process.goroutines", float64(runtime.NumGoroutine()), sendingQueue)
+	sendingQueue = c.addInternalMetric("process.heapAllocBytes", float64(memStats.HeapAlloc), sendingQueue)
+	sendingQueue = c.addInternalMetric("process.heapInuseBytes", float64(memStats.HeapInuse), sendingQueue)
+	sendingQueue = c.addInternalMetric("process.gcRuns", float64(memStats.NumGC), sendingQueue)
+	sendingQueue = c.addInternalMetric("process.gcPauseTotalSeconds", time.Duration(memStats.PauseTotalNs).Seconds(), sendingQueue)
+	return c.addInternalMetric("process.lastGCPauseSeconds", time.Duration(lastPause).Seconds(), sendingQueue)
+}
@@ -0,0 +1,43 @@
+package opentsdbclient
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type TimestampPrecision int
+
+const (
+	SecondsPrecision TimestampPrecision = iota
+	MillisecondsPrecision
+)
+
+func ParseTimestampPrecision(precision string) (TimestampPrecision, error) {
+	switch strings.ToLower(precision) {
+	case "", "s", "seconds":
+		return SecondsPrecision, nil
+	case "ms", "milliseconds":
+		return MillisecondsPrecision, nil
+	default:
+		return SecondsPrecision, fmt.Errorf("unknown timestamp precision %q, expected \"seconds\" or \"milliseconds\"", precision)
+	}
+}
+
+func (p TimestampPrecision) String() string {
+	if p == MillisecondsPrecision {
+		return "milliseconds"
+	}
+	return "seconds"
+}
+
+func (p TimestampPrecision) FromNanos(nanos int64) int64 {
+	if p == MillisecondsPrecision {
+		return nanos / int64(time.Millisecond)
+	}
+	return nanos / int64(time.Second)
+}
+
+func (p TimestampPrecision) FromTime(t time.Time) int64 {
+	return p.FromNanos(t.UnixNano())
+}
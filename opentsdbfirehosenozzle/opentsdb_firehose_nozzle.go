@@ -1,15 +1,19 @@
 package opentsdbfirehosenozzle
 
 import (
-	"crypto/tls"
-	"log"
+	"fmt"
+	"io"
+	"os"
 	"time"
 
-	"github.com/cloudfoundry/noaa/consumer"
 	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/cloudcontroller"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/envelopesource"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/nozzleconfig"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/opentsdbclient"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/rlpgateway"
 	"code.cloudfoundry.org/localip"
 )
 
@@ -18,40 +22,101 @@ type OpenTSDBFirehoseNozzle struct {
 	errs             <-chan error
 	messages         <-chan *events.Envelope
 	authTokenFetcher AuthTokenFetcher
-	consumer         *consumer.Consumer
+	source           envelopesource.EnvelopeSource
+	recorder         *envelopesource.Recorder
+	dryRunFile       *os.File
+	transporter      opentsdbclient.Poster
 	client           *opentsdbclient.Client
+	appCache         *cloudcontroller.AppCache
 	run              chan bool
+	reloads          chan reloadRequest
+	done             chan struct{}
 }
 
+const (
+	defaultAppCacheTTL   = 5 * time.Minute
+	fullBufferRetryDelay = 100 * time.Millisecond
+)
+
 type AuthTokenFetcher interface {
 	FetchAuthToken() string
 }
 
 func NewOpenTSDBFirehoseNozzle(config *nozzleconfig.NozzleConfig, tokenFetcher AuthTokenFetcher) *OpenTSDBFirehoseNozzle {
+	return NewOpenTSDBNozzleWithSource(config, tokenFetcher, NewEnvelopeSource(config, tokenFetcher))
+}
+
+func NewOpenTSDBNozzleWithSource(config *nozzleconfig.NozzleConfig, tokenFetcher AuthTokenFetcher, source envelopesource.EnvelopeSource) *OpenTSDBFirehoseNozzle {
 	return &OpenTSDBFirehoseNozzle{
 		config:           config,
 		errs:             make(<-chan error),
 		messages:         make(<-chan *events.Envelope),
-		run: 			  make(chan bool),
+		run:              make(chan bool),
+		reloads:          make(chan reloadRequest),
+		done:             make(chan struct{}),
 		authTokenFetcher: tokenFetcher,
+		source:           source,
 	}
 }
 
-func (o *OpenTSDBFirehoseNozzle) Start() {
-	var authToken string
+func NewEnvelopeSource(config *nozzleconfig.NozzleConfig, tokenFetcher AuthTokenFetcher) envelopesource.EnvelopeSource {
+	var sourceTokenFetcher envelopesource.AuthTokenFetcher
+	if !config.DisableAccessControl {
+		sourceTokenFetcher = tokenFetcher
+	}
+	idleTimeout := time.Duration(config.IdleTimeoutSeconds) * time.Second
 
-	if !o.config.DisableAccessControl {
-		authToken = o.authTokenFetcher.FetchAuthToken()
+	switch config.Input {
+	case "", nozzleconfig.FirehoseInput:
+		return envelopesource.NewFirehoseSource(config.TrafficControllerURL, config.FirehoseSubscriptionID, config.InsecureSSLSkipVerify, idleTimeout, sourceTokenFetcher)
+	case nozzleconfig.RLPGatewayInput:
+		selectors, err := rlpgateway.ParseSelectors(config.RLPGatewaySelectors)
+		if err != nil {
+			panic(err)
+		}
+		return envelopesource.NewRLPGatewaySource(config.RLPGatewayURL, config.FirehoseSubscriptionID, selectors, config.InsecureSSLSkipVerify, idleTimeout, sourceTokenFetcher)
+	case nozzleconfig.UDPInput:
+		return envelopesource.NewUDPSource(config.UDPListenAddress)
+	case nozzleconfig.ReplayInput:
+		source := envelopesource.NewFileSource(config.ReplayFile)
+		source.SetRealTime(config.ReplayRealTime)
+		source.SetRewriteTimestamps(config.ReplayRewriteTimestamps)
+		return source
+	default:
+		panic(fmt.Sprintf("unknown input %q, expected %q, %q, %q or %q", config.Input, nozzleconfig.FirehoseInput, nozzleconfig.RLPGatewayInput, nozzleconfig.UDPInput, nozzleconfig.ReplayInput))
 	}
-	log.Print("Starting OpenTSDB Firehose Nozzle...")
+}
+
+func (o *OpenTSDBFirehoseNozzle) Start() {
+	logger.Info("Starting OpenTSDB Firehose Nozzle")
 	o.createClient()
-	o.consumeFirehose(authToken)
+	o.createRecorder()
+	o.messages, o.errs = o.source.Connect()
 	o.postToOpenTSDB()
-	log.Print("OpenTSDB Firehose Nozzle shutting down...")
+	o.source.Close()
+	if o.recorder != nil {
+		if err := o.recorder.Close(); err != nil {
+			logger.Error("Could not close the record file", logger.Fields{"file": o.config.RecordFile, "error": err})
+		}
+	}
+	if o.appCache != nil {
+		o.appCache.Stop()
+	}
+	if closer, ok := o.transporter.(io.Closer); ok {
+		closer.Close()
+	}
+	if o.dryRunFile != nil {
+		o.dryRunFile.Close()
+	}
+	logger.Info("OpenTSDB Firehose Nozzle shutting down")
+	close(o.done)
 }
 
 func (o *OpenTSDBFirehoseNozzle) Stop() {
-	o.run<- true
+	select {
+	case o.run <- true:
+	case <-o.done:
+	}
 }
 
 func (o *OpenTSDBFirehoseNozzle) createClient() {
@@ -60,59 +125,183 @@ func (o *OpenTSDBFirehoseNozzle) createClient() {
 		panic(err)
 	}
 
-	var transporter opentsdbclient.Poster
-	if o.config.UseTelnetAPI {
-		transporter = poster.NewTelnetPoster(o.config.OpenTSDBURL)
-	} else {
-		transporter = poster.NewHTTPPoster(o.config.OpenTSDBURL)
+	precision, err := opentsdbclient.ParseTimestampPrecision(o.config.TimestampPrecision)
+	if err != nil {
+		panic(err)
+	}
+
+	o.transporter = o.createTransporter(precision)
+	o.client = opentsdbclient.New(o.transporter, o.config.MetricPrefix, o.config.Deployment, o.config.Job, o.config.Index, ipAddress)
+	o.client.SetTimestampPrecision(precision)
+	o.client.SetForwardAppMetrics(o.config.ForwardAppMetrics)
+	o.client.SetAppTags(o.config.AppMetricTags)
+	o.client.SetForwardEnvelopeTags(o.config.Input == nozzleconfig.RLPGatewayInput)
+	overflowPolicy, _ := opentsdbclient.ParseOverflowPolicy(o.config.BufferOverflowPolicy)
+	o.client.SetBufferLimits(opentsdbclient.BufferLimits{
+		MaxPoints:        int(o.config.MaxBufferedMetrics),
+		MaxBytes:         int(o.config.MaxBufferedBytes),
+		Policy:           overflowPolicy,
+		HighWaterPercent: int(o.config.BufferHighWaterPercent),
+	})
+	o.client.SetFlushThresholds(int(o.config.FlushBatchSize), int(o.config.FlushBatchBytes))
+	if reporter, ok := o.authTokenFetcher.(opentsdbclient.TokenRefreshReporter); ok {
+		o.client.SetTokenRefreshReporter(reporter)
+	}
+	if o.config.NozzleInstanceTag != "" {
+		instanceIndex := o.config.InstanceIndex()
+		if instanceIndex == "" {
+			logger.Warn("NozzleInstanceTag is set but neither Index nor CF_INSTANCE_INDEX is set, not tagging metrics", logger.Fields{"tag": o.config.NozzleInstanceTag})
+		}
+		o.client.SetInstanceTag(o.config.NozzleInstanceTag, instanceIndex)
+	}
+
+	if o.config.CloudControllerURL != "" {
+		ttl := time.Duration(o.config.AppCacheTTLSeconds) * time.Second
+		if ttl == 0 {
+			ttl = defaultAppCacheTTL
+		}
+		ccClient := cloudcontroller.NewClient(o.config.CloudControllerURL, o.config.InsecureSSLSkipVerify, o.authTokenFetcher)
+		o.appCache = cloudcontroller.NewAppCache(ccClient, ttl)
+		o.appCache.Start()
+		o.client.SetAppMetadataResolver(o.appCache)
+	}
+}
+
+func (o *OpenTSDBFirehoseNozzle) createDryRunPoster() opentsdbclient.Poster {
+	if o.config.DryRunFile == "" {
+		logger.Info("Dry run: writing metrics instead of posting them to OpenTSDB", logger.Fields{"file": "stdout"})
+		return poster.NewDryRunPoster(os.Stdout, o.config.UseTelnetAPI)
+	}
+
+	file, err := os.OpenFile(o.config.DryRunFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		panic(err)
 	}
-	o.client = opentsdbclient.New(transporter, o.config.MetricPrefix, o.config.Deployment, o.config.Job, o.config.Index, ipAddress)
+	logger.Info("Dry run: writing metrics instead of posting them to OpenTSDB", logger.Fields{"file": o.config.DryRunFile})
+	o.dryRunFile = file
+	return poster.NewDryRunPoster(file, o.config.UseTelnetAPI)
 }
 
-func (o *OpenTSDBFirehoseNozzle) consumeFirehose(authToken string) {
-	o.consumer = consumer.New(
-		o.config.TrafficControllerURL,
-		&tls.Config{InsecureSkipVerify: o.config.InsecureSSLSkipVerify},
-		nil)
-	o.consumer.SetIdleTimeout(time.Duration(o.config.IdleTimeoutSeconds) * time.Second)
-	o.messages, o.errs = o.consumer.Firehose(o.config.FirehoseSubscriptionID, authToken)
+func (o *OpenTSDBFirehoseNozzle) createRecorder() {
+	if o.config.RecordFile == "" {
+		return
+	}
+
+	recorder, err := envelopesource.NewRecorder(o.config.RecordFile)
+	if err != nil {
+		panic(err)
+	}
+	logger.Info("Recording envelopes", logger.Fields{"file": o.config.RecordFile})
+	o.recorder = recorder
 }
 
 func (o *OpenTSDBFirehoseNozzle) postToOpenTSDB() {
-	ticker := time.NewTicker(time.Duration(o.config.FlushDurationSeconds) * time.Second)
+	flushDurationSeconds := o.config.FlushDurationSeconds
+	ticker := time.NewTicker(time.Duration(flushDurationSeconds) * time.Second)
+	defer func() { ticker.Stop() }()
+	restartTicker := func() {
+		ticker.Stop()
+		ticker = time.NewTicker(time.Duration(flushDurationSeconds) * time.Second)
+	}
 	for {
 		select {
 		case <-o.run:
 			return
 		case <-ticker.C:
 			o.postMetrics()
-		case envelope := <-o.messages:
+		case request := <-o.reloads:
+			o.applyReload(request.config)
+			if o.config.FlushDurationSeconds != flushDurationSeconds {
+				flushDurationSeconds = o.config.FlushDurationSeconds
+				restartTicker()
+			}
+			close(request.done)
+		case envelope, ok := <-o.messages:
+			if !ok {
+				o.messages = nil
+				continue
+			}
+			o.recordEnvelope(envelope)
 			o.client.AddMetric(envelope)
-		case err := <-o.errs:
+			if o.client.BufferFull() || o.client.BatchReady() {
+				// post the batch now, which also stops reading envelopes
+				// until it is posted, and restart the flush interval so
+				// that the next batch is a full interval long
+				o.postMetrics()
+				if !o.postFullBuffer() {
+					return
+				}
+				restartTicker()
+			}
+		case err, ok := <-o.errs:
+			if !ok {
+				o.errs = nil
+				continue
+			}
+			if err == envelopesource.ErrSourceExhausted {
+				logger.Info("Envelope source exhausted")
+				o.postMetrics()
+				return
+			}
+			if fatal, ok := err.(*envelopesource.FatalError); ok {
+				logger.Error("The envelope source failed, shutting down", logger.Fields{"error": fatal.Err})
+				o.postMetrics()
+				return
+			}
 			o.handleError(err)
 			o.postMetrics()
 		}
 	}
 }
 
+func (o *OpenTSDBFirehoseNozzle) recordEnvelope(envelope *events.Envelope) {
+	if o.recorder == nil {
+		return
+	}
+	if err := o.recorder.Record(envelope); err != nil {
+		logger.Error("Could not record envelope", logger.Fields{"file": o.config.RecordFile, "error": err})
+	}
+}
+
 func (o *OpenTSDBFirehoseNozzle) postMetrics() {
-	err := o.client.PostMetrics()
-	if err != nil {
-		log.Printf("Error: %s", err.Error())
+	if o.recorder != nil {
+		if err := o.recorder.Flush(); err != nil {
+			logger.Error("Could not flush the record file", logger.Fields{"file": o.config.RecordFile, "error": err})
+		}
+	}
+
+	// the client logs the metrics it could not post
+	o.client.PostMetrics()
+}
+
+// postFullBuffer retries posting a buffer that is still full under the
+// block policy, without reading envelopes in the meantime, so that the
+// source is held back instead of points being dropped. It returns false
+// when the nozzle is stopped while waiting.
+func (o *OpenTSDBFirehoseNozzle) postFullBuffer() bool {
+	delay := fullBufferRetryDelay
+	for o.client.BufferFull() {
+		select {
+		case <-o.run:
+			return false
+		case <-time.After(delay):
+		}
+		o.postMetrics()
+		delay *= 2
+		if maxDelay := time.Duration(o.config.FlushDurationSeconds) * time.Second; delay > maxDelay {
+			delay = maxDelay
+		}
 	}
+	return true
 }
 
 func (o *OpenTSDBFirehoseNozzle) handleError(err error) {
 	o.client.IncrementFirehoseDisconnect()
-	log.Printf("Closing connection with traffic controller due to %v", err)
-	o.consumer.Close()
+	logger.Warn("Closing connection with the envelope source", logger.Fields{"error": err})
+	o.source.Close()
 
 	time.Sleep(o.config.FirehoseReconnectDelay)
 
-	log.Println("Reconnecting to Firehose")
-	if o.config.DisableAccessControl {
-		o.consumeFirehose("")
-		return
-	}
-	o.consumeFirehose(o.authTokenFetcher.FetchAuthToken())
+	logger.Info("Reconnecting to the envelope source", logger.Fields{"delay": o.config.FirehoseReconnectDelay})
+	o.messages, o.errs = o.source.Connect()
 }
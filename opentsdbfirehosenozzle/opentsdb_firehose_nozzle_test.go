@@ -2,8 +2,12 @@ package opentsdbfirehosenozzle_test
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/cloudfoundry/sonde-go/events"
@@ -11,6 +15,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gbytes"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/envelopesource"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/nozzleconfig"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/opentsdbfirehosenozzle"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
@@ -64,71 +69,313 @@ var _ = Describe("OpenTSDB Firehose Nozzle", func() {
 		fakeOpenTSDB.Close()
 	})
 
-	It("sends metrics when the FlushDurationTicker ticks", func() {
-		fakeFirehose.KeepConnectionAlive()
-		defer fakeFirehose.CloseAliveConnection()
-		config.FlushDurationSeconds = 1
-		nozzle = opentsdbfirehosenozzle.NewOpenTSDBFirehoseNozzle(config, tokenFetcher)
-		envelope := events.Envelope{
-		Origin:    proto.String("origin"),
-			EventType: events.Envelope_ValueMetric.Enum(),
-			ValueMetric: &events.ValueMetric{
-			Name:  proto.String("metricName"),
-				Value: proto.Float64(float64(1)),
-				Unit:  proto.String("gauge"),
-			},
-			Deployment: proto.String("deployment-name"),
-			Job:        proto.String("doppler"),
-			Timestamp: proto.Int64(1000000000),
-		}
-		fakeFirehose.AddEvent(envelope)
-		go nozzle.Start()
-		defer nozzle.Stop()
-		var contents []byte
-		Eventually(fakeOpenTSDB.ReceivedContents, 2).Should(Receive(&contents))
-		var metrics []poster.Metric
-		err := json.Unmarshal(util.UnzipIgnoreError(contents), &metrics)
-		Expect(err).ToNot(HaveOccurred())
-		Expect(logOutput).ToNot(gbytes.Say("Error while reading from the firehose"))
-
-		// +3 internal metrics that show totalMessagesReceived, totalMetricSent, and totalFirehoseDisconnects
-		Expect(metrics).To(HaveLen(4))
-	})
+	Context("with a generated envelope source", func() {
+		var source *envelopesource.GeneratorSource
 
-	It("receives data from the firehose", func(done Done) {
-		defer close(done)
-
-		for i := 0; i < 10; i++ {
-			envelope := events.Envelope{
+		valueMetric := func(name string, value float64) *events.Envelope {
+			return &events.Envelope{
 				Origin:    proto.String("origin"),
 				Timestamp: proto.Int64(1000000000),
 				EventType: events.Envelope_ValueMetric.Enum(),
 				ValueMetric: &events.ValueMetric{
-					Name:  proto.String(fmt.Sprintf("metricName-%d", i)),
-					Value: proto.Float64(float64(i)),
+					Name:  proto.String(name),
+					Value: proto.Float64(value),
 					Unit:  proto.String("gauge"),
 				},
 				Deployment: proto.String("deployment-name"),
 				Job:        proto.String("doppler"),
 				Index:      proto.String("0"),
 			}
-			fakeFirehose.AddEvent(envelope)
 		}
 
-		go nozzle.Start()
-		defer nozzle.Stop()
+		It("sends metrics when the FlushDurationTicker ticks", func() {
+			config.FlushDurationSeconds = 1
+			source = envelopesource.NewGeneratorSource(valueMetric("metricName", 1))
+			nozzle = opentsdbfirehosenozzle.NewOpenTSDBNozzleWithSource(config, tokenFetcher, source)
+
+			go nozzle.Start()
+			defer nozzle.Stop()
+			var contents []byte
+			Eventually(fakeOpenTSDB.ReceivedContents, 2).Should(Receive(&contents))
+			var metrics []poster.Metric
+			err := json.Unmarshal(util.UnzipIgnoreError(contents), &metrics)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logOutput).ToNot(gbytes.Say("Closing connection with the envelope source"))
+
+			Expect(forwardedMetrics(metrics)).To(HaveLen(1))
+			Expect(getMetric(metrics, "opentsdb.nozzle.totalMessagesReceived").Value).To(BeEquivalentTo(1))
+		})
 
-		var contents []byte
-		Eventually(fakeOpenTSDB.ReceivedContents).Should(Receive(&contents))
+		It("posts a full buffer right away with the block policy", func() {
+			config.FlushDurationSeconds = 60
+			config.MaxBufferedMetrics = 2
+			config.BufferOverflowPolicy = "block"
+			source = envelopesource.NewGeneratorSource(valueMetric("first", 1), valueMetric("second", 2), valueMetric("third", 3))
+			nozzle = opentsdbfirehosenozzle.NewOpenTSDBNozzleWithSource(config, tokenFetcher, source)
 
-		var metrics []poster.Metric
-		err := json.Unmarshal(util.UnzipIgnoreError(contents), &metrics)
-		Expect(err).ToNot(HaveOccurred())
+			go nozzle.Start()
+			defer nozzle.Stop()
+			var contents []byte
+			Eventually(fakeOpenTSDB.ReceivedContents, 2).Should(Receive(&contents))
+			var metrics []poster.Metric
+			Expect(json.Unmarshal(util.UnzipIgnoreError(contents), &metrics)).To(Succeed())
+			Expect(metrics[0].Metric).To(Equal("opentsdb.nozzle.origin.first"))
+			Expect(metrics[1].Metric).To(Equal("opentsdb.nozzle.origin.second"))
+			Expect(metrics[2].Metric).To(Equal("opentsdb.nozzle.totalMessagesReceived"))
+		})
 
-		// +3 internal metrics that show totalMessagesReceived, totalMetricSent, and totalFirehoseDisconnects
-		Expect(metrics).To(HaveLen(13))
+		It("keeps a full buffer and stops reading envelopes until a post succeeds with the block policy", func() {
+			config.FlushDurationSeconds = 60
+			config.MaxBufferedMetrics = 2
+			config.BufferOverflowPolicy = "block"
+			fakeOpenTSDB.FailRequests(2)
+			source = envelopesource.NewGeneratorSource(valueMetric("first", 1), valueMetric("second", 2), valueMetric("third", 3))
+			nozzle = opentsdbfirehosenozzle.NewOpenTSDBNozzleWithSource(config, tokenFetcher, source)
+
+			go nozzle.Start()
+			defer nozzle.Stop()
+			var contents []byte
+			Eventually(fakeOpenTSDB.ReceivedContents, 2).Should(Receive(&contents))
+			var metrics []poster.Metric
+			Expect(json.Unmarshal(util.UnzipIgnoreError(contents), &metrics)).To(Succeed())
+			Expect(metrics[0].Metric).To(Equal("opentsdb.nozzle.origin.first"))
+			Expect(metrics[1].Metric).To(Equal("opentsdb.nozzle.origin.second"))
+			Expect(metrics[2].Metric).To(Equal("opentsdb.nozzle.totalMessagesReceived"))
+			Expect(metrics[2].Value).To(BeEquivalentTo(2))
+		})
+
+		It("posts as soon as the batch size is reached", func() {
+			config.FlushDurationSeconds = 60
+			config.FlushBatchSize = 2
+			source = envelopesource.NewGeneratorSource(valueMetric("first", 1), valueMetric("second", 2), valueMetric("third", 3))
+			nozzle = opentsdbfirehosenozzle.NewOpenTSDBNozzleWithSource(config, tokenFetcher, source)
+
+			go nozzle.Start()
+			defer nozzle.Stop()
+			var contents []byte
+			Eventually(fakeOpenTSDB.ReceivedContents, 2).Should(Receive(&contents))
+			var metrics []poster.Metric
+			Expect(json.Unmarshal(util.UnzipIgnoreError(contents), &metrics)).To(Succeed())
+			Expect(metrics[0].Metric).To(Equal("opentsdb.nozzle.origin.first"))
+			Expect(metrics[1].Metric).To(Equal("opentsdb.nozzle.origin.second"))
+			Expect(metrics[2].Metric).To(Equal("opentsdb.nozzle.totalMessagesReceived"))
+			Consistently(fakeOpenTSDB.ReceivedContents).ShouldNot(Receive())
+		})
+
+		It("receives data from the envelope source", func(done Done) {
+			defer close(done)
+
+			var envelopes []*events.Envelope
+			for i := 0; i < 10; i++ {
+				envelopes = append(envelopes, valueMetric(fmt.Sprintf("metricName-%d", i), float64(i)))
+			}
+			config.FlushDurationSeconds = 1
+			source = envelopesource.NewGeneratorSource(envelopes...)
+			nozzle = opentsdbfirehosenozzle.NewOpenTSDBNozzleWithSource(config, tokenFetcher, source)
+
+			go nozzle.Start()
+			defer nozzle.Stop()
+
+			var contents []byte
+			Eventually(fakeOpenTSDB.ReceivedContents, 2).Should(Receive(&contents))
+
+			var metrics []poster.Metric
+			err := json.Unmarshal(util.UnzipIgnoreError(contents), &metrics)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(forwardedMetrics(metrics)).To(HaveLen(10))
+		}, 3)
+
+		It("reconnects and increments the total disconnects metric when the source fails", func() {
+			source = envelopesource.NewGeneratorSource()
+			nozzle = opentsdbfirehosenozzle.NewOpenTSDBNozzleWithSource(config, tokenFetcher, source)
+
+			go nozzle.Start()
+			defer nozzle.Stop()
+			Eventually(source.Connects).Should(Equal(1))
+			source.Fail(errors.New("disconnected"))
+
+			var contents []byte
+			Eventually(fakeOpenTSDB.ReceivedContents).Should(Receive(&contents))
+
+			var metrics []poster.Metric
+			err := json.Unmarshal(util.UnzipIgnoreError(contents), &metrics)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(forwardedMetrics(metrics)).To(BeEmpty())
+			metric := getDisconnectMetric(metrics)
+			Expect(metric.Value).To(BeEquivalentTo(1.0))
+			Eventually(source.Connects).Should(Equal(2))
+		})
+
+		It("flushes and stops when the source is exhausted", func() {
+			source = envelopesource.NewGeneratorSource(valueMetric("metricName", 1))
+			nozzle = opentsdbfirehosenozzle.NewOpenTSDBNozzleWithSource(config, tokenFetcher, source)
+
+			stopped := make(chan struct{})
+			go func() {
+				nozzle.Start()
+				close(stopped)
+			}()
+			Eventually(source.Connects).Should(Equal(1))
+			source.Fail(envelopesource.ErrSourceExhausted)
+
+			var contents []byte
+			Eventually(fakeOpenTSDB.ReceivedContents).Should(Receive(&contents))
+			Eventually(stopped).Should(BeClosed())
+			Expect(source.Connects()).To(Equal(1))
+		})
 
-	}, 2)
+		It("flushes and stops without reconnecting when the source fails for good", func() {
+			source = envelopesource.NewGeneratorSource(valueMetric("metricName", 1))
+			nozzle = opentsdbfirehosenozzle.NewOpenTSDBNozzleWithSource(config, tokenFetcher, source)
+
+			stopped := make(chan struct{})
+			go func() {
+				nozzle.Start()
+				close(stopped)
+			}()
+			Eventually(source.Connects).Should(Equal(1))
+			source.Fail(&envelopesource.FatalError{Err: errors.New("corrupt record")})
+
+			var contents []byte
+			Eventually(fakeOpenTSDB.ReceivedContents).Should(Receive(&contents))
+			Eventually(stopped).Should(BeClosed())
+			Expect(source.Connects()).To(Equal(1))
+		})
+
+		Context("when the configuration is reloaded", func() {
+			var reloaded nozzleconfig.NozzleConfig
+
+			BeforeEach(func() {
+				config.FirehoseSubscriptionID = "opentsdb-nozzle"
+				config.Username = "nozzle"
+				config.Password = "secret"
+				source = envelopesource.NewGeneratorSource(valueMetric("metricName", 1))
+				nozzle = opentsdbfirehosenozzle.NewOpenTSDBNozzleWithSource(config, tokenFetcher, source)
+				reloaded = *config
+			})
+
+			It("applies the new prefix and flush interval", func() {
+				go nozzle.Start()
+				defer nozzle.Stop()
+
+				reloaded.MetricPrefix = "reloaded."
+				reloaded.FlushDurationSeconds = 1
+				reloaded.UAAURL = "https://other-uaa.example.com"
+				Expect(nozzle.Reload(&reloaded)).To(Succeed())
+				Expect(logOutput).To(gbytes.Say(`WARN Not reloading settings that require a restart settings=UAAURL`))
+				Expect(logOutput).To(gbytes.Say(`INFO Reloaded the configuration changed="MetricPrefix from \\"opentsdb.nozzle.\\" to \\"reloaded.\\", FlushDurationSeconds from 10 to 1"`))
+
+				var contents []byte
+				Eventually(fakeOpenTSDB.ReceivedContents, 2).Should(Receive(&contents))
+				var metrics []poster.Metric
+				Expect(json.Unmarshal(util.UnzipIgnoreError(contents), &metrics)).To(Succeed())
+				var names []string
+				for _, metric := range metrics {
+					names = append(names, metric.Metric)
+				}
+				Expect(names).To(ContainElement("reloaded.totalMessagesReceived"))
+			})
+
+			It("keeps the running configuration when the new one is invalid", func() {
+				go nozzle.Start()
+				defer nozzle.Stop()
+
+				reloaded.FlushDurationSeconds = 0
+				err := nozzle.Reload(&reloaded)
+				Expect(err).To(MatchError(ContainSubstring("FlushDurationSeconds must be positive")))
+				Expect(logOutput).NotTo(gbytes.Say("Reloaded the configuration"))
+			})
+		})
+
+		It("records the envelopes and replays them through the replay input", func() {
+			dir, err := ioutil.TempDir("", "nozzle")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			config.FlushDurationSeconds = 1
+			config.RecordFile = filepath.Join(dir, "recording.bin")
+			source = envelopesource.NewGeneratorSource(valueMetric("recorded", 7))
+			nozzle = opentsdbfirehosenozzle.NewOpenTSDBNozzleWithSource(config, tokenFetcher, source)
+
+			stopped := make(chan struct{})
+			go func() {
+				nozzle.Start()
+				close(stopped)
+			}()
+			Eventually(fakeOpenTSDB.ReceivedContents, 2).Should(Receive())
+			nozzle.Stop()
+			Eventually(stopped).Should(BeClosed())
+
+			config.RecordFile = ""
+			config.Input = nozzleconfig.ReplayInput
+			config.ReplayFile = filepath.Join(dir, "recording.bin")
+			nozzle = opentsdbfirehosenozzle.NewOpenTSDBFirehoseNozzle(config, tokenFetcher)
+			nozzle.Start()
+
+			var contents []byte
+			Eventually(fakeOpenTSDB.ReceivedContents).Should(Receive(&contents))
+			var metrics []poster.Metric
+			err = json.Unmarshal(util.UnzipIgnoreError(contents), &metrics)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(forwardedMetrics(metrics)).To(HaveLen(1))
+			Expect(metrics[0].Metric).To(Equal("opentsdb.nozzle.origin.recorded"))
+			Expect(metrics[0].Value).To(BeEquivalentTo(7))
+		})
+	})
+
+	Context("with several outputs", func() {
+		var secondOpenTSDB *FakeOpenTSDB
+
+		BeforeEach(func() {
+			secondOpenTSDB = NewFakeOpenTSDB()
+			secondOpenTSDB.Start()
+
+			config.FlushDurationSeconds = 1
+			config.Outputs = []nozzleconfig.OutputConfig{
+				{Name: "primary", OpenTSDBURL: fakeOpenTSDB.URL()},
+				{Name: "secondary", OpenTSDBURL: secondOpenTSDB.URL(), IncludeMetrics: []string{"opentsdb.nozzle.origin.*"}},
+			}
+		})
+
+		AfterEach(func() {
+			secondOpenTSDB.Close()
+		})
+
+		It("writes to every output with its own filters and stats", func() {
+			source := envelopesource.NewGeneratorSource(&events.Envelope{
+				Origin:    proto.String("origin"),
+				Timestamp: proto.Int64(1000000000),
+				EventType: events.Envelope_ValueMetric.Enum(),
+				ValueMetric: &events.ValueMetric{
+					Name:  proto.String("metricName"),
+					Value: proto.Float64(5),
+					Unit:  proto.String("gauge"),
+				},
+			})
+			nozzle = opentsdbfirehosenozzle.NewOpenTSDBNozzleWithSource(config, tokenFetcher, source)
+			go nozzle.Start()
+			defer nozzle.Stop()
+
+			var contents []byte
+			var metrics []poster.Metric
+			Eventually(secondOpenTSDB.ReceivedContents, 2).Should(Receive(&contents))
+			Expect(json.Unmarshal(util.UnzipIgnoreError(contents), &metrics)).To(Succeed())
+			Expect(metrics).To(HaveLen(1))
+			Expect(metrics[0].Metric).To(Equal("opentsdb.nozzle.origin.metricName"))
+
+			Eventually(fakeOpenTSDB.ReceivedContents, 2).Should(Receive(&contents))
+			Expect(json.Unmarshal(util.UnzipIgnoreError(contents), &metrics)).To(Succeed())
+			Expect(forwardedMetrics(metrics)).To(HaveLen(1))
+			var outputs []string
+			for _, metric := range metrics {
+				if metric.Metric == "opentsdb.nozzle.output.metricsSent" {
+					outputs = append(outputs, metric.Tags.Extra["output"])
+				}
+			}
+			Expect(outputs).To(ConsistOf("primary", "secondary"))
+			Expect(getMetric(metrics, "opentsdb.nozzle.totalMetricsSent").Metric).To(BeEmpty())
+		})
+	})
 
 	It("gets a valid authentication token", func() {
 		go nozzle.Start()
@@ -191,11 +438,54 @@ var _ = Describe("OpenTSDB Firehose Nozzle", func() {
 		})
 	})
 
-	Context("when the firehose disconnects", func() {
+	Context("when the input is the RLP gateway", func() {
+		var fakeGateway *FakeRLPGateway
+
 		BeforeEach(func() {
+			fakeGateway = NewFakeRLPGateway(fakeUAA.AuthToken())
+			fakeGateway.KeepConnectionAlive()
+			fakeGateway.AddBatch(`{"batch":[{"timestamp":"1000000000","source_id":"doppler","tags":{"deployment":"cf","job":"doppler","index":"0","az":"z1"},"gauge":{"metrics":{"ingress":{"unit":"count","value":5}}}}]}`)
+			fakeGateway.Start()
+
+			config.Input = nozzleconfig.RLPGatewayInput
+			config.RLPGatewayURL = fakeGateway.URL()
+			config.FlushDurationSeconds = 1
 			nozzle = opentsdbfirehosenozzle.NewOpenTSDBFirehoseNozzle(config, tokenFetcher)
 		})
 
+		AfterEach(func() {
+			fakeGateway.Close()
+		})
+
+		It("forwards gauges with their v2 tags", func() {
+			go nozzle.Start()
+			defer nozzle.Stop()
+
+			var contents []byte
+			Eventually(fakeOpenTSDB.ReceivedContents, 2).Should(Receive(&contents))
+
+			var metrics []poster.Metric
+			err := json.Unmarshal(util.UnzipIgnoreError(contents), &metrics)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metrics).To(ContainElement(poster.Metric{
+				Metric:    "opentsdb.nozzle.doppler.ingress",
+				Value:     5,
+				Timestamp: 1,
+				Tags: poster.Tags{
+					Deployment: "cf",
+					Job:        "doppler",
+					Index:      "0",
+					Extra: map[string]string{
+						"az": "z1",
+					},
+				},
+			}))
+			Expect(fakeGateway.LastAuthorization()).To(Equal("bearer 123456789"))
+			Expect(fakeFirehose.Requested()).To(BeFalse())
+		})
+	})
+
+	Context("when the firehose disconnects", func() {
 		It("Increments the total disconnects metric", func() {
 			go nozzle.Start()
 			defer nozzle.Stop()
@@ -208,22 +498,35 @@ var _ = Describe("OpenTSDB Firehose Nozzle", func() {
 			err := json.Unmarshal(util.UnzipIgnoreError(contents), &metrics)
 			Expect(err).ToNot(HaveOccurred())
 
-			// +3 internal metrics that show totalMessagesReceived, totalMetricSent, and totalFirehoseDisconnects
-			Expect(metrics).To(HaveLen(3))
+			Expect(forwardedMetrics(metrics)).To(BeEmpty())
 			metric := getDisconnectMetric(metrics)
 			Expect(metric.Metric).To(Equal("opentsdb.nozzle.totalFirehoseDisconnects"))
 			Expect(metric.Value).To(BeEquivalentTo(1.0))
 		})
 	})
-
-
 })
 
 func getDisconnectMetric(metrics []poster.Metric) poster.Metric {
+	return getMetric(metrics, "opentsdb.nozzle.totalFirehoseDisconnects")
+}
+
+func getMetric(metrics []poster.Metric, name string) poster.Metric {
 	for _, metric := range metrics {
-		if metric.Metric == "opentsdb.nozzle.totalFirehoseDisconnects" {
+		if metric.Metric == name {
 			return metric
 		}
 	}
-	return poster.Metric{};
+	return poster.Metric{}
+}
+
+// forwardedMetrics leaves out the metrics the nozzle reports about itself,
+// so that the tests do not depend on how many there are.
+func forwardedMetrics(metrics []poster.Metric) []poster.Metric {
+	var forwarded []poster.Metric
+	for _, metric := range metrics {
+		if strings.HasPrefix(metric.Metric, "opentsdb.nozzle.origin.") {
+			forwarded = append(forwarded, metric)
+		}
+	}
+	return forwarded
 }
\ No newline at end of file
@@ -0,0 +1,192 @@
+package opentsdbfirehosenozzle
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/fanout"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/nozzleconfig"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/opentsdbclient"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+)
+
+func (o *OpenTSDBFirehoseNozzle) createTransporter(precision opentsdbclient.TimestampPrecision) opentsdbclient.Poster {
+	if o.config.DryRun {
+		return o.createDryRunPoster()
+	}
+	if len(o.config.Outputs) == 0 {
+		return createPoster(o.config.PrimaryOutput(), precision)
+	}
+
+	var outputs []*fanout.Output
+	for i, outputConfig := range o.config.Outputs {
+		name := outputConfig.Name
+		if name == "" {
+			name = fmt.Sprintf("%s-%d", outputConfig.Type, i)
+		}
+		outputPoster := createPoster(outputConfig, precision)
+		output, err := fanout.NewOutput(name, outputPoster, outputConfig.IncludeMetrics, outputConfig.ExcludeMetrics)
+		if err != nil {
+			panic(err)
+		}
+		if outputConfig.QueueSize > 0 {
+			output.SetQueueSize(int(outputConfig.QueueSize))
+		}
+		if remoteWritePoster, ok := outputPoster.(*poster.RemoteWritePoster); ok {
+			// The remote write poster retries by itself, honouring
+			// Retry-After and giving up on other 4xx responses, so the
+			// output must not retry its failures again.
+			configureRemoteWriteRetries(remoteWritePoster, outputConfig)
+			output.SetMaxRetries(0)
+		} else {
+			if outputConfig.MaxRetries > 0 {
+				output.SetMaxRetries(int(outputConfig.MaxRetries))
+			}
+			if outputConfig.RetryDelay > 0 {
+				output.SetRetryDelay(outputConfig.RetryDelay)
+			}
+		}
+		logger.Info("Writing to output", logger.Fields{"output": name, "type": outputConfig.Type})
+		outputs = append(outputs, output)
+	}
+	fanOut := fanout.New(outputs...)
+	overflowPolicy, _ := opentsdbclient.ParseOverflowPolicy(o.config.BufferOverflowPolicy)
+	fanOut.SetBlocking(overflowPolicy == opentsdbclient.Block)
+	return fanOut
+}
+
+func createPoster(output nozzleconfig.OutputConfig, precision opentsdbclient.TimestampPrecision) opentsdbclient.Poster {
+	switch output.Type {
+	case "", nozzleconfig.OpenTSDBOutput:
+		if len(output.OpenTSDBURLs) > 0 {
+			return createBalancedPoster(output)
+		}
+		if output.UseTelnetAPI {
+			telnetPoster := poster.NewTelnetPoster(output.OpenTSDBURL)
+			telnetPoster.SetTLSConfig(createTelnetTLSConfig(output))
+			telnetPoster.SetTimeouts(output.OpenTSDBConnectTimeout, output.OpenTSDBRequestTimeout)
+			return telnetPoster
+		}
+		httpPoster := poster.NewHTTPPoster(output.OpenTSDBURL)
+		httpPoster.SetHTTPClient(createHTTPClient(output))
+		if err := httpPoster.SetCompression(parseCompression(output), output.OpenTSDBCompressionLevel); err != nil {
+			panic(err)
+		}
+		return httpPoster
+	case nozzleconfig.GraphiteOutput:
+		return createGraphitePoster(output, precision)
+	case nozzleconfig.InfluxDBOutput:
+		return createInfluxDBPoster(output, precision)
+	case nozzleconfig.RemoteWriteOutput:
+		remoteWritePoster := poster.NewRemoteWritePoster(output.RemoteWriteURL)
+		remoteWritePoster.SetHTTPClient(createHTTPClient(output))
+		remoteWritePoster.SetMillisecondTimestamps(precision == opentsdbclient.MillisecondsPrecision)
+		return remoteWritePoster
+	default:
+		panic(fmt.Sprintf("unknown output %q, expected %q, %q, %q or %q", output.Type, nozzleconfig.OpenTSDBOutput, nozzleconfig.GraphiteOutput, nozzleconfig.InfluxDBOutput, nozzleconfig.RemoteWriteOutput))
+	}
+}
+
+func configureRemoteWriteRetries(remoteWritePoster *poster.RemoteWritePoster, output nozzleconfig.OutputConfig) {
+	if output.MaxRetries == 0 && output.RetryDelay == 0 {
+		return
+	}
+	maxRetries := poster.DefaultRemoteWriteMaxRetries
+	if output.MaxRetries > 0 {
+		maxRetries = int(output.MaxRetries)
+	}
+	minBackoff := poster.DefaultRemoteWriteMinBackoff
+	if output.RetryDelay > 0 {
+		minBackoff = output.RetryDelay
+	}
+	maxBackoff := poster.DefaultRemoteWriteMaxBackoff
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+	remoteWritePoster.SetRetryPolicy(maxRetries, minBackoff, maxBackoff)
+}
+
+func createBalancedPoster(output nozzleconfig.OutputConfig) opentsdbclient.Poster {
+	balancing, err := poster.ParseBalancing(output.OpenTSDBBalancing)
+	if err != nil {
+		panic(err)
+	}
+
+	balancedPoster := poster.NewBalancedPoster(output.OpenTSDBURLs, output.UseTelnetAPI, balancing)
+	balancedPoster.SetHTTPClient(createHTTPClient(output))
+	balancedPoster.SetTelnetOptions(createTelnetTLSConfig(output), output.OpenTSDBConnectTimeout, output.OpenTSDBRequestTimeout)
+	if err := balancedPoster.SetCompression(parseCompression(output), output.OpenTSDBCompressionLevel); err != nil {
+		panic(err)
+	}
+	balancedPoster.SetEjection(int(output.OpenTSDBEjectAfter), output.OpenTSDBEjectCooldown)
+	return balancedPoster
+}
+
+func createHTTPClient(output nozzleconfig.OutputConfig) *http.Client {
+	client, err := poster.NewHTTPClient(output.HTTPClientConfig())
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+func parseCompression(output nozzleconfig.OutputConfig) poster.Compression {
+	compression, err := poster.ParseCompression(output.OpenTSDBCompression)
+	if err != nil {
+		panic(err)
+	}
+	return compression
+}
+
+func createTelnetTLSConfig(output nozzleconfig.OutputConfig) *tls.Config {
+	tlsConfig, err := output.TelnetTLSConfig()
+	if err != nil {
+		panic(err)
+	}
+	return tlsConfig
+}
+
+func createGraphitePoster(output nozzleconfig.OutputConfig, precision opentsdbclient.TimestampPrecision) opentsdbclient.Poster {
+	format, err := poster.ParseGraphiteFormat(output.GraphiteFormat)
+	if err != nil {
+		panic(err)
+	}
+	tagStyle, err := poster.ParseGraphiteTagStyle(output.GraphiteTagStyle)
+	if err != nil {
+		panic(err)
+	}
+
+	graphitePoster := poster.NewGraphitePoster(output.GraphiteAddress, format, tagStyle)
+	graphitePoster.SetMillisecondTimestamps(precision == opentsdbclient.MillisecondsPrecision)
+	graphitePoster.SetTimeouts(output.OpenTSDBConnectTimeout, output.OpenTSDBRequestTimeout)
+	return graphitePoster
+}
+
+func createInfluxDBPoster(output nozzleconfig.OutputConfig, precision opentsdbclient.TimestampPrecision) opentsdbclient.Poster {
+	influxURL, err := url.Parse(output.InfluxDBURL)
+	if err != nil {
+		panic(err)
+	}
+
+	switch influxURL.Scheme {
+	case "udp":
+		if precision == opentsdbclient.MillisecondsPrecision {
+			logger.Warn("The InfluxDB UDP listener has a fixed precision, make sure it is configured for milliseconds")
+		}
+		return poster.NewInfluxDBUDPPoster(influxURL.Host)
+	case "http", "https":
+		influxPoster := poster.NewInfluxDBHTTPPoster(output.InfluxDBURL, output.InfluxDBDatabase, output.InfluxDBRetentionPolicy)
+		influxPoster.SetHTTPClient(createHTTPClient(output))
+		if output.InfluxDBBucket != "" {
+			influxPoster.SetBucket(output.InfluxDBOrganization, output.InfluxDBBucket)
+		}
+		influxPoster.SetToken(output.InfluxDBToken)
+		influxPoster.SetMillisecondTimestamps(precision == opentsdbclient.MillisecondsPrecision)
+		return influxPoster
+	default:
+		panic(fmt.Sprintf("unsupported InfluxDBURL scheme %q, expected http, https or udp", influxURL.Scheme))
+	}
+}
@@ -0,0 +1,64 @@
+package opentsdbfirehosenozzle
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/fanout"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/nozzleconfig"
+)
+
+type reloadRequest struct {
+	config *nozzleconfig.NozzleConfig
+	done   chan struct{}
+}
+
+// Reload validates config and applies the settings that can change while
+// the nozzle runs, see nozzleconfig.ReloadDiff. The changes are applied
+// between two envelopes, so a batch never mixes old and new settings.
+// An invalid config is rejected and the running one is kept.
+func (o *OpenTSDBFirehoseNozzle) Reload(config *nozzleconfig.NozzleConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	request := reloadRequest{config: config, done: make(chan struct{})}
+	select {
+	case o.reloads <- request:
+	case <-o.done:
+		return errors.New("the nozzle has stopped")
+	}
+	<-request.done
+	return nil
+}
+
+func (o *OpenTSDBFirehoseNozzle) applyReload(next *nozzleconfig.NozzleConfig) {
+	reloadable, restartRequired := nozzleconfig.ReloadDiff(o.config, next)
+	if len(restartRequired) > 0 {
+		logger.Warn("Not reloading settings that require a restart", logger.Fields{"settings": strings.Join(restartRequired, ", ")})
+	}
+	if len(reloadable) == 0 {
+		logger.Info("Reloaded the configuration, no setting that can be reloaded has changed")
+		return
+	}
+
+	if level, err := logger.ParseLevel(next.LogLevel); err == nil {
+		logger.SetLevel(level)
+	}
+	o.client.SetPrefix(next.MetricPrefix)
+	if fanOut, ok := o.transporter.(*fanout.FanOut); ok && len(next.Outputs) == len(o.config.Outputs) {
+		for i, output := range fanOut.Outputs() {
+			if err := output.SetFilters(next.Outputs[i].IncludeMetrics, next.Outputs[i].ExcludeMetrics); err != nil {
+				logger.Error("Could not reload the filters of an output", logger.Fields{"output": output.Name(), "error": err})
+			}
+		}
+	}
+	o.config = nozzleconfig.Reloaded(o.config, next)
+
+	changes := make([]string, 0, len(reloadable))
+	for _, change := range reloadable {
+		changes = append(changes, change.String())
+	}
+	logger.Info("Reloaded the configuration", logger.Fields{"changed": strings.Join(changes, ", ")})
+}
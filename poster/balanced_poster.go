@@ -0,0 +1,326 @@
+package poster
+
+import (
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
+)
+
+type Balancing int
+
+const (
+	RoundRobin Balancing = iota
+	// ConsistentHash sends every series to the same TSD as long as that TSD
+	// is healthy, which keeps each TSD's compaction and caches effective.
+	ConsistentHash
+)
+
+func ParseBalancing(balancing string) (Balancing, error) {
+	switch strings.ToLower(balancing) {
+	case "", "round-robin":
+		return RoundRobin, nil
+	case "consistent-hash":
+		return ConsistentHash, nil
+	default:
+		return RoundRobin, fmt.Errorf("unknown balancing %q, expected round-robin or consistent-hash", balancing)
+	}
+}
+
+const (
+	defaultEjectAfterFailures = 3
+	defaultEjectCooldown      = 30 * time.Second
+	hashRingReplicas          = 100
+	probeTimeout              = 5 * time.Second
+)
+
+type metricPoster interface {
+	Post([]Metric) error
+}
+
+type endpoint struct {
+	// index is the position in the configured URLs
+	index    int
+	url      string
+	probeURL string
+	poster   metricPoster
+
+	failures     int
+	ejectedUntil time.Time
+}
+
+type ringEntry struct {
+	hash     uint32
+	endpoint int
+}
+
+type ringByHash []ringEntry
+
+func (r ringByHash) Len() int           { return len(r) }
+func (r ringByHash) Less(i, j int) bool { return r[i].hash < r[j].hash }
+func (r ringByHash) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+type endpointsByIndex []*endpoint
+
+func (e endpointsByIndex) Len() int           { return len(e) }
+func (e endpointsByIndex) Less(i, j int) bool { return e[i].index < e[j].index }
+func (e endpointsByIndex) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// BalancedPoster distributes batches over several TSDs. An endpoint that
+// fails ejectAfterFailures posts in a row is ejected for the cooldown and
+// only reinstated once its /api/version answers.
+type BalancedPoster struct {
+	balancing          Balancing
+	ejectAfterFailures int
+	ejectCooldown      time.Duration
+	probeClient        *http.Client
+
+	lock      sync.Mutex
+	endpoints []*endpoint
+	ring      []ringEntry
+	next      int
+}
+
+func NewBalancedPoster(urls []string, useTelnetAPI bool, balancing Balancing) *BalancedPoster {
+	p := &BalancedPoster{
+		balancing:          balancing,
+		ejectAfterFailures: defaultEjectAfterFailures,
+		ejectCooldown:      defaultEjectCooldown,
+		probeClient:        &http.Client{Timeout: probeTimeout},
+	}
+
+	for i, url := range urls {
+		e := &endpoint{index: i, url: url, probeURL: VersionURL(url, useTelnetAPI)}
+		if useTelnetAPI {
+			e.poster = NewTelnetPoster(url)
+		} else {
+			e.poster = NewHTTPPoster(url)
+		}
+		p.endpoints = append(p.endpoints, e)
+
+		for replica := 0; replica < hashRingReplicas; replica++ {
+			p.ring = append(p.ring, ringEntry{hash: hashString(url + "#" + strconv.Itoa(replica)), endpoint: i})
+		}
+	}
+	sort.Sort(ringByHash(p.ring))
+	return p
+}
+
+// SetHTTPClient sets the client used to post to HTTP endpoints and to
+// probe ejected endpoints.
+func (p *BalancedPoster) SetHTTPClient(client *http.Client) {
+	p.probeClient = client
+	for _, e := range p.endpoints {
+		if httpPoster, ok := e.poster.(*HTTPPoster); ok {
+			httpPoster.SetHTTPClient(client)
+		}
+	}
+}
+
+// SetCompression sets the compression of the HTTP endpoints.
+func (p *BalancedPoster) SetCompression(compression Compression, level int) error {
+	for _, e := range p.endpoints {
+		if httpPoster, ok := e.poster.(*HTTPPoster); ok {
+			if err := httpPoster.SetCompression(compression, level); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BytesSent adds up the bytes sent to the HTTP endpoints.
+func (p *BalancedPoster) BytesSent() (uncompressed uint64, compressed uint64) {
+	for _, e := range p.endpoints {
+		if httpPoster, ok := e.poster.(*HTTPPoster); ok {
+			endpointUncompressed, endpointCompressed := httpPoster.BytesSent()
+			uncompressed += endpointUncompressed
+			compressed += endpointCompressed
+		}
+	}
+	return uncompressed, compressed
+}
+
+// SetTelnetOptions applies the TLS settings and timeouts to telnet
+// endpoints. With TLS, ejected endpoints are probed over https.
+func (p *BalancedPoster) SetTelnetOptions(tlsConfig *tls.Config, connectTimeout time.Duration, writeTimeout time.Duration) {
+	for _, e := range p.endpoints {
+		telnetPoster, ok := e.poster.(*TelnetPoster)
+		if !ok {
+			continue
+		}
+		telnetPoster.SetTLSConfig(tlsConfig)
+		telnetPoster.SetTimeouts(connectTimeout, writeTimeout)
+		if tlsConfig != nil {
+			e.probeURL = "https://" + strings.TrimPrefix(e.probeURL, "http://")
+		}
+	}
+}
+
+// SetEjection sets how many failed posts in a row eject an endpoint and
+// for how long. Zero keeps the default of 3 failures and 30 seconds.
+func (p *BalancedPoster) SetEjection(ejectAfterFailures int, ejectCooldown time.Duration) {
+	if ejectAfterFailures <= 0 {
+		ejectAfterFailures = defaultEjectAfterFailures
+	}
+	p.ejectAfterFailures = ejectAfterFailures
+	p.ejectCooldown = durationOrDefault(ejectCooldown, defaultEjectCooldown)
+}
+
+// VersionURL derives the /api/version URL of a TSD. The telnet API shares
+// its port with the HTTP API.
+func VersionURL(url string, useTelnetAPI bool) string {
+	if useTelnetAPI {
+		return "http://" + url + "/api/version"
+	}
+	url = strings.TrimRight(url, "/")
+	if strings.HasSuffix(url, "/api") {
+		return url + "/version"
+	}
+	return url + "/api/version"
+}
+
+func (p *BalancedPoster) Post(metrics []Metric) error {
+	healthy := p.healthyEndpoints()
+	if len(healthy) == 0 {
+		return fmt.Errorf("no healthy OpenTSDB endpoints, dropping %d metrics", len(metrics))
+	}
+
+	if p.balancing == RoundRobin {
+		p.lock.Lock()
+		start := p.next % len(healthy)
+		p.next++
+		p.lock.Unlock()
+		return p.postWithFailover(metrics, healthy, start)
+	}
+
+	positions := make(map[*endpoint]int, len(healthy))
+	for i, e := range healthy {
+		positions[e] = i
+	}
+	batches := make(map[int][]Metric)
+	for _, metric := range metrics {
+		i := p.lookup(seriesHash(metric), positions)
+		batches[i] = append(batches[i], metric)
+	}
+
+	var failures []string
+	for i, batch := range batches {
+		if err := p.postWithFailover(batch, healthy, i); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// postWithFailover posts to healthy[start] and moves on to the next healthy
+// endpoint when that fails.
+func (p *BalancedPoster) postWithFailover(metrics []Metric, healthy []*endpoint, start int) error {
+	var errs []string
+	for attempt := 0; attempt < len(healthy); attempt++ {
+		e := healthy[(start+attempt)%len(healthy)]
+		err := e.poster.Post(metrics)
+		p.recordResult(e, err)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", e.url, err))
+	}
+	return fmt.Errorf("all OpenTSDB endpoints failed: %s", strings.Join(errs, "; "))
+}
+
+func (p *BalancedPoster) recordResult(e *endpoint, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err == nil {
+		e.failures = 0
+		return
+	}
+
+	e.failures++
+	if e.failures >= p.ejectAfterFailures {
+		logger.Warn("Ejecting OpenTSDB endpoint", logger.Fields{"endpoint": e.url, "cooldown": p.ejectCooldown, "failures": e.failures})
+		e.ejectedUntil = time.Now().Add(p.ejectCooldown)
+		e.failures = 0
+	}
+}
+
+// healthyEndpoints returns the endpoints that are not ejected, probing the
+// ejected ones whose cooldown has passed.
+func (p *BalancedPoster) healthyEndpoints() []*endpoint {
+	p.lock.Lock()
+	var healthy, probe []*endpoint
+	now := time.Now()
+	for _, e := range p.endpoints {
+		switch {
+		case e.ejectedUntil.IsZero():
+			healthy = append(healthy, e)
+		case now.After(e.ejectedUntil):
+			probe = append(probe, e)
+		}
+	}
+	p.lock.Unlock()
+
+	for _, e := range probe {
+		if p.probe(e) {
+			healthy = append(healthy, e)
+		}
+	}
+	// keep the configured order so that round-robin and failover are stable
+	sort.Sort(endpointsByIndex(healthy))
+	return healthy
+}
+
+func (p *BalancedPoster) probe(e *endpoint) bool {
+	resp, err := p.probeClient.Get(e.probeURL)
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		e.ejectedUntil = time.Now().Add(p.ejectCooldown)
+		return false
+	}
+	logger.Info("Reinstating OpenTSDB endpoint", logger.Fields{"endpoint": e.url})
+	e.ejectedUntil = time.Time{}
+	return true
+}
+
+// lookup finds the first healthy endpoint clockwise from hash on the ring
+// and returns its position among the healthy endpoints.
+func (p *BalancedPoster) lookup(hash uint32, positions map[*endpoint]int) int {
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= hash })
+	for offset := 0; offset < len(p.ring); offset++ {
+		entry := p.ring[(start+offset)%len(p.ring)]
+		if i, ok := positions[p.endpoints[entry.endpoint]]; ok {
+			return i
+		}
+	}
+	return 0
+}
+
+func seriesHash(metric Metric) uint32 {
+	key := metric.Metric + " " + metric.Tags.Deployment + " " + metric.Tags.Job + " " + metric.Tags.Index + " " + metric.Tags.IP
+	for _, k := range metric.Tags.ExtraKeys() {
+		key += " " + k + "=" + metric.Tags.Extra[k]
+	}
+	return hashString(key)
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,249 @@
+package poster_test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+)
+
+type fakeTSD struct {
+	server *httptest.Server
+
+	lock     sync.Mutex
+	healthy  bool
+	received []poster.Metric
+	posts    int
+	probes   int
+}
+
+func newFakeTSD() *fakeTSD {
+	tsd := &fakeTSD{healthy: true}
+	tsd.server = httptest.NewServer(tsd)
+	return tsd
+}
+
+func (t *fakeTSD) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	switch r.URL.Path {
+	case "/api/version":
+		t.probes++
+	case "/put":
+		t.posts++
+		if t.healthy {
+			reader, err := gzip.NewReader(r.Body)
+			Expect(err).NotTo(HaveOccurred())
+			var metrics []poster.Metric
+			Expect(json.NewDecoder(reader).Decode(&metrics)).To(Succeed())
+			t.received = append(t.received, metrics...)
+		}
+	}
+	if !t.healthy {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+func (t *fakeTSD) setHealthy(healthy bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.healthy = healthy
+}
+
+func (t *fakeTSD) metrics() []poster.Metric {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.received
+}
+
+func (t *fakeTSD) counts() (posts, probes int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.posts, t.probes
+}
+
+var _ = Describe("BalancedPoster", func() {
+	var tsds []*fakeTSD
+	var urls []string
+
+	BeforeEach(func() {
+		tsds = []*fakeTSD{newFakeTSD(), newFakeTSD(), newFakeTSD()}
+		urls = nil
+		for _, tsd := range tsds {
+			urls = append(urls, tsd.server.URL)
+		}
+	})
+
+	AfterEach(func() {
+		for _, tsd := range tsds {
+			tsd.server.Close()
+		}
+	})
+
+	series := func(name string, count int) []poster.Metric {
+		var metrics []poster.Metric
+		for i := 0; i < count; i++ {
+			metrics = append(metrics, poster.Metric{
+				Metric:    fmt.Sprintf("%s.%d", name, i),
+				Value:     1,
+				Timestamp: 1000,
+				Tags:      poster.Tags{Deployment: "cf", Job: "doppler", Index: "0"},
+			})
+		}
+		return metrics
+	}
+
+	It("parses the balancing", func() {
+		Expect(poster.ParseBalancing("")).To(Equal(poster.RoundRobin))
+		Expect(poster.ParseBalancing("round-robin")).To(Equal(poster.RoundRobin))
+		Expect(poster.ParseBalancing("consistent-hash")).To(Equal(poster.ConsistentHash))
+		_, err := poster.ParseBalancing("random")
+		Expect(err).To(MatchError(`unknown balancing "random", expected round-robin or consistent-hash`))
+	})
+
+	Context("round-robin", func() {
+		It("sends each batch to the next endpoint", func() {
+			p := poster.NewBalancedPoster(urls, false, poster.RoundRobin)
+			for i := 0; i < 6; i++ {
+				Expect(p.Post(series("metric", 1))).To(Succeed())
+			}
+
+			for _, tsd := range tsds {
+				Expect(tsd.metrics()).To(HaveLen(2))
+			}
+		})
+
+		It("fails over to the next endpoint", func() {
+			tsds[0].setHealthy(false)
+			p := poster.NewBalancedPoster(urls, false, poster.RoundRobin)
+
+			Expect(p.Post(series("metric", 1))).To(Succeed())
+			Expect(tsds[1].metrics()).To(HaveLen(1))
+		})
+
+		It("returns an error when every endpoint fails", func() {
+			for _, tsd := range tsds {
+				tsd.setHealthy(false)
+			}
+			p := poster.NewBalancedPoster(urls, false, poster.RoundRobin)
+
+			err := p.Post(series("metric", 1))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("all OpenTSDB endpoints failed: "))
+		})
+	})
+
+	Context("consistent hash", func() {
+		It("sends every series to the same endpoint", func() {
+			p := poster.NewBalancedPoster(urls, false, poster.ConsistentHash)
+			Expect(p.Post(series("metric", 100))).To(Succeed())
+
+			owners := make(map[string]int)
+			for i, tsd := range tsds {
+				Expect(tsd.metrics()).NotTo(BeEmpty())
+				for _, metric := range tsd.metrics() {
+					owners[metric.Metric] = i
+				}
+			}
+
+			Expect(p.Post(series("metric", 100))).To(Succeed())
+			for i, tsd := range tsds {
+				for _, metric := range tsd.metrics() {
+					Expect(owners[metric.Metric]).To(Equal(i))
+				}
+			}
+		})
+
+		It("only moves the series of an ejected endpoint", func() {
+			p := poster.NewBalancedPoster(urls, false, poster.ConsistentHash)
+			p.SetEjection(1, time.Hour)
+			Expect(p.Post(series("metric", 100))).To(Succeed())
+			owners := make(map[string]int)
+			for i, tsd := range tsds {
+				for _, metric := range tsd.metrics() {
+					owners[metric.Metric] = i
+				}
+			}
+
+			tsds[0].setHealthy(false)
+			Expect(p.Post(series("metric", 100))).To(Succeed())
+			received := []int{0, len(tsds[1].metrics()), len(tsds[2].metrics())}
+			Expect(p.Post(series("metric", 100))).To(Succeed())
+
+			moved := 0
+			for i := 1; i < len(tsds); i++ {
+				for _, metric := range tsds[i].metrics()[received[i]:] {
+					if owners[metric.Metric] == 0 {
+						moved++
+					} else {
+						Expect(owners[metric.Metric]).To(Equal(i))
+					}
+				}
+			}
+			Expect(moved).To(BeNumerically(">", 0))
+		})
+	})
+
+	Context("ejection", func() {
+		It("ejects an endpoint after repeated failures and reinstates it once /api/version answers", func() {
+			p := poster.NewBalancedPoster(urls[:2], false, poster.RoundRobin)
+			p.SetEjection(2, 50*time.Millisecond)
+			tsds[0].setHealthy(false)
+
+			for i := 0; i < 4; i++ {
+				Expect(p.Post(series("metric", 1))).To(Succeed())
+			}
+			posts, _ := tsds[0].counts()
+			Expect(posts).To(Equal(2))
+
+			for i := 0; i < 4; i++ {
+				Expect(p.Post(series("metric", 1))).To(Succeed())
+			}
+			posts, probes := tsds[0].counts()
+			Expect(posts).To(Equal(2))
+			Expect(probes).To(Equal(0))
+
+			time.Sleep(60 * time.Millisecond)
+			Expect(p.Post(series("metric", 1))).To(Succeed())
+			_, probes = tsds[0].counts()
+			Expect(probes).To(Equal(1))
+			Expect(tsds[0].metrics()).To(BeEmpty())
+
+			tsds[0].setHealthy(true)
+			time.Sleep(60 * time.Millisecond)
+			Expect(p.Post(series("metric", 1))).To(Succeed())
+			Expect(p.Post(series("metric", 1))).To(Succeed())
+			Expect(tsds[0].metrics()).To(HaveLen(1))
+		})
+
+		It("keeps the default of 3 failures when no ejection is configured", func() {
+			p := poster.NewBalancedPoster(urls[:2], false, poster.RoundRobin)
+			p.SetEjection(0, 0)
+			tsds[0].setHealthy(false)
+
+			for i := 0; i < 8; i++ {
+				Expect(p.Post(series("metric", 1))).To(Succeed())
+			}
+			posts, probes := tsds[0].counts()
+			Expect(posts).To(Equal(3))
+			Expect(probes).To(Equal(0))
+		})
+
+		It("drops the batch when every endpoint is ejected", func() {
+			p := poster.NewBalancedPoster(urls[:1], false, poster.RoundRobin)
+			p.SetEjection(1, time.Hour)
+			tsds[0].setHealthy(false)
+
+			Expect(p.Post(series("metric", 1))).NotTo(Succeed())
+			Expect(p.Post(series("metric", 2))).To(MatchError("no healthy OpenTSDB endpoints, dropping 2 metrics"))
+		})
+	})
+})
@@ -0,0 +1,158 @@
+package poster
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Compression int
+
+const (
+	GzipCompression Compression = iota
+	// DeflateCompression is the zlib format, which is what HTTP means by
+	// the deflate content encoding.
+	DeflateCompression
+	NoCompression
+)
+
+func ParseCompression(compression string) (Compression, error) {
+	switch strings.ToLower(compression) {
+	case "", "gzip":
+		return GzipCompression, nil
+	case "deflate":
+		return DeflateCompression, nil
+	case "none":
+		return NoCompression, nil
+	default:
+		return GzipCompression, fmt.Errorf("unknown compression %q, expected none, gzip or deflate", compression)
+	}
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+type resettableWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// compressor compresses request bodies into pooled buffers, reusing the
+// compressing writers between requests.
+type compressor struct {
+	compression Compression
+	writers     sync.Pool
+}
+
+// newCompressor returns a compressor for the level, between 1 and 9. Level
+// 0 selects the default level.
+func newCompressor(compression Compression, level int) (*compressor, error) {
+	if level == 0 {
+		level = flate.DefaultCompression
+	} else if level < flate.BestSpeed || level > flate.BestCompression {
+		return nil, fmt.Errorf("invalid compression level %d, expected 1 to 9", level)
+	}
+
+	c := &compressor{compression: compression}
+	c.writers.New = func() interface{} {
+		var w resettableWriter
+		switch compression {
+		case GzipCompression:
+			w, _ = gzip.NewWriterLevel(nil, level)
+		case DeflateCompression:
+			w, _ = zlib.NewWriterLevel(nil, level)
+		}
+		return w
+	}
+	return c, nil
+}
+
+func (c *compressor) contentEncoding() string {
+	switch c.compression {
+	case GzipCompression:
+		return "gzip"
+	case DeflateCompression:
+		return "deflate"
+	default:
+		return ""
+	}
+}
+
+// compress returns a pooled buffer holding the compressed data, which the
+// caller hands back with releaseBuffer once it has been sent.
+func (c *compressor) compress(data []byte) (*bytes.Buffer, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	if c.compression == NoCompression {
+		buf.Write(data)
+		return buf, nil
+	}
+
+	w := c.writers.Get().(resettableWriter)
+	defer c.writers.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(data); err != nil {
+		releaseBuffer(buf)
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		releaseBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+func releaseBuffer(buf *bytes.Buffer) {
+	bufferPool.Put(buf)
+}
+
+// pooledRequestBody lends a pooled buffer to an HTTP request. The transport
+// may still be writing the body after the response arrived, and may ask
+// for it again to retry, so the buffer goes back to the pool only once the
+// poster and every body handed out are done with it.
+type pooledRequestBody struct {
+	buf  *bytes.Buffer
+	refs int32
+}
+
+func newPooledRequestBody(buf *bytes.Buffer) *pooledRequestBody {
+	return &pooledRequestBody{buf: buf, refs: 1}
+}
+
+func (b *pooledRequestBody) attach(req *http.Request) {
+	req.ContentLength = int64(b.buf.Len())
+	req.Body = b.open()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return b.open(), nil
+	}
+}
+
+func (b *pooledRequestBody) open() io.ReadCloser {
+	atomic.AddInt32(&b.refs, 1)
+	return &pooledBodyReader{Reader: bytes.NewReader(b.buf.Bytes()), body: b}
+}
+
+func (b *pooledRequestBody) release() {
+	if atomic.AddInt32(&b.refs, -1) == 0 {
+		releaseBuffer(b.buf)
+	}
+}
+
+type pooledBodyReader struct {
+	*bytes.Reader
+	body *pooledRequestBody
+	once sync.Once
+}
+
+func (r *pooledBodyReader) Close() error {
+	r.once.Do(r.body.release)
+	return nil
+}
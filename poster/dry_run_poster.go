@@ -0,0 +1,37 @@
+package poster
+
+import (
+	"io"
+	"sync"
+)
+
+// DryRunPoster writes the metrics to w in the format the telnet or HTTP
+// poster would send them, without contacting OpenTSDB.
+type DryRunPoster struct {
+	lock   sync.Mutex
+	writer io.Writer
+	format func([]Metric) []byte
+}
+
+func NewDryRunPoster(writer io.Writer, useTelnetAPI bool) *DryRunPoster {
+	format := (&HTTPPoster{}).formatMetrics
+	if useTelnetAPI {
+		format = (&TelnetPoster{}).formatMetrics
+	}
+	return &DryRunPoster{
+		writer: writer,
+		format: format,
+	}
+}
+
+func (p *DryRunPoster) Post(metrics []Metric) error {
+	output := p.format(metrics)
+	if len(output) > 0 && output[len(output)-1] != '\n' {
+		output = append(output, '\n')
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, err := p.writer.Write(output)
+	return err
+}
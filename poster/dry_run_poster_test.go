@@ -0,0 +1,52 @@
+package poster_test
+
+import (
+	"bytes"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+)
+
+var _ = Describe("DryRunPoster", func() {
+	var output *bytes.Buffer
+	var metric poster.Metric
+
+	BeforeEach(func() {
+		output = &bytes.Buffer{}
+		metric = poster.Metric{
+			Metric:    "origin.metricName",
+			Value:     5,
+			Timestamp: 1000,
+			Tags: poster.Tags{
+				Deployment: "deployment-name",
+				Job:        "doppler",
+				Index:      "SOME-GUID",
+				IP:         "10.10.10.10",
+			},
+		}
+	})
+
+	It("writes telnet put lines", func() {
+		p := poster.NewDryRunPoster(output, true)
+		err := p.Post([]poster.Metric{metric, metric})
+		Expect(err).ToNot(HaveOccurred())
+
+		line := "put origin.metricName 1000 5.000000 deployment=deployment-name index=SOME-GUID ip=10.10.10.10 job=doppler\n"
+		Expect(output.String()).To(Equal(line + line))
+	})
+
+	It("writes the HTTP JSON body, one line per post", func() {
+		p := poster.NewDryRunPoster(output, false)
+		Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+		Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+
+		lines := bytes.Split(bytes.TrimSuffix(output.Bytes(), []byte("\n")), []byte("\n"))
+		Expect(lines).To(HaveLen(2))
+
+		var metrics []poster.Metric
+		Expect(json.Unmarshal(lines[0], &metrics)).To(Succeed())
+		Expect(metrics).To(Equal([]poster.Metric{metric}))
+	})
+})
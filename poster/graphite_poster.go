@@ -0,0 +1,227 @@
+package poster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type GraphiteFormat int
+
+const (
+	GraphitePlaintext GraphiteFormat = iota
+	GraphitePickle
+)
+
+func ParseGraphiteFormat(format string) (GraphiteFormat, error) {
+	switch strings.ToLower(format) {
+	case "", "plaintext":
+		return GraphitePlaintext, nil
+	case "pickle":
+		return GraphitePickle, nil
+	default:
+		return GraphitePlaintext, fmt.Errorf("unknown graphite format %q, expected plaintext or pickle", format)
+	}
+}
+
+type GraphiteTagStyle int
+
+const (
+	// GraphitePathTags folds the tag values into the dotted metric path.
+	GraphitePathTags GraphiteTagStyle = iota
+	// GraphiteTaggedSeries uses the Graphite 1.1 name;tag=value syntax.
+	GraphiteTaggedSeries
+)
+
+func ParseGraphiteTagStyle(style string) (GraphiteTagStyle, error) {
+	switch strings.ToLower(style) {
+	case "", "path":
+		return GraphitePathTags, nil
+	case "tagged":
+		return GraphiteTaggedSeries, nil
+	default:
+		return GraphitePathTags, fmt.Errorf("unknown graphite tag style %q, expected path or tagged", style)
+	}
+}
+
+// carbon rejects pickled messages above 1MB, so batches are kept well below.
+const graphitePickleBatchSize = 500
+
+type GraphitePoster struct {
+	conn                  *persistentConn
+	format                GraphiteFormat
+	tagStyle              GraphiteTagStyle
+	millisecondTimestamps bool
+}
+
+func NewGraphitePoster(address string, format GraphiteFormat, tagStyle GraphiteTagStyle) *GraphitePoster {
+	return &GraphitePoster{
+		conn:     newPersistentConn(address),
+		format:   format,
+		tagStyle: tagStyle,
+	}
+}
+
+// SetMillisecondTimestamps tells the poster that metric timestamps are in
+// milliseconds; Graphite expects (fractional) seconds.
+func (p *GraphitePoster) SetMillisecondTimestamps(millisecondTimestamps bool) {
+	p.millisecondTimestamps = millisecondTimestamps
+}
+
+// SetTimeouts bounds the connection and the write of each batch.
+func (p *GraphitePoster) SetTimeouts(connectTimeout time.Duration, writeTimeout time.Duration) {
+	p.conn.setTimeouts(connectTimeout, writeTimeout)
+}
+
+func (p *GraphitePoster) Post(metrics []Metric) error {
+	if p.format == GraphitePickle {
+		for start := 0; start < len(metrics); start += graphitePickleBatchSize {
+			end := start + graphitePickleBatchSize
+			if end > len(metrics) {
+				end = len(metrics)
+			}
+			if err := p.conn.write(p.formatPickle(metrics[start:end])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(metrics) == 0 {
+		return nil
+	}
+	return p.conn.write(p.formatPlaintext(metrics))
+}
+
+func (p *GraphitePoster) Close() error {
+	return p.conn.close()
+}
+
+func (p *GraphitePoster) formatPlaintext(metrics []Metric) []byte {
+	var buf bytes.Buffer
+	for _, metric := range metrics {
+		fmt.Fprintf(&buf, "%s %s %s\n",
+			p.path(metric),
+			strconv.FormatFloat(metric.Value, 'f', -1, 64),
+			p.timestamp(metric))
+	}
+	return buf.Bytes()
+}
+
+func (p *GraphitePoster) timestamp(metric Metric) string {
+	if p.millisecondTimestamps {
+		return strconv.FormatFloat(float64(metric.Timestamp)/1000, 'f', 3, 64)
+	}
+	return strconv.FormatInt(metric.Timestamp, 10)
+}
+
+func (p *GraphitePoster) seconds(metric Metric) float64 {
+	if p.millisecondTimestamps {
+		return float64(metric.Timestamp) / 1000
+	}
+	return float64(metric.Timestamp)
+}
+
+func (p *GraphitePoster) path(metric Metric) string {
+	if p.tagStyle == GraphiteTaggedSeries {
+		path := sanitizeGraphiteName(metric.Metric, true)
+		appendTag := func(key string, value string) {
+			if value != "" {
+				path += ";" + sanitizeGraphiteTag(key) + "=" + sanitizeGraphiteTag(value)
+			}
+		}
+		appendTag("deployment", metric.Tags.Deployment)
+		appendTag("job", metric.Tags.Job)
+		appendTag("index", metric.Tags.Index)
+		appendTag("ip", metric.Tags.IP)
+		for _, key := range metric.Tags.ExtraKeys() {
+			appendTag(key, metric.Tags.Extra[key])
+		}
+		return path
+	}
+
+	// The ip is left out of dotted paths, it would start a new series
+	// whenever a VM is recreated.
+	var nodes []string
+	appendNode := func(value string) {
+		if value != "" {
+			nodes = append(nodes, sanitizeGraphiteName(value, false))
+		}
+	}
+	appendNode(metric.Tags.Deployment)
+	appendNode(metric.Tags.Job)
+	appendNode(metric.Tags.Index)
+	nodes = append(nodes, sanitizeGraphiteName(metric.Metric, true))
+	for _, key := range metric.Tags.ExtraKeys() {
+		appendNode(metric.Tags.Extra[key])
+	}
+	return strings.Join(nodes, ".")
+}
+
+// sanitizeGraphiteName replaces characters that would break the plaintext
+// protocol or, unless keepDots is set, split a tag value into several nodes.
+func sanitizeGraphiteName(name string, keepDots bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '.' && keepDots:
+			return r
+		case r == '.', r == ' ', r == '\t', r == '\n', r == ';', r == '/', r == '\\':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func sanitizeGraphiteTag(tag string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', ';', '~', '=', '!', '^':
+			return '_'
+		}
+		return r
+	}, tag)
+}
+
+// formatPickle encodes the metrics as the list of (path, (timestamp, value))
+// tuples carbon's pickle receiver expects, using pickle protocol 2 and a
+// 4 byte big endian length header.
+func (p *GraphitePoster) formatPickle(metrics []Metric) []byte {
+	var payload bytes.Buffer
+	payload.Write([]byte{0x80, 2}) // PROTO 2
+	payload.WriteByte(']')         // EMPTY_LIST
+	if len(metrics) > 0 {
+		payload.WriteByte('(') // MARK
+		for _, metric := range metrics {
+			writePickleUnicode(&payload, p.path(metric))
+			writePickleFloat(&payload, p.seconds(metric))
+			writePickleFloat(&payload, metric.Value)
+			payload.WriteByte(0x86) // TUPLE2
+			payload.WriteByte(0x86) // TUPLE2
+		}
+		payload.WriteByte('e') // APPENDS
+	}
+	payload.WriteByte('.') // STOP
+
+	message := make([]byte, 4, 4+payload.Len())
+	binary.BigEndian.PutUint32(message, uint32(payload.Len()))
+	return append(message, payload.Bytes()...)
+}
+
+func writePickleUnicode(buf *bytes.Buffer, value string) {
+	buf.WriteByte('X') // BINUNICODE
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(value)))
+	buf.Write(length[:])
+	buf.WriteString(value)
+}
+
+func writePickleFloat(buf *bytes.Buffer, value float64) {
+	buf.WriteByte('G') // BINFLOAT
+	var bits [8]byte
+	binary.BigEndian.PutUint64(bits[:], math.Float64bits(value))
+	buf.Write(bits[:])
+}
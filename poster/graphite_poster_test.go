@@ -0,0 +1,207 @@
+package poster_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+)
+
+type fakeGraphite struct {
+	listener net.Listener
+	received chan []byte
+
+	lock        sync.Mutex
+	connections int
+	closeAfter  bool
+}
+
+func newFakeGraphite() *fakeGraphite {
+	listener, err := net.Listen("tcp", "localhost:0")
+	Expect(err).ToNot(HaveOccurred())
+
+	g := &fakeGraphite{
+		listener: listener,
+		received: make(chan []byte, 100),
+	}
+	go g.accept()
+	return g
+}
+
+func (g *fakeGraphite) accept() {
+	for {
+		conn, err := g.listener.Accept()
+		if err != nil {
+			return
+		}
+		g.lock.Lock()
+		g.connections++
+		closeAfter := g.closeAfter
+		g.lock.Unlock()
+
+		go func() {
+			defer conn.Close()
+			buf := make([]byte, 64*1024)
+			for {
+				n, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+				g.received <- append([]byte(nil), buf[:n]...)
+				if closeAfter {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (g *fakeGraphite) Connections() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.connections
+}
+
+func (g *fakeGraphite) CloseConnectionsAfterRead() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.closeAfter = true
+}
+
+var _ = Describe("GraphitePoster", func() {
+	var graphite *fakeGraphite
+	var metric poster.Metric
+
+	BeforeEach(func() {
+		graphite = newFakeGraphite()
+		metric = poster.Metric{
+			Metric:    "opentsdb.nozzle.origin.metricName",
+			Value:     5.5,
+			Timestamp: 1000,
+			Tags: poster.Tags{
+				Deployment: "cf",
+				Job:        "doppler",
+				Index:      "0",
+				IP:         "10.10.10.10",
+				Extra:      map[string]string{"app_name": "my.app"},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		graphite.listener.Close()
+	})
+
+	It("folds the tags into the dotted path", func() {
+		p := poster.NewGraphitePoster(graphite.listener.Addr().String(), poster.GraphitePlaintext, poster.GraphitePathTags)
+		defer p.Close()
+
+		Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+		Eventually(graphite.received).Should(Receive(Equal([]byte("cf.doppler.0.opentsdb.nozzle.origin.metricName.my_app 5.5 1000\n"))))
+	})
+
+	It("uses the tagged series syntax", func() {
+		p := poster.NewGraphitePoster(graphite.listener.Addr().String(), poster.GraphitePlaintext, poster.GraphiteTaggedSeries)
+		defer p.Close()
+
+		Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+		Eventually(graphite.received).Should(Receive(Equal([]byte("opentsdb.nozzle.origin.metricName;deployment=cf;job=doppler;index=0;ip=10.10.10.10;app_name=my.app 5.5 1000\n"))))
+	})
+
+	It("converts millisecond timestamps to seconds", func() {
+		p := poster.NewGraphitePoster(graphite.listener.Addr().String(), poster.GraphitePlaintext, poster.GraphitePathTags)
+		p.SetMillisecondTimestamps(true)
+		defer p.Close()
+
+		metric.Timestamp = 1500
+		Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+		Eventually(graphite.received).Should(Receive(Equal([]byte("cf.doppler.0.opentsdb.nozzle.origin.metricName.my_app 5.5 1.500\n"))))
+	})
+
+	It("sends pickled batches with a length header", func() {
+		p := poster.NewGraphitePoster(graphite.listener.Addr().String(), poster.GraphitePickle, poster.GraphitePathTags)
+		defer p.Close()
+
+		Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+
+		var message []byte
+		Eventually(graphite.received).Should(Receive(&message))
+		reader := bufio.NewReader(bytes.NewReader(message))
+		var length uint32
+		Expect(binary.Read(reader, binary.BigEndian, &length)).To(Succeed())
+		payload := make([]byte, length)
+		_, err := io.ReadFull(reader, payload)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reader.Buffered()).To(Equal(0))
+
+		Expect(payload[:3]).To(Equal([]byte{0x80, 2, ']'}))
+		Expect(payload[len(payload)-2:]).To(Equal([]byte("e.")))
+		Expect(string(payload)).To(ContainSubstring("cf.doppler.0.opentsdb.nozzle.origin.metricName.my_app"))
+	})
+
+	It("keeps the connection open between posts", func() {
+		p := poster.NewGraphitePoster(graphite.listener.Addr().String(), poster.GraphitePlaintext, poster.GraphitePathTags)
+		defer p.Close()
+
+		Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+		Eventually(graphite.received).Should(Receive())
+		Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+		Eventually(graphite.received).Should(Receive())
+		Expect(graphite.Connections()).To(Equal(1))
+	})
+
+	It("reconnects when the server closed the connection", func() {
+		graphite.CloseConnectionsAfterRead()
+		p := poster.NewGraphitePoster(graphite.listener.Addr().String(), poster.GraphitePlaintext, poster.GraphitePathTags)
+		defer p.Close()
+
+		Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+		Eventually(graphite.received).Should(Receive())
+
+		Eventually(func() int {
+			p.Post([]poster.Metric{metric})
+			return graphite.Connections()
+		}).Should(BeNumerically(">=", 2))
+	})
+
+	It("gives up on a write after the write timeout", func() {
+		// the listener accepts the connection but never reads from it
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				defer conn.Close()
+				time.Sleep(5 * time.Second)
+			}
+		}()
+
+		p := poster.NewGraphitePoster(listener.Addr().String(), poster.GraphitePlaintext, poster.GraphitePathTags)
+		defer p.Close()
+		p.SetTimeouts(time.Second, 50*time.Millisecond)
+		metrics := make([]poster.Metric, 200000)
+		for i := range metrics {
+			metrics[i] = metric
+		}
+
+		start := time.Now()
+		Expect(p.Post(metrics)).ToNot(Succeed())
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+	})
+
+	It("returns an error when graphite is unreachable", func() {
+		address := graphite.listener.Addr().String()
+		graphite.listener.Close()
+
+		p := poster.NewGraphitePoster(address, poster.GraphitePlaintext, poster.GraphitePathTags)
+		Expect(p.Post([]poster.Metric{metric})).ToNot(Succeed())
+	})
+})
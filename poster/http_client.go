@@ -0,0 +1,111 @@
+package poster
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultConnectTimeout      = 5 * time.Second
+	defaultRequestTimeout      = 30 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultMaxIdleConnsPerHost = 10
+)
+
+// HTTPClientConfig describes how the HTTP posters reach their endpoint.
+// Zero timeouts and MaxIdleConnsPerHost use the defaults.
+type HTTPClientConfig struct {
+	CACertFile         string
+	ClientCertFile     string
+	ClientKeyFile      string
+	InsecureSkipVerify bool
+
+	Username    string
+	Password    string
+	BearerToken string
+	Headers     map[string]string
+
+	ConnectTimeout      time.Duration
+	RequestTimeout      time.Duration
+	IdleConnTimeout     time.Duration
+	MaxIdleConnsPerHost int
+}
+
+// NewHTTPClient returns a client that keeps up to MaxIdleConnsPerHost
+// connections open between posts and adds the configured authentication
+// and headers to every request.
+func NewHTTPClient(config HTTPClientConfig) (*http.Client, error) {
+	tlsConfig, err := NewTLSConfig(config.CACertFile, config.ClientCertFile, config.ClientKeyFile, config.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	connectTimeout := durationOrDefault(config.ConnectTimeout, defaultConnectTimeout)
+	maxIdleConnsPerHost := config.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost <= 0 {
+		maxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+
+	var transport http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: connectTimeout,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		IdleConnTimeout:     durationOrDefault(config.IdleConnTimeout, defaultIdleConnTimeout),
+	}
+
+	if config.Username != "" || config.BearerToken != "" || len(config.Headers) > 0 {
+		transport = &headerTransport{
+			transport:   transport,
+			username:    config.Username,
+			password:    config.Password,
+			bearerToken: config.BearerToken,
+			headers:     config.Headers,
+		}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   durationOrDefault(config.RequestTimeout, defaultRequestTimeout),
+	}, nil
+}
+
+type headerTransport struct {
+	transport   http.RoundTripper
+	username    string
+	password    string
+	bearerToken string
+	headers     map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request it is given
+	authReq := new(http.Request)
+	*authReq = *req
+	authReq.Header = make(http.Header, len(req.Header)+len(t.headers)+1)
+	for key, values := range req.Header {
+		authReq.Header[key] = values
+	}
+
+	for key, value := range t.headers {
+		authReq.Header.Set(key, value)
+	}
+	if t.bearerToken != "" {
+		authReq.Header.Set("Authorization", "Bearer "+t.bearerToken)
+	} else if t.username != "" {
+		authReq.SetBasicAuth(t.username, t.password)
+	}
+	return t.transport.RoundTrip(authReq)
+}
+
+func durationOrDefault(duration time.Duration, defaultDuration time.Duration) time.Duration {
+	if duration > 0 {
+		return duration
+	}
+	return defaultDuration
+}
@@ -0,0 +1,185 @@
+package poster_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/testhelpers"
+)
+
+var _ = Describe("HTTP client", func() {
+	var tmpDir string
+	var certs *testhelpers.Certificates
+	var requests chan *http.Request
+	var handler http.HandlerFunc
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "http-client")
+		Expect(err).NotTo(HaveOccurred())
+		certs, err = testhelpers.GenerateCertificates(tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		requests = make(chan *http.Request, 10)
+		handler = func(rw http.ResponseWriter, r *http.Request) {
+			requests <- r
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	startTLSServer := func(requireClientCert bool) *httptest.Server {
+		tlsConfig, err := certs.ServerTLSConfig(requireClientCert)
+		Expect(err).NotTo(HaveOccurred())
+		server := httptest.NewUnstartedServer(handler)
+		server.TLS = tlsConfig
+		server.StartTLS()
+		return server
+	}
+
+	It("adds basic auth and the static headers to every request", func() {
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		client, err := poster.NewHTTPClient(poster.HTTPClientConfig{
+			Username: "user",
+			Password: "secret",
+			Headers:  map[string]string{"X-Scope-OrgID": "cf"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		p := poster.NewHTTPPoster(server.URL)
+		p.SetHTTPClient(client)
+		Expect(p.Post([]poster.Metric{})).To(Succeed())
+
+		var request *http.Request
+		Eventually(requests).Should(Receive(&request))
+		username, password, ok := request.BasicAuth()
+		Expect(ok).To(BeTrue())
+		Expect(username).To(Equal("user"))
+		Expect(password).To(Equal("secret"))
+		Expect(request.Header.Get("X-Scope-OrgID")).To(Equal("cf"))
+		Expect(request.Header.Get("Content-Encoding")).To(Equal("gzip"))
+	})
+
+	It("prefers the bearer token over basic auth", func() {
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		client, err := poster.NewHTTPClient(poster.HTTPClientConfig{Username: "user", BearerToken: "token"})
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := client.Get(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+
+		var request *http.Request
+		Eventually(requests).Should(Receive(&request))
+		Expect(request.Header.Get("Authorization")).To(Equal("Bearer token"))
+	})
+
+	It("trusts the configured CA", func() {
+		server := startTLSServer(false)
+		defer server.Close()
+
+		client, err := poster.NewHTTPClient(poster.HTTPClientConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.Get(server.URL)
+		Expect(err).To(HaveOccurred())
+
+		client, err = poster.NewHTTPClient(poster.HTTPClientConfig{CACertFile: certs.CACertFile})
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := client.Get(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+	})
+
+	It("skips the verification when asked to", func() {
+		server := startTLSServer(false)
+		defer server.Close()
+
+		client, err := poster.NewHTTPClient(poster.HTTPClientConfig{InsecureSkipVerify: true})
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := client.Get(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+	})
+
+	It("presents the client certificate", func() {
+		server := startTLSServer(true)
+		defer server.Close()
+
+		client, err := poster.NewHTTPClient(poster.HTTPClientConfig{CACertFile: certs.CACertFile})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.Get(server.URL)
+		Expect(err).To(HaveOccurred())
+
+		client, err = poster.NewHTTPClient(poster.HTTPClientConfig{
+			CACertFile:     certs.CACertFile,
+			ClientCertFile: certs.ClientCertFile,
+			ClientKeyFile:  certs.ClientKeyFile,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := client.Get(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+
+		var request *http.Request
+		Eventually(requests).Should(Receive(&request))
+		Expect(request.TLS.PeerCertificates[0].Subject.CommonName).To(Equal("nozzle"))
+	})
+
+	It("reuses connections between requests", func() {
+		server := httptest.NewUnstartedServer(handler)
+		var newConns int32
+		server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&newConns, 1)
+			}
+		}
+		server.Start()
+		defer server.Close()
+
+		client, err := poster.NewHTTPClient(poster.HTTPClientConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		p := poster.NewHTTPPoster(server.URL)
+		p.SetHTTPClient(client)
+		for i := 0; i < 3; i++ {
+			Expect(p.Post([]poster.Metric{})).To(Succeed())
+		}
+		Expect(atomic.LoadInt32(&newConns)).To(BeEquivalentTo(1))
+	})
+
+	It("times out slow requests", func() {
+		handler = func(rw http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+		}
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		client, err := poster.NewHTTPClient(poster.HTTPClientConfig{RequestTimeout: 50 * time.Millisecond})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.Get(server.URL)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("returns an error for unusable certificate files", func() {
+		_, err := poster.NewHTTPClient(poster.HTTPClientConfig{CACertFile: filepath.Join(tmpDir, "missing.crt")})
+		Expect(err).To(HaveOccurred())
+
+		_, err = poster.NewHTTPClient(poster.HTTPClientConfig{CACertFile: certs.ServerKeyFile})
+		Expect(err).To(MatchError("No PEM encoded certificates found in " + certs.ServerKeyFile))
+
+		_, err = poster.NewHTTPClient(poster.HTTPClientConfig{ClientCertFile: certs.ClientCertFile})
+		Expect(err).To(MatchError("Both a client certificate and a client key are required for mutual TLS"))
+	})
+})
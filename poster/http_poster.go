@@ -1,57 +1,106 @@
 package poster
 
 import (
-	"bytes"
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
 )
 
 type HTTPPoster struct {
-	tsdbHost string
+	// updated atomically, and first in the struct for 64-bit alignment
+	uncompressedBytesSent uint64
+	compressedBytesSent   uint64
+
+	tsdbHost   string
+	client     *http.Client
+	compressor *compressor
 }
 
 func NewHTTPPoster(tsdbHost string) *HTTPPoster {
+	client, _ := NewHTTPClient(HTTPClientConfig{})
+	compressor, _ := newCompressor(GzipCompression, 0)
 	return &HTTPPoster{
-		tsdbHost: tsdbHost,
+		tsdbHost:   tsdbHost,
+		client:     client,
+		compressor: compressor,
 	}
 }
 
+func (p *HTTPPoster) SetHTTPClient(client *http.Client) {
+	p.client = client
+}
+
+// SetCompression selects how request bodies are compressed, with level
+// between 1 and 9, or 0 for the default level.
+func (p *HTTPPoster) SetCompression(compression Compression, level int) error {
+	compressor, err := newCompressor(compression, level)
+	if err != nil {
+		return err
+	}
+	p.compressor = compressor
+	return nil
+}
+
+// BytesSent returns the size of the request bodies sent so far, before and
+// after compression.
+func (p *HTTPPoster) BytesSent() (uncompressed uint64, compressed uint64) {
+	return atomic.LoadUint64(&p.uncompressedBytesSent), atomic.LoadUint64(&p.compressedBytesSent)
+}
+
 func (p *HTTPPoster) Post(metrics []Metric) error {
-	numMetrics := len(metrics)
-	log.Printf("Posting %d metrics", numMetrics)
+	start := time.Now()
 	url := p.tsdbURL()
 
 	seriesBytes := p.formatMetrics(metrics)
-	var buf bytes.Buffer
-	g := gzip.NewWriter(&buf)
-	if _, err := g.Write(seriesBytes); err != nil {
-		log.Printf("Fail to gzip metrics: %v", err)
+	buf, err := p.compressor.compress(seriesBytes)
+	if err != nil {
+		logger.Error("Could not compress metrics", logger.Fields{"batch_size": len(metrics), "endpoint": p.tsdbHost, "error": err})
 		return err
-	} else {
-		g.Close()
 	}
+	compressedSize := uint64(buf.Len())
+	body := newPooledRequestBody(buf)
+	defer body.release()
 
-	req, err := http.NewRequest("POST", url, &buf)
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return err
+	}
+	body.attach(req)
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Encoding", "gzip")
-	resp, err := http.DefaultClient.Do(req)
+	if encoding := p.compressor.contentEncoding(); encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	resp, err := p.client.Do(req)
 	if err != nil {
 		return err
 	}
+	atomic.AddUint64(&p.uncompressedBytesSent, uint64(len(seriesBytes)))
+	atomic.AddUint64(&p.compressedBytesSent, compressedSize)
 
 	defer resp.Body.Close()
+	// drain the body so that the connection can be reused
+	defer io.Copy(ioutil.Discard, resp.Body)
 	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
 		contents, err := ioutil.ReadAll(resp.Body)
+		fields := logger.Fields{"batch_size": len(metrics), "endpoint": p.tsdbHost, "status": resp.StatusCode, "body": string(contents)}
 		if err != nil {
-			log.Printf("%s", err)
+			fields["error"] = err
 		}
-		log.Printf("Response body is: %s", string(contents))
-		return fmt.Errorf("opentsdb request returned HTTP response: %v", resp.StatusCode)
+		logger.Warn("OpenTSDB rejected the metrics", fields)
+		return &StatusError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("opentsdb request returned HTTP response: %v", resp.StatusCode)}
 	}
+	logger.InfoLimited("Posted metrics", logger.Fields{
+		"batch_size": len(metrics),
+		"endpoint":   p.tsdbHost,
+		"bytes":      compressedSize,
+		"duration":   time.Since(start),
+	})
 	return nil
 }
 
@@ -3,11 +3,13 @@ package poster_test
 import (
 	"bytes"
 	"compress/gzip"
+	"compress/zlib"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/util"
 
 	"encoding/json"
 
@@ -99,11 +101,42 @@ var _ = Describe("OpentsdbClient", func() {
 			}))
 	})
 
+	It("flattens extra tags into the tags object", func() {
+		metric := poster.Metric{
+			Metric:    "app.cpuPercentage",
+			Value:     5,
+			Timestamp: 1,
+			Tags: poster.Tags{
+				Deployment: "deployment-name",
+				Job:        "diego_cell",
+				Index:      "SOME-GUID",
+				Extra: map[string]string{
+					"app_name": "my-app",
+					"app_id":   "app-guid",
+				},
+			},
+		}
+
+		err := p.Post([]poster.Metric{metric})
+		Expect(err).ToNot(HaveOccurred())
+
+		var receivedBytes []byte
+		Eventually(bodyChan).Should(Receive(&receivedBytes))
+		uncompressedData := util.UnzipIgnoreError(receivedBytes)
+		Expect(string(uncompressedData)).To(ContainSubstring(`"tags":{"deployment":"deployment-name","job":"diego_cell","index":"SOME-GUID","ip":"","app_id":"app-guid","app_name":"my-app"}`))
+
+		var metrics []poster.Metric
+		err = json.Unmarshal(uncompressedData, &metrics)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(metrics).To(Equal([]poster.Metric{metric}))
+	})
+
 	It("returns an error when opentsdb responds with a non 200 response code", func() {
 		responseCode = http.StatusBadRequest // 400
 		err := p.Post([]poster.Metric{})
 		Expect(err).To(HaveOccurred())
 		Expect(err.Error()).To(ContainSubstring("opentsdb request returned HTTP response: 400"))
+		Expect(poster.FailureReason(err)).To(Equal("http_4xx"))
 		<-bodyChan
 
 		responseCode = http.StatusSwitchingProtocols // 101
@@ -117,6 +150,71 @@ var _ = Describe("OpentsdbClient", func() {
 		Expect(err).ToNot(HaveOccurred())
 	})
 
+	Context("compression", func() {
+		var encodings chan string
+		var bodies chan []byte
+		var server *httptest.Server
+
+		metrics := []poster.Metric{{Metric: "origin.metricName", Value: 5, Timestamp: 1, Tags: poster.Tags{Index: "SOME-GUID"}}}
+		expectedBody, _ := json.Marshal(metrics)
+
+		BeforeEach(func() {
+			encodings = make(chan string, 1)
+			bodies = make(chan []byte, 1)
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				encodings <- r.Header.Get("Content-Encoding")
+				bodies <- body
+			}))
+			p = poster.NewHTTPPoster(server.URL)
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("gzips by default and counts the bytes sent", func() {
+			Expect(p.Post(metrics)).To(Succeed())
+			Expect(<-encodings).To(Equal("gzip"))
+			body := <-bodies
+			Expect(util.UnzipIgnoreError(body)).To(Equal(expectedBody))
+
+			uncompressed, compressed := p.BytesSent()
+			Expect(uncompressed).To(BeEquivalentTo(len(expectedBody)))
+			Expect(compressed).To(BeEquivalentTo(len(body)))
+		})
+
+		It("deflates with the zlib format", func() {
+			Expect(p.SetCompression(poster.DeflateCompression, 9)).To(Succeed())
+			Expect(p.Post(metrics)).To(Succeed())
+			Expect(<-encodings).To(Equal("deflate"))
+
+			reader, err := zlib.NewReader(bytes.NewReader(<-bodies))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.ReadAll(reader)).To(Equal(expectedBody))
+		})
+
+		It("sends uncompressed bodies", func() {
+			Expect(p.SetCompression(poster.NoCompression, 0)).To(Succeed())
+			for i := 0; i < 2; i++ {
+				Expect(p.Post(metrics)).To(Succeed())
+				Expect(<-encodings).To(BeEmpty())
+				Expect(<-bodies).To(Equal(expectedBody))
+			}
+
+			uncompressed, compressed := p.BytesSent()
+			Expect(uncompressed).To(BeEquivalentTo(2 * len(expectedBody)))
+			Expect(compressed).To(Equal(uncompressed))
+		})
+
+		It("rejects invalid levels and compressions", func() {
+			Expect(p.SetCompression(poster.GzipCompression, 10)).To(MatchError("invalid compression level 10, expected 1 to 9"))
+			_, err := poster.ParseCompression("brotli")
+			Expect(err).To(MatchError(`unknown compression "brotli", expected none, gzip or deflate`))
+			Expect(poster.ParseCompression("")).To(Equal(poster.GzipCompression))
+		})
+	})
+
 	It("shows a proper error message when the server does not respond", func() {
 		address := ts.Listener.Addr().String()
 		ts.Close()
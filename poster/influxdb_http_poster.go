@@ -0,0 +1,148 @@
+package poster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
+)
+
+// InfluxDB recommends batches of about 5000 points.
+const influxDBBatchSize = 5000
+
+type InfluxDBHTTPPoster struct {
+	influxURL             string
+	client                *http.Client
+	database              string
+	retentionPolicy       string
+	organization          string
+	bucket                string
+	token                 string
+	millisecondTimestamps bool
+}
+
+// NewInfluxDBHTTPPoster writes to the /write endpoint of InfluxDB 1.x. With
+// InfluxDB 2 the same endpoint is served by the 1.x compatibility API, which
+// maps database and retention policy to a bucket; use SetBucket to write to
+// the native API instead.
+func NewInfluxDBHTTPPoster(influxURL string, database string, retentionPolicy string) *InfluxDBHTTPPoster {
+	client, _ := NewHTTPClient(HTTPClientConfig{})
+	return &InfluxDBHTTPPoster{
+		influxURL:       strings.TrimRight(influxURL, "/"),
+		client:          client,
+		database:        database,
+		retentionPolicy: retentionPolicy,
+	}
+}
+
+func (p *InfluxDBHTTPPoster) SetHTTPClient(client *http.Client) {
+	p.client = client
+}
+
+// SetBucket writes to the /api/v2/write endpoint of InfluxDB 2, into the
+// bucket of the organization, instead of the database.
+func (p *InfluxDBHTTPPoster) SetBucket(organization string, bucket string) {
+	p.organization = organization
+	p.bucket = bucket
+}
+
+// SetToken sends an InfluxDB 2 API token, which the 1.x compatibility API
+// accepts as well.
+func (p *InfluxDBHTTPPoster) SetToken(token string) {
+	p.token = token
+}
+
+func (p *InfluxDBHTTPPoster) SetMillisecondTimestamps(millisecondTimestamps bool) {
+	p.millisecondTimestamps = millisecondTimestamps
+}
+
+// Post writes the metrics in batches. A failing batch does not stop the
+// remaining ones; the returned error lists every batch that failed.
+func (p *InfluxDBHTTPPoster) Post(metrics []Metric) error {
+	numBatches := (len(metrics) + influxDBBatchSize - 1) / influxDBBatchSize
+	logger.InfoLimited("Posting metrics to InfluxDB", logger.Fields{"batch_size": len(metrics), "batches": numBatches, "endpoint": p.influxURL})
+
+	var failures []string
+	for batch := 0; batch < numBatches; batch++ {
+		start := batch * influxDBBatchSize
+		end := start + influxDBBatchSize
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		if err := p.postBatch(metrics[start:end]); err != nil {
+			failures = append(failures, fmt.Sprintf("batch %d of %d: %s", batch+1, numBatches, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("influxdb write failed for %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (p *InfluxDBHTTPPoster) postBatch(metrics []Metric) error {
+	var body bytes.Buffer
+	for _, metric := range metrics {
+		formatInfluxLine(&body, metric)
+	}
+	if body.Len() == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequest("POST", p.writeURL(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Token "+p.token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	contents, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		// InfluxDB 1.x reports errors as {"error": ...}, InfluxDB 2 as {"message": ...}
+		var influxError struct {
+			Error   string `json:"error"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(contents, &influxError) == nil {
+			message := influxError.Error
+			if message == "" {
+				message = influxError.Message
+			}
+			if message != "" {
+				return &StatusError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("HTTP response %v: %s", resp.StatusCode, message)}
+			}
+		}
+		return &StatusError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("HTTP response %v", resp.StatusCode)}
+	}
+	return nil
+}
+
+func (p *InfluxDBHTTPPoster) writeURL() string {
+	query := url.Values{}
+	if p.bucket != "" {
+		query.Set("org", p.organization)
+		query.Set("bucket", p.bucket)
+		query.Set("precision", influxPrecision(p.millisecondTimestamps))
+		return fmt.Sprintf("%s/api/v2/write?%s", p.influxURL, query.Encode())
+	}
+
+	query.Set("db", p.database)
+	if p.retentionPolicy != "" {
+		query.Set("rp", p.retentionPolicy)
+	}
+	query.Set("precision", influxPrecision(p.millisecondTimestamps))
+	return fmt.Sprintf("%s/write?%s", p.influxURL, query.Encode())
+}
@@ -0,0 +1,69 @@
+package poster
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagEscaper         = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// formatInfluxLine appends the metric as an InfluxDB line protocol point
+// with a single "value" field. InfluxDB can not store NaN or infinite
+// values, so those metrics are skipped.
+func formatInfluxLine(buf *bytes.Buffer, metric Metric) bool {
+	if math.IsNaN(metric.Value) || math.IsInf(metric.Value, 0) {
+		logger.Debug("Skipping a metric whose value InfluxDB can not store", logger.Fields{"metric": metric.Metric, "value": strconv.FormatFloat(metric.Value, 'g', -1, 64)})
+		return false
+	}
+
+	buf.WriteString(influxMeasurementEscaper.Replace(metric.Metric))
+
+	tags := map[string]string{
+		"deployment": metric.Tags.Deployment,
+		"job":        metric.Tags.Job,
+		"index":      metric.Tags.Index,
+		"ip":         metric.Tags.IP,
+	}
+	for key, value := range metric.Tags.Extra {
+		if _, builtin := tags[key]; !builtin {
+			tags[key] = value
+		}
+	}
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// empty tag values are invalid in line protocol
+		if tags[key] == "" {
+			continue
+		}
+		buf.WriteByte(',')
+		buf.WriteString(influxTagEscaper.Replace(key))
+		buf.WriteByte('=')
+		buf.WriteString(influxTagEscaper.Replace(tags[key]))
+	}
+
+	buf.WriteString(" value=")
+	buf.WriteString(strconv.FormatFloat(metric.Value, 'g', -1, 64))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(metric.Timestamp, 10))
+	buf.WriteByte('\n')
+	return true
+}
+
+func influxPrecision(millisecondTimestamps bool) string {
+	if millisecondTimestamps {
+		return "ms"
+	}
+	return "s"
+}
@@ -0,0 +1,201 @@
+package poster_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+)
+
+var _ = Describe("InfluxDB posters", func() {
+	var metric poster.Metric
+
+	BeforeEach(func() {
+		metric = poster.Metric{
+			Metric:    "origin.metric name,1",
+			Value:     5.5,
+			Timestamp: 1000,
+			Tags: poster.Tags{
+				Deployment: "cf",
+				Job:        "doppler",
+				Index:      "0",
+				Extra:      map[string]string{"app name": "a=b,c"},
+			},
+		}
+	})
+
+	Describe("InfluxDBHTTPPoster", func() {
+		var server *httptest.Server
+		var lock sync.Mutex
+		var queries []url.Values
+		var headers []http.Header
+		var bodies []string
+		var failBatch int
+
+		BeforeEach(func() {
+			queries = nil
+			headers = nil
+			bodies = nil
+			failBatch = 0
+			server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				defer r.Body.Close()
+				body, _ := ioutil.ReadAll(r.Body)
+
+				lock.Lock()
+				defer lock.Unlock()
+				queries = append(queries, r.URL.Query())
+				headers = append(headers, r.Header)
+				bodies = append(bodies, string(body))
+				if r.URL.Path == "/api/v2/write" && r.URL.Query().Get("org") != "my-org" {
+					rw.WriteHeader(http.StatusNotFound)
+					rw.Write([]byte(`{"code":"not found","message":"organization not found"}`))
+					return
+				}
+				if (r.URL.Path != "/write" && r.URL.Path != "/api/v2/write") || len(bodies) == failBatch {
+					rw.WriteHeader(http.StatusBadRequest)
+					rw.Write([]byte(`{"error":"partial write: field type conflict"}`))
+					return
+				}
+				rw.WriteHeader(http.StatusNoContent)
+			}))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("writes escaped line protocol to /write", func() {
+			p := poster.NewInfluxDBHTTPPoster(server.URL+"/", "firehose", "two_weeks")
+			Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+
+			Expect(bodies).To(Equal([]string{
+				`origin.metric\ name\,1,app\ name=a\=b\,c,deployment=cf,index=0,job=doppler value=5.5 1000` + "\n",
+			}))
+			Expect(queries[0].Get("db")).To(Equal("firehose"))
+			Expect(queries[0].Get("rp")).To(Equal("two_weeks"))
+			Expect(queries[0].Get("precision")).To(Equal("s"))
+		})
+
+		It("sets the precision for millisecond timestamps", func() {
+			p := poster.NewInfluxDBHTTPPoster(server.URL, "firehose", "")
+			p.SetMillisecondTimestamps(true)
+			Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+
+			Expect(queries[0].Get("precision")).To(Equal("ms"))
+			Expect(queries[0]).ToNot(HaveKey("rp"))
+		})
+
+		It("writes to the bucket of an InfluxDB 2 organization with a token", func() {
+			p := poster.NewInfluxDBHTTPPoster(server.URL, "", "")
+			p.SetBucket("my-org", "firehose")
+			p.SetToken("influx-token")
+			Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+
+			Expect(queries[0].Get("org")).To(Equal("my-org"))
+			Expect(queries[0].Get("bucket")).To(Equal("firehose"))
+			Expect(queries[0].Get("precision")).To(Equal("s"))
+			Expect(queries[0]).ToNot(HaveKey("db"))
+			Expect(headers[0].Get("Authorization")).To(Equal("Token influx-token"))
+		})
+
+		It("reports InfluxDB 2 error messages", func() {
+			p := poster.NewInfluxDBHTTPPoster(server.URL, "", "")
+			p.SetBucket("other-org", "firehose")
+			Expect(p.Post([]poster.Metric{metric})).To(MatchError("influxdb write failed for batch 1 of 1: HTTP response 404: organization not found"))
+		})
+
+		It("posts with the configured HTTP client", func() {
+			client, err := poster.NewHTTPClient(poster.HTTPClientConfig{Headers: map[string]string{"X-Scope": "nozzle"}})
+			Expect(err).ToNot(HaveOccurred())
+			p := poster.NewInfluxDBHTTPPoster(server.URL, "firehose", "")
+			p.SetHTTPClient(client)
+			Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+
+			Expect(headers[0].Get("X-Scope")).To(Equal("nozzle"))
+		})
+
+		It("skips values InfluxDB can not store", func() {
+			p := poster.NewInfluxDBHTTPPoster(server.URL, "firehose", "")
+			metric.Value = math.NaN()
+			Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+			Expect(bodies).To(BeEmpty())
+		})
+
+		It("reports the InfluxDB error of each failed batch and writes the others", func() {
+			failBatch = 2
+			metrics := make([]poster.Metric, 12000)
+			for i := range metrics {
+				metrics[i] = metric
+			}
+
+			p := poster.NewInfluxDBHTTPPoster(server.URL, "firehose", "")
+			err := p.Post(metrics)
+			Expect(err).To(MatchError("influxdb write failed for batch 2 of 3: HTTP response 400: partial write: field type conflict"))
+			Expect(bodies).To(HaveLen(3))
+			Expect(strings.Count(bodies[2], "\n")).To(Equal(2000))
+		})
+
+		It("returns an error when InfluxDB is unreachable", func() {
+			server.Close()
+			p := poster.NewInfluxDBHTTPPoster(server.URL, "firehose", "")
+			Expect(p.Post([]poster.Metric{metric})).ToNot(Succeed())
+		})
+	})
+
+	Describe("InfluxDBUDPPoster", func() {
+		var conn net.PacketConn
+
+		BeforeEach(func() {
+			var err error
+			conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			conn.Close()
+		})
+
+		readDatagram := func() string {
+			buf := make([]byte, 65536)
+			n, _, err := conn.ReadFrom(buf)
+			Expect(err).ToNot(HaveOccurred())
+			return string(buf[:n])
+		}
+
+		It("sends line protocol datagrams", func() {
+			p := poster.NewInfluxDBUDPPoster(conn.LocalAddr().String())
+			Expect(p.Post([]poster.Metric{metric, metric})).To(Succeed())
+
+			line := `origin.metric\ name\,1,app\ name=a\=b\,c,deployment=cf,index=0,job=doppler value=5.5 1000` + "\n"
+			Expect(readDatagram()).To(Equal(line + line))
+		})
+
+		It("splits large batches over several datagrams", func() {
+			metrics := make([]poster.Metric, 50)
+			for i := range metrics {
+				metrics[i] = metric
+				metrics[i].Metric = fmt.Sprintf("metric%d", i)
+			}
+
+			p := poster.NewInfluxDBUDPPoster(conn.LocalAddr().String())
+			Expect(p.Post(metrics)).To(Succeed())
+
+			received := 0
+			for received < len(metrics) {
+				datagram := readDatagram()
+				Expect(len(datagram)).To(BeNumerically("<=", 1400))
+				received += strings.Count(datagram, "\n")
+			}
+			Expect(received).To(Equal(len(metrics)))
+		})
+	})
+})
@@ -0,0 +1,66 @@
+package poster
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Points are packed into datagrams of at most this size so that they are
+// not fragmented on common networks; larger points are sent on their own.
+const influxDBMaxDatagramSize = 1400
+
+// InfluxDBUDPPoster sends line protocol to the InfluxDB UDP listener. The
+// listener has a fixed precision (seconds unless configured otherwise) and
+// database, and gives no feedback about rejected points.
+type InfluxDBUDPPoster struct {
+	address string
+}
+
+func NewInfluxDBUDPPoster(address string) *InfluxDBUDPPoster {
+	return &InfluxDBUDPPoster{
+		address: address,
+	}
+}
+
+func (p *InfluxDBUDPPoster) Post(metrics []Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	conn, err := net.Dial("udp", p.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var failures []string
+	var datagram, line bytes.Buffer
+	send := func() {
+		if datagram.Len() == 0 {
+			return
+		}
+		if _, err := conn.Write(datagram.Bytes()); err != nil {
+			failures = append(failures, err.Error())
+		}
+		datagram.Reset()
+	}
+
+	for _, metric := range metrics {
+		line.Reset()
+		if !formatInfluxLine(&line, metric) {
+			continue
+		}
+		if datagram.Len()+line.Len() > influxDBMaxDatagramSize {
+			send()
+		}
+		datagram.Write(line.Bytes())
+	}
+	send()
+
+	if len(failures) > 0 {
+		return fmt.Errorf("influxdb udp write failed for %d datagrams: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
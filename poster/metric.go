@@ -1,10 +1,17 @@
 package poster
 
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
 type Tags struct {
-	Deployment string `json:"deployment"`
-	Job        string `json:"job"`
-	Index      string `json:"index"`
-	IP         string `json:"ip"`
+	Deployment string            `json:"deployment"`
+	Job        string            `json:"job"`
+	Index      string            `json:"index"`
+	IP         string            `json:"ip"`
+	Extra      map[string]string `json:"-"`
 }
 
 type Metric struct {
@@ -13,3 +20,80 @@ type Metric struct {
 	Timestamp int64   `json:"timestamp"`
 	Tags      Tags    `json:"tags"`
 }
+
+func (t Tags) ExtraKeys() []string {
+	keys := make([]string, 0, len(t.Extra))
+	for key := range t.Extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WithExtra returns a copy of the tags with the extra tag set, leaving the
+// receiver's map untouched since metrics of one envelope share it.
+func (t Tags) WithExtra(key string, value string) Tags {
+	extra := make(map[string]string, len(t.Extra)+1)
+	for k, v := range t.Extra {
+		extra[k] = v
+	}
+	extra[key] = value
+	t.Extra = extra
+	return t
+}
+
+func (t Tags) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	writeJSONTag(&buf, "deployment", t.Deployment, true)
+	writeJSONTag(&buf, "job", t.Job, false)
+	writeJSONTag(&buf, "index", t.Index, false)
+	writeJSONTag(&buf, "ip", t.IP, false)
+	for _, key := range t.ExtraKeys() {
+		switch key {
+		case "deployment", "job", "index", "ip":
+			continue
+		}
+		writeJSONTag(&buf, key, t.Extra[key], false)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (t *Tags) UnmarshalJSON(data []byte) error {
+	var tags map[string]string
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return err
+	}
+
+	*t = Tags{}
+	for key, value := range tags {
+		switch key {
+		case "deployment":
+			t.Deployment = value
+		case "job":
+			t.Job = value
+		case "index":
+			t.Index = value
+		case "ip":
+			t.IP = value
+		default:
+			if t.Extra == nil {
+				t.Extra = make(map[string]string)
+			}
+			t.Extra[key] = value
+		}
+	}
+	return nil
+}
+
+func writeJSONTag(buf *bytes.Buffer, key string, value string, first bool) {
+	if !first {
+		buf.WriteByte(',')
+	}
+	encodedKey, _ := json.Marshal(key)
+	encodedValue, _ := json.Marshal(value)
+	buf.Write(encodedKey)
+	buf.WriteByte(':')
+	buf.Write(encodedValue)
+}
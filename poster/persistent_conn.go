@@ -0,0 +1,81 @@
+package poster
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
+)
+
+const defaultWriteTimeout = 10 * time.Second
+
+// persistentConn keeps a TCP connection open across posts. A failed write
+// closes the connection and is retried once on a fresh one, since the
+// server may have dropped the idle connection in the meantime.
+type persistentConn struct {
+	address        string
+	connectTimeout time.Duration
+	writeTimeout   time.Duration
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func newPersistentConn(address string) *persistentConn {
+	return &persistentConn{
+		address:        address,
+		connectTimeout: defaultConnectTimeout,
+		writeTimeout:   defaultWriteTimeout,
+	}
+}
+
+func (c *persistentConn) setTimeouts(connectTimeout time.Duration, writeTimeout time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.connectTimeout = durationOrDefault(connectTimeout, defaultConnectTimeout)
+	c.writeTimeout = durationOrDefault(writeTimeout, defaultWriteTimeout)
+}
+
+func (c *persistentConn) write(data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	reused := c.conn != nil
+	err := c.writeOnce(data)
+	if err != nil && reused {
+		logger.Warn("Reconnecting after a write error", logger.Fields{"endpoint": c.address, "error": err})
+		err = c.writeOnce(data)
+	}
+	return err
+}
+
+func (c *persistentConn) writeOnce(data []byte) error {
+	if c.conn == nil {
+		dialer := &net.Dialer{Timeout: c.connectTimeout}
+		conn, err := dialer.Dial("tcp", c.address)
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	if _, err := c.conn.Write(data); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (c *persistentConn) close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
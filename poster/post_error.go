@@ -0,0 +1,34 @@
+package poster
+
+import (
+	"fmt"
+	"net"
+)
+
+// StatusError is returned by the HTTP posters when the backend answers
+// with a status other than 2xx.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+// FailureReason classifies a post error for the self-metrics as http_4xx,
+// http_5xx, timeout, connection or other.
+func FailureReason(err error) string {
+	switch e := err.(type) {
+	case recoverableError:
+		return FailureReason(e.error)
+	case *StatusError:
+		return fmt.Sprintf("http_%dxx", e.StatusCode/100)
+	case net.Error:
+		if e.Timeout() {
+			return "timeout"
+		}
+		return "connection"
+	}
+	return "other"
+}
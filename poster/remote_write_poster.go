@@ -0,0 +1,306 @@
+package poster
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
+)
+
+const remoteWriteMaxSamplesPerSend = 2000
+
+const (
+	DefaultRemoteWriteMaxRetries = 3
+	DefaultRemoteWriteMinBackoff = 100 * time.Millisecond
+	DefaultRemoteWriteMaxBackoff = 5 * time.Second
+)
+
+type RemoteWritePoster struct {
+	writeURL              string
+	client                *http.Client
+	millisecondTimestamps bool
+
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+func NewRemoteWritePoster(writeURL string) *RemoteWritePoster {
+	client, _ := NewHTTPClient(HTTPClientConfig{})
+	return &RemoteWritePoster{
+		writeURL:   writeURL,
+		client:     client,
+		maxRetries: DefaultRemoteWriteMaxRetries,
+		minBackoff: DefaultRemoteWriteMinBackoff,
+		maxBackoff: DefaultRemoteWriteMaxBackoff,
+	}
+}
+
+func (p *RemoteWritePoster) SetHTTPClient(client *http.Client) {
+	p.client = client
+}
+
+func (p *RemoteWritePoster) SetMillisecondTimestamps(millisecondTimestamps bool) {
+	p.millisecondTimestamps = millisecondTimestamps
+}
+
+// SetRetryPolicy configures how often a batch that failed with a 429, a
+// 5xx or a connection error is retried, with exponential backoff between
+// minBackoff and maxBackoff. A Retry-After header lengthens the wait up
+// to maxBackoff.
+func (p *RemoteWritePoster) SetRetryPolicy(maxRetries int, minBackoff time.Duration, maxBackoff time.Duration) {
+	p.maxRetries = maxRetries
+	p.minBackoff = minBackoff
+	p.maxBackoff = maxBackoff
+}
+
+func (p *RemoteWritePoster) Post(metrics []Metric) error {
+	series := p.toTimeSeries(metrics)
+	logger.InfoLimited("Posting metrics to the remote write endpoint", logger.Fields{"batch_size": len(metrics), "series": len(series), "endpoint": p.writeURL})
+
+	var failures []string
+	var batch []TimeSeries
+	samples := 0
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := p.send(&WriteRequest{Timeseries: batch}); err != nil {
+			failures = append(failures, err.Error())
+		}
+		batch = nil
+		samples = 0
+	}
+	for _, ts := range series {
+		for len(ts.Samples) > 0 {
+			chunk := remoteWriteMaxSamplesPerSend - samples
+			if chunk > len(ts.Samples) {
+				chunk = len(ts.Samples)
+			}
+			batch = append(batch, TimeSeries{Labels: ts.Labels, Samples: ts.Samples[:chunk]})
+			samples += chunk
+			ts.Samples = ts.Samples[chunk:]
+			if samples == remoteWriteMaxSamplesPerSend {
+				send()
+			}
+		}
+	}
+	send()
+
+	if len(failures) > 0 {
+		return fmt.Errorf("remote write failed for %d of the batches: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Check sends an empty write request, which receivers accept without
+// storing anything, to check the URL, the TLS settings and the credentials.
+// It does not retry.
+func (p *RemoteWritePoster) Check() error {
+	data, err := proto.Marshal(&WriteRequest{})
+	if err != nil {
+		return err
+	}
+	err = p.sendOnce(snappy.Encode(nil, data))
+	if recoverable, ok := err.(recoverableError); ok {
+		return recoverable.error
+	}
+	return err
+}
+
+type recoverableError struct {
+	error
+	retryAfter time.Duration
+}
+
+func (p *RemoteWritePoster) send(request *WriteRequest) error {
+	data, err := proto.Marshal(request)
+	if err != nil {
+		return err
+	}
+	compressed := snappy.Encode(nil, data)
+
+	backoff := p.minBackoff
+	for attempt := 0; ; attempt++ {
+		err := p.sendOnce(compressed)
+		recoverable, ok := err.(recoverableError)
+		if !ok || attempt >= p.maxRetries {
+			return err
+		}
+
+		sleep := backoff
+		if recoverable.retryAfter > sleep {
+			sleep = recoverable.retryAfter
+		}
+		if sleep > p.maxBackoff {
+			sleep = p.maxBackoff
+		}
+		logger.Warn("Retrying remote write", logger.Fields{"endpoint": p.writeURL, "retry_in": sleep, "error": err})
+		time.Sleep(sleep)
+
+		backoff *= 2
+		if backoff > p.maxBackoff {
+			backoff = p.maxBackoff
+		}
+	}
+}
+
+func (p *RemoteWritePoster) sendOnce(compressed []byte) error {
+	req, err := http.NewRequest("POST", p.writeURL, bytes.NewReader(compressed))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return recoverableError{error: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	contents, _ := ioutil.ReadAll(resp.Body)
+	err = &StatusError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("remote write returned HTTP response: %v: %s", resp.StatusCode, strings.TrimSpace(string(contents)))}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5 {
+		return recoverableError{error: err, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return err
+}
+
+func parseRetryAfter(retryAfter string) time.Duration {
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		return date.Sub(time.Now())
+	}
+	return 0
+}
+
+// toTimeSeries groups the metrics by label set, with the samples of each
+// series in timestamp order as remote write receivers require.
+func (p *RemoteWritePoster) toTimeSeries(metrics []Metric) []TimeSeries {
+	var series []TimeSeries
+	seriesByKey := make(map[string]int)
+	for _, metric := range metrics {
+		labels := remoteWriteLabels(metric)
+		key := labelsKey(labels)
+		i, ok := seriesByKey[key]
+		if !ok {
+			i = len(series)
+			seriesByKey[key] = i
+			series = append(series, TimeSeries{Labels: labels})
+		}
+
+		timestamp := metric.Timestamp
+		if !p.millisecondTimestamps {
+			timestamp *= 1000
+		}
+		series[i].Samples = append(series[i].Samples, Sample{Value: metric.Value, Timestamp: timestamp})
+	}
+
+	for _, ts := range series {
+		sort.Stable(samplesByTimestamp(ts.Samples))
+	}
+	return series
+}
+
+func remoteWriteLabels(metric Metric) []Label {
+	labels := map[string]string{
+		"deployment": metric.Tags.Deployment,
+		"job":        metric.Tags.Job,
+		"index":      metric.Tags.Index,
+		"ip":         metric.Tags.IP,
+	}
+	for key, value := range metric.Tags.Extra {
+		name := sanitizeLabelName(key)
+		if _, taken := labels[name]; !taken {
+			labels[name] = value
+		}
+	}
+	labels["__name__"] = sanitizeMetricName(metric.Metric)
+
+	var result []Label
+	for name, value := range labels {
+		// an empty label value is the same as an absent label
+		if value != "" {
+			result = append(result, Label{Name: name, Value: value})
+		}
+	}
+	sort.Sort(labelsByName(result))
+	return result
+}
+
+type samplesByTimestamp []Sample
+
+func (s samplesByTimestamp) Len() int           { return len(s) }
+func (s samplesByTimestamp) Less(i, j int) bool { return s[i].Timestamp < s[j].Timestamp }
+func (s samplesByTimestamp) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type labelsByName []Label
+
+func (l labelsByName) Len() int           { return len(l) }
+func (l labelsByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
+func (l labelsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func labelsKey(labels []Label) string {
+	var key bytes.Buffer
+	for _, label := range labels {
+		key.WriteString(label.Name)
+		key.WriteByte(0)
+		key.WriteString(label.Value)
+		key.WriteByte(0)
+	}
+	return key.String()
+}
+
+// sanitizeMetricName maps an OpenTSDB metric name onto the Prometheus
+// metric name charset [a-zA-Z_:][a-zA-Z0-9_:]*, turning dots into
+// underscores.
+func sanitizeMetricName(name string) string {
+	return sanitizePrometheusName(name, true)
+}
+
+// sanitizeLabelName maps a tag name onto [a-zA-Z_][a-zA-Z0-9_]*. Names
+// starting with __ are reserved for Prometheus internal use.
+func sanitizeLabelName(name string) string {
+	name = sanitizePrometheusName(name, false)
+	if strings.HasPrefix(name, "__") {
+		name = "tag" + name
+	}
+	return name
+}
+
+func sanitizePrometheusName(name string, allowColons bool) string {
+	var result bytes.Buffer
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		case r == ':' && allowColons:
+		case r >= '0' && r <= '9' && i > 0:
+		case r >= '0' && r <= '9':
+			result.WriteByte('_')
+		default:
+			r = '_'
+		}
+		result.WriteRune(r)
+	}
+	if result.Len() == 0 {
+		return "_"
+	}
+	return result.String()
+}
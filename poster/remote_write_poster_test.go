@@ -0,0 +1,150 @@
+package poster_test
+
+import (
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+	. "github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/testhelpers"
+)
+
+var _ = Describe("RemoteWritePoster", func() {
+	var receiver *FakeRemoteWriteReceiver
+	var p *poster.RemoteWritePoster
+	var metric poster.Metric
+
+	BeforeEach(func() {
+		receiver = NewFakeRemoteWriteReceiver()
+		receiver.Start()
+
+		p = poster.NewRemoteWritePoster(receiver.URL())
+		p.SetRetryPolicy(2, time.Millisecond, 10*time.Millisecond)
+
+		metric = poster.Metric{
+			Metric:    "opentsdb.nozzle.gorouter.latency-p99",
+			Value:     5.5,
+			Timestamp: 1000,
+			Tags: poster.Tags{
+				Deployment: "cf",
+				Job:        "router",
+				Index:      "0",
+				Extra: map[string]string{
+					"app.name":     "my-app",
+					"__reserved":   "value",
+					"1st_instance": "yes",
+					"empty":        "",
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		receiver.Close()
+	})
+
+	It("sends a snappy compressed protobuf write request with Prometheus-valid labels", func() {
+		Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+
+		Expect(receiver.Requests()).To(HaveLen(1))
+		Expect(receiver.Requests()[0].Timeseries).To(Equal([]poster.TimeSeries{
+			{
+				Labels: []poster.Label{
+					{Name: "_1st_instance", Value: "yes"},
+					{Name: "__name__", Value: "opentsdb_nozzle_gorouter_latency_p99"},
+					{Name: "app_name", Value: "my-app"},
+					{Name: "deployment", Value: "cf"},
+					{Name: "index", Value: "0"},
+					{Name: "job", Value: "router"},
+					{Name: "tag__reserved", Value: "value"},
+				},
+				Samples: []poster.Sample{{Value: 5.5, Timestamp: 1000000}},
+			},
+		}))
+
+		headers := receiver.Headers()[0]
+		Expect(headers.Get("Content-Encoding")).To(Equal("snappy"))
+		Expect(headers.Get("Content-Type")).To(Equal("application/x-protobuf"))
+		Expect(headers.Get("X-Prometheus-Remote-Write-Version")).To(Equal("0.1.0"))
+	})
+
+	It("groups samples of the same series in timestamp order", func() {
+		p.SetMillisecondTimestamps(true)
+		later := metric
+		later.Timestamp = 3000
+		later.Value = 7
+
+		Expect(p.Post([]poster.Metric{later, metric})).To(Succeed())
+
+		series := receiver.Requests()[0].Timeseries
+		Expect(series).To(HaveLen(1))
+		Expect(series[0].Samples).To(Equal([]poster.Sample{
+			{Value: 5.5, Timestamp: 1000},
+			{Value: 7, Timestamp: 3000},
+		}))
+	})
+
+	It("retries on 5xx and 429 responses", func() {
+		receiver.RespondWith(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+
+		Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+		Expect(receiver.Attempts()).To(Equal(3))
+		Expect(receiver.Requests()).To(HaveLen(1))
+	})
+
+	It("gives up after the maximum number of retries", func() {
+		receiver.RespondWith(http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+
+		err := p.Post([]poster.Metric{metric})
+		Expect(err).To(MatchError(ContainSubstring("remote write returned HTTP response: 500")))
+		Expect(receiver.Attempts()).To(Equal(3))
+	})
+
+	It("waits no longer than the maximum backoff when the receiver asks for more", func() {
+		receiver.SetRetryAfter("60")
+		receiver.RespondWith(http.StatusTooManyRequests)
+
+		start := time.Now()
+		Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(receiver.Attempts()).To(Equal(2))
+	})
+
+	It("posts with the configured HTTP client", func() {
+		client, err := poster.NewHTTPClient(poster.HTTPClientConfig{BearerToken: "secret"})
+		Expect(err).NotTo(HaveOccurred())
+		p.SetHTTPClient(client)
+
+		Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+		Expect(receiver.Headers()[0].Get("Authorization")).To(Equal("Bearer secret"))
+	})
+
+	It("does not retry other 4xx responses", func() {
+		receiver.RespondWith(http.StatusBadRequest)
+
+		err := p.Post([]poster.Metric{metric})
+		Expect(err).To(MatchError(ContainSubstring("remote write returned HTTP response: 400")))
+		Expect(receiver.Attempts()).To(Equal(1))
+	})
+
+	It("splits large posts into several requests", func() {
+		metrics := make([]poster.Metric, 4500)
+		for i := range metrics {
+			metrics[i] = metric
+			metrics[i].Timestamp = int64(i)
+		}
+		other := metric
+		other.Metric = "other"
+		metrics = append(metrics, other)
+
+		Expect(p.Post(metrics)).To(Succeed())
+		requests := receiver.Requests()
+		Expect(requests).To(HaveLen(3))
+		Expect(requests[0].Timeseries[0].Samples).To(HaveLen(2000))
+		Expect(requests[1].Timeseries[0].Samples).To(HaveLen(2000))
+		Expect(requests[2].Timeseries).To(HaveLen(2))
+		Expect(requests[2].Timeseries[0].Samples).To(HaveLen(500))
+		Expect(requests[2].Timeseries[1].Labels).To(ContainElement(poster.Label{Name: "__name__", Value: "other"}))
+	})
+})
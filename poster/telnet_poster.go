@@ -1,32 +1,61 @@
 package poster
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"time"
 )
 
 type TelnetPoster struct {
-	tsdbHost string
+	tsdbHost       string
+	tlsConfig      *tls.Config
+	connectTimeout time.Duration
+	writeTimeout   time.Duration
 }
 
 func NewTelnetPoster(tsdbHost string) *TelnetPoster {
 	return &TelnetPoster{
-		tsdbHost: tsdbHost,
+		tsdbHost:       tsdbHost,
+		connectTimeout: defaultConnectTimeout,
+		writeTimeout:   defaultRequestTimeout,
 	}
 }
 
+// SetTLSConfig makes the poster connect over TLS, for TSDs behind a TLS
+// terminating proxy.
+func (p *TelnetPoster) SetTLSConfig(tlsConfig *tls.Config) {
+	p.tlsConfig = tlsConfig
+}
+
+// SetTimeouts bounds the connection, including the TLS handshake, and the
+// write of each batch.
+func (p *TelnetPoster) SetTimeouts(connectTimeout time.Duration, writeTimeout time.Duration) {
+	p.connectTimeout = durationOrDefault(connectTimeout, defaultConnectTimeout)
+	p.writeTimeout = durationOrDefault(writeTimeout, defaultRequestTimeout)
+}
+
 func (p *TelnetPoster) Post(metrics []Metric) error {
-	conn, err := net.Dial("tcp", p.tsdbHost)
+	conn, err := p.dial()
 	if err != nil {
 		return err
 	}
 
 	defer conn.Close()
 
+	conn.SetWriteDeadline(time.Now().Add(p.writeTimeout))
 	_, err = conn.Write([]byte(p.formatMetrics(metrics)))
 	return err
 }
 
+func (p *TelnetPoster) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: p.connectTimeout}
+	if p.tlsConfig == nil {
+		return dialer.Dial("tcp", p.tsdbHost)
+	}
+	return tls.DialWithDialer(dialer, "tcp", p.tsdbHost, p.tlsConfig)
+}
+
 func (p *TelnetPoster) formatMetrics(metrics []Metric) []byte {
 	var result []byte
 	for _, metric := range metrics {
@@ -45,6 +74,9 @@ func (p *TelnetPoster) formatMetrics(metrics []Metric) []byte {
 		if metric.Tags.Job != "" {
 			metricString += fmt.Sprintf(" job=%s", metric.Tags.Job)
 		}
+		for _, key := range metric.Tags.ExtraKeys() {
+			metricString += fmt.Sprintf(" %s=%s", key, metric.Tags.Extra[key])
+		}
 		metricString += "\n"
 		result = append(result, []byte(metricString)...)
 	}
@@ -1,15 +1,19 @@
 package poster_test
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
 	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/testhelpers"
 )
 
 var telnetChan chan []byte
@@ -113,6 +117,31 @@ var _ = Describe("OpentsdbClient Tcp", func() {
 		Expect(string(receivedBytes)).To(ContainSubstring(fmt.Sprintf("put origin.metricName %d %f deployment=deployment-name index=SOME-GUID job=doppler\n", timestamp, 5.0)))
 	})
 
+	It("appends extra tags in sorted order", func() {
+		timestamp := time.Now().Unix()
+		metric := poster.Metric{
+			Metric:    "app.cpuPercentage",
+			Value:     5,
+			Timestamp: timestamp,
+			Tags: poster.Tags{
+				Deployment: "deployment-name",
+				Job:        "diego_cell",
+				Index:      "SOME-GUID",
+				Extra: map[string]string{
+					"app_name": "my-app",
+					"app_id":   "app-guid",
+				},
+			},
+		}
+
+		err := p.Post([]poster.Metric{metric})
+		Expect(err).ToNot(HaveOccurred())
+
+		var receivedBytes []byte
+		Eventually(telnetChan).Should(Receive(&receivedBytes))
+		Expect(string(receivedBytes)).To(ContainSubstring(fmt.Sprintf("put app.cpuPercentage %d %f deployment=deployment-name index=SOME-GUID job=diego_cell app_id=app-guid app_name=my-app\n", timestamp, 5.0)))
+	})
+
 	It("shows a proper error when the connection does not work", func() {
 		address := tcpListener.Addr().String()
 		tcpListener.Close()
@@ -120,6 +149,87 @@ var _ = Describe("OpentsdbClient Tcp", func() {
 		Eventually(func() error { return p.Post([]poster.Metric{}) }).Should(MatchError(fmt.Sprintf("dial tcp %s: getsockopt: connection refused", address)))
 	})
 
+	Context("over TLS", func() {
+		var tmpDir string
+		var certs *testhelpers.Certificates
+		var tlsListener net.Listener
+		var received chan string
+
+		metric := poster.Metric{
+			Metric:    "origin.metricName",
+			Value:     5,
+			Timestamp: 1,
+			Tags:      poster.Tags{Index: "SOME-GUID"},
+		}
+
+		BeforeEach(func() {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "telnet-tls")
+			Expect(err).NotTo(HaveOccurred())
+			certs, err = testhelpers.GenerateCertificates(tmpDir)
+			Expect(err).NotTo(HaveOccurred())
+			serverTLSConfig, err := certs.ServerTLSConfig(true)
+			Expect(err).NotTo(HaveOccurred())
+
+			received = make(chan string, 1)
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			tlsListener = tls.NewListener(listener, serverTLSConfig)
+			p = poster.NewTelnetPoster(tlsListener.Addr().String())
+		})
+
+		AfterEach(func() {
+			tlsListener.Close()
+			os.RemoveAll(tmpDir)
+		})
+
+		serve := func() {
+			go func() {
+				conn, err := tlsListener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				tlsConn := conn.(*tls.Conn)
+				if tlsConn.Handshake() != nil {
+					return
+				}
+				contents, _ := ioutil.ReadAll(conn)
+				received <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName + ": " + string(contents)
+			}()
+		}
+
+		It("posts metrics with the client certificate", func() {
+			serve()
+			tlsConfig, err := poster.NewTLSConfig(certs.CACertFile, certs.ClientCertFile, certs.ClientKeyFile, false)
+			Expect(err).NotTo(HaveOccurred())
+			p.SetTLSConfig(tlsConfig)
+
+			Expect(p.Post([]poster.Metric{metric})).To(Succeed())
+			Eventually(received).Should(Receive(Equal(fmt.Sprintf("nozzle: put origin.metricName 1 %f index=SOME-GUID\n", 5.0))))
+		})
+
+		It("does not trust an unknown server certificate", func() {
+			serve()
+			tlsConfig, err := poster.NewTLSConfig("", certs.ClientCertFile, certs.ClientKeyFile, false)
+			Expect(err).NotTo(HaveOccurred())
+			p.SetTLSConfig(tlsConfig)
+
+			Expect(p.Post([]poster.Metric{metric})).NotTo(Succeed())
+		})
+
+		It("gives up on a handshake after the connect timeout", func() {
+			// the listener accepts the connection but never answers the handshake
+			tlsConfig, err := poster.NewTLSConfig(certs.CACertFile, certs.ClientCertFile, certs.ClientKeyFile, false)
+			Expect(err).NotTo(HaveOccurred())
+			p.SetTLSConfig(tlsConfig)
+			p.SetTimeouts(50*time.Millisecond, time.Second)
+
+			start := time.Now()
+			Expect(p.Post([]poster.Metric{metric})).NotTo(Succeed())
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
+	})
 })
 
 func NewTCPServer() *net.TCPListener {
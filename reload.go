@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/nozzleconfig"
+)
+
+type reloader interface {
+	Reload(config *nozzleconfig.NozzleConfig) error
+}
+
+type configLoader func() (*nozzleconfig.NozzleConfig, error)
+
+// reloadConfig loads the config again and hands it to the nozzle, keeping
+// the running config when the new one is invalid.
+func reloadConfig(load configLoader, nozzle reloader) {
+	config, err := load()
+	if err != nil {
+		logger.Error("Not reloading the configuration", logger.Fields{"error": err})
+		return
+	}
+	if err := nozzle.Reload(config); err != nil {
+		logger.Error("Not reloading the configuration", logger.Fields{"error": err})
+	}
+}
+
+// reloadOnSignal reloads the config file whenever the process receives
+// SIGHUP.
+func reloadOnSignal(configFilePath string, load configLoader, nozzle reloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		logger.Info("Received SIGHUP, reloading the configuration", logger.Fields{"file": configFilePath})
+		reloadConfig(load, nozzle)
+	}
+}
+
+// watchConfig checks the modification time of the config file every
+// interval and reloads it when it has changed.
+func watchConfig(configFilePath string, interval time.Duration, load configLoader, nozzle reloader) {
+	var lastModified time.Time
+	if info, err := os.Stat(configFilePath); err == nil {
+		lastModified = info.ModTime()
+	}
+
+	for range time.Tick(interval) {
+		info, err := os.Stat(configFilePath)
+		if err != nil {
+			logger.Error("Could not watch the config file", logger.Fields{"file": configFilePath, "error": err})
+			continue
+		}
+		if info.ModTime().Equal(lastModified) {
+			continue
+		}
+		lastModified = info.ModTime()
+		logger.Info("The config file has changed, reloading it", logger.Fields{"file": configFilePath})
+		reloadConfig(load, nozzle)
+	}
+}
@@ -0,0 +1,144 @@
+package rlpgateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// The gateway encodes loggregator v2 envelope batches as protobuf JSON,
+// where 64 bit integers are quoted strings.
+type envelopeBatch struct {
+	Batch []envelope `json:"batch"`
+}
+
+type envelope struct {
+	Timestamp  jsonInt64         `json:"timestamp"`
+	SourceID   string            `json:"source_id"`
+	InstanceID string            `json:"instance_id"`
+	Tags       map[string]string `json:"tags"`
+	Gauge      *gauge            `json:"gauge"`
+	Counter    *counter          `json:"counter"`
+	Timer      *timer            `json:"timer"`
+}
+
+type gauge struct {
+	Metrics map[string]gaugeValue `json:"metrics"`
+}
+
+type gaugeValue struct {
+	Unit  string  `json:"unit"`
+	Value float64 `json:"value"`
+}
+
+type counter struct {
+	Name  string    `json:"name"`
+	Delta jsonInt64 `json:"delta"`
+	Total jsonInt64 `json:"total"`
+}
+
+type timer struct {
+	Name  string    `json:"name"`
+	Start jsonInt64 `json:"start"`
+	Stop  jsonInt64 `json:"stop"`
+}
+
+type jsonInt64 int64
+
+func (i *jsonInt64) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseInt(string(bytes.Trim(data, `"`)), 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = jsonInt64(value)
+	return nil
+}
+
+func parseBatch(data []byte) ([]*events.Envelope, error) {
+	var batch envelopeBatch
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return nil, err
+	}
+
+	var converted []*events.Envelope
+	for _, e := range batch.Batch {
+		converted = append(converted, e.toV1()...)
+	}
+	return converted, nil
+}
+
+func (e envelope) toV1() []*events.Envelope {
+	switch {
+	case e.Gauge != nil:
+		var converted []*events.Envelope
+		for name, metric := range e.Gauge.Metrics {
+			v1 := e.newV1(events.Envelope_ValueMetric)
+			v1.ValueMetric = &events.ValueMetric{
+				Name:  proto.String(name),
+				Value: proto.Float64(metric.Value),
+				Unit:  proto.String(metric.Unit),
+			}
+			converted = append(converted, v1)
+		}
+		return converted
+	case e.Counter != nil:
+		v1 := e.newV1(events.Envelope_CounterEvent)
+		v1.CounterEvent = &events.CounterEvent{
+			Name:  proto.String(e.Counter.Name),
+			Delta: proto.Uint64(uint64(e.Counter.Delta)),
+			Total: proto.Uint64(uint64(e.Counter.Total)),
+		}
+		return []*events.Envelope{v1}
+	case e.Timer != nil:
+		v1 := e.newV1(events.Envelope_ValueMetric)
+		duration := time.Duration(e.Timer.Stop - e.Timer.Start)
+		v1.ValueMetric = &events.ValueMetric{
+			Name:  proto.String(e.Timer.Name + ".durationMs"),
+			Value: proto.Float64(float64(duration) / float64(time.Millisecond)),
+			Unit:  proto.String("ms"),
+		}
+		return []*events.Envelope{v1}
+	default:
+		return nil
+	}
+}
+
+func (e envelope) newV1(eventType events.Envelope_EventType) *events.Envelope {
+	origin := e.Tags["origin"]
+	if origin == "" {
+		origin = e.SourceID
+	}
+
+	tags := make(map[string]string)
+	for key, value := range e.Tags {
+		switch key {
+		case "origin", "deployment", "job", "index", "ip":
+		default:
+			tags[key] = value
+		}
+	}
+	// source_id and instance_id name the same component and instance as
+	// deployment, job and index, so they are only kept in place of those to
+	// stay within the tag limit of OpenTSDB
+	if e.SourceID != "" && (e.Tags["deployment"] == "" || e.Tags["job"] == "") {
+		tags["source_id"] = e.SourceID
+	}
+	if e.InstanceID != "" && e.Tags["index"] == "" {
+		tags["instance_id"] = e.InstanceID
+	}
+
+	return &events.Envelope{
+		Origin:     proto.String(origin),
+		EventType:  eventType.Enum(),
+		Timestamp:  proto.Int64(int64(e.Timestamp)),
+		Deployment: proto.String(e.Tags["deployment"]),
+		Job:        proto.String(e.Tags["job"]),
+		Index:      proto.String(e.Tags["index"]),
+		Ip:         proto.String(e.Tags["ip"]),
+		Tags:       tags,
+	}
+}
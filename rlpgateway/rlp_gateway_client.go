@@ -0,0 +1,182 @@
+package rlpgateway
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
+)
+
+var validSelectors = map[string]bool{
+	"gauge":   true,
+	"counter": true,
+	"timer":   true,
+}
+
+func ParseSelectors(selectors string) ([]string, error) {
+	if strings.TrimSpace(selectors) == "" {
+		return []string{"gauge", "counter", "timer"}, nil
+	}
+
+	var parsed []string
+	for _, selector := range strings.Split(selectors, ",") {
+		selector = strings.ToLower(strings.TrimSpace(selector))
+		if !validSelectors[selector] {
+			return nil, fmt.Errorf("unknown RLP gateway selector %q, expected gauge, counter or timer", selector)
+		}
+		parsed = append(parsed, selector)
+	}
+	return parsed, nil
+}
+
+type Client struct {
+	gatewayURL  string
+	selectors   []string
+	httpClient  *http.Client
+	idleTimeout time.Duration
+
+	lock   sync.Mutex
+	cancel context.CancelFunc
+}
+
+func NewClient(gatewayURL string, insecureSSLSkipVerify bool, selectors []string) *Client {
+	return &Client{
+		gatewayURL: strings.TrimRight(gatewayURL, "/"),
+		selectors:  selectors,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSSLSkipVerify},
+			},
+		},
+	}
+}
+
+func (c *Client) SetIdleTimeout(idleTimeout time.Duration) {
+	c.idleTimeout = idleTimeout
+}
+
+func (c *Client) Stream(shardID string, authToken string) (<-chan *events.Envelope, <-chan error) {
+	messages := make(chan *events.Envelope)
+	errs := make(chan error, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.lock.Lock()
+	c.cancel = cancel
+	c.lock.Unlock()
+
+	go func() {
+		err := c.stream(ctx, shardID, authToken, messages)
+		if ctx.Err() == nil {
+			errs <- err
+		}
+	}()
+	return messages, errs
+}
+
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+	return nil
+}
+
+func (c *Client) readURL(shardID string) string {
+	query := url.Values{}
+	query.Set("shard_id", shardID)
+	for _, selector := range c.selectors {
+		query.Set(selector, "")
+	}
+	return fmt.Sprintf("%s/v2/read?%s", c.gatewayURL, query.Encode())
+}
+
+func (c *Client) stream(ctx context.Context, shardID string, authToken string, messages chan<- *events.Envelope) error {
+	req, err := http.NewRequest("GET", c.readURL(shardID), nil)
+	if err != nil {
+		return err
+	}
+	requestCtx, cancelRequest := context.WithCancel(ctx)
+	defer cancelRequest()
+	req = req.WithContext(requestCtx)
+	req.Header.Set("Authorization", authToken)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rlp gateway request returned HTTP response: %v", resp.StatusCode)
+	}
+
+	var idleTimer *time.Timer
+	if c.idleTimeout > 0 {
+		idleTimer = time.AfterFunc(c.idleTimeout, cancelRequest)
+		defer idleTimer.Stop()
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	var eventName string
+	var data bytes.Buffer
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if ctx.Err() == nil && requestCtx.Err() != nil {
+				return fmt.Errorf("no data received from the rlp gateway for %s", c.idleTimeout)
+			}
+			if err == io.EOF {
+				return errors.New("rlp gateway closed the stream")
+			}
+			return err
+		}
+		if idleTimer != nil {
+			idleTimer.Reset(c.idleTimeout)
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		switch {
+		case len(line) == 0:
+			if eventName == "" && data.Len() > 0 {
+				c.dispatch(requestCtx, data.Bytes(), messages)
+			}
+			eventName = ""
+			data.Reset()
+		case bytes.HasPrefix(line, []byte("event:")):
+			eventName = string(bytes.TrimSpace(line[len("event:"):]))
+		case bytes.HasPrefix(line, []byte("data:")):
+			data.Write(bytes.TrimSpace(line[len("data:"):]))
+		}
+	}
+}
+
+func (c *Client) dispatch(ctx context.Context, data []byte, messages chan<- *events.Envelope) {
+	envelopes, err := parseBatch(data)
+	if err != nil {
+		logger.Warn("Could not parse RLP gateway batch", logger.Fields{"error": err})
+		return
+	}
+
+	for _, envelope := range envelopes {
+		select {
+		case messages <- envelope:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package rlpgateway_test
+
+import (
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/rlpgateway"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/testhelpers"
+)
+
+var _ = Describe("RLPGateway Client", func() {
+	var (
+		fakeGateway *testhelpers.FakeRLPGateway
+		client      *rlpgateway.Client
+	)
+
+	BeforeEach(func() {
+		fakeGateway = testhelpers.NewFakeRLPGateway("bearer good-token")
+		fakeGateway.Start()
+		client = rlpgateway.NewClient(fakeGateway.URL(), false, []string{"gauge", "counter"})
+	})
+
+	AfterEach(func() {
+		client.Close()
+		fakeGateway.Close()
+	})
+
+	It("requests the selected envelope types for the shard", func() {
+		fakeGateway.KeepConnectionAlive()
+		client.Stream("opentsdb-nozzle", "bearer good-token")
+
+		Eventually(fakeGateway.Requests).Should(Equal(1))
+		Expect(fakeGateway.LastAuthorization()).To(Equal("bearer good-token"))
+		query := fakeGateway.LastQuery()
+		Expect(query.Get("shard_id")).To(Equal("opentsdb-nozzle"))
+		Expect(query).To(HaveKey("gauge"))
+		Expect(query).To(HaveKey("counter"))
+		Expect(query).ToNot(HaveKey("timer"))
+	})
+
+	It("converts gauges and maps their tags", func() {
+		fakeGateway.KeepConnectionAlive()
+		fakeGateway.AddBatch(`{"batch":[{"timestamp":"1000000000","source_id":"doppler","instance_id":"SOME-GUID","tags":{"origin":"loggregator.doppler","deployment":"cf","job":"doppler","index":"SOME-GUID","ip":"10.0.0.1","az":"z1"},"gauge":{"metrics":{"ingress":{"unit":"count","value":5}}}}]}`)
+		messages, _ := client.Stream("opentsdb-nozzle", "bearer good-token")
+
+		var envelope *events.Envelope
+		Eventually(messages).Should(Receive(&envelope))
+		Expect(envelope).To(Equal(&events.Envelope{
+			Origin:     proto.String("loggregator.doppler"),
+			EventType:  events.Envelope_ValueMetric.Enum(),
+			Timestamp:  proto.Int64(1000000000),
+			Deployment: proto.String("cf"),
+			Job:        proto.String("doppler"),
+			Index:      proto.String("SOME-GUID"),
+			Ip:         proto.String("10.0.0.1"),
+			Tags: map[string]string{
+				"az": "z1",
+			},
+			ValueMetric: &events.ValueMetric{
+				Name:  proto.String("ingress"),
+				Value: proto.Float64(5),
+				Unit:  proto.String("count"),
+			},
+		}))
+	})
+
+	It("converts counters", func() {
+		fakeGateway.KeepConnectionAlive()
+		fakeGateway.AddBatch(`{"batch":[{"timestamp":"2000000000","source_id":"gorouter","tags":{"deployment":"cf"},"counter":{"name":"requests","delta":"3","total":"42"}}]}`)
+		messages, _ := client.Stream("opentsdb-nozzle", "bearer good-token")
+
+		var envelope *events.Envelope
+		Eventually(messages).Should(Receive(&envelope))
+		Expect(envelope.GetOrigin()).To(Equal("gorouter"))
+		Expect(envelope.GetEventType()).To(Equal(events.Envelope_CounterEvent))
+		Expect(envelope.GetCounterEvent().GetName()).To(Equal("requests"))
+		Expect(envelope.GetCounterEvent().GetDelta()).To(BeEquivalentTo(3))
+		Expect(envelope.GetCounterEvent().GetTotal()).To(BeEquivalentTo(42))
+	})
+
+	It("converts timers to durations in milliseconds", func() {
+		fakeGateway.KeepConnectionAlive()
+		fakeGateway.AddBatch(`{"batch":[{"timestamp":"2000000000","source_id":"app-guid","instance_id":"1","tags":{},"timer":{"name":"http","start":"1000000000","stop":"1250000000"}}]}`)
+		client = rlpgateway.NewClient(fakeGateway.URL(), false, []string{"timer"})
+		messages, _ := client.Stream("opentsdb-nozzle", "bearer good-token")
+
+		var envelope *events.Envelope
+		Eventually(messages).Should(Receive(&envelope))
+		Expect(envelope.GetEventType()).To(Equal(events.Envelope_ValueMetric))
+		Expect(envelope.GetValueMetric().GetName()).To(Equal("http.durationMs"))
+		Expect(envelope.GetValueMetric().GetValue()).To(BeEquivalentTo(250))
+		Expect(envelope.GetTags()).To(Equal(map[string]string{"source_id": "app-guid", "instance_id": "1"}))
+	})
+
+	It("tags with the source and instance IDs only when deployment, job or index are missing", func() {
+		fakeGateway.KeepConnectionAlive()
+		fakeGateway.AddBatch(`{"batch":[{"timestamp":"2000000000","source_id":"gorouter","instance_id":"3","tags":{"deployment":"cf","index":"3"},"counter":{"name":"requests","delta":"3","total":"42"}}]}`)
+		messages, _ := client.Stream("opentsdb-nozzle", "bearer good-token")
+
+		var envelope *events.Envelope
+		Eventually(messages).Should(Receive(&envelope))
+		Expect(envelope.GetTags()).To(Equal(map[string]string{"source_id": "gorouter"}))
+	})
+
+	It("returns an error when the gateway rejects the token", func() {
+		_, errs := client.Stream("opentsdb-nozzle", "bearer bad-token")
+
+		var err error
+		Eventually(errs).Should(Receive(&err))
+		Expect(err).To(MatchError("rlp gateway request returned HTTP response: 401"))
+	})
+
+	It("returns an error when the gateway closes the stream", func() {
+		_, errs := client.Stream("opentsdb-nozzle", "bearer good-token")
+
+		var err error
+		Eventually(errs).Should(Receive(&err))
+		Expect(err).To(MatchError("rlp gateway closed the stream"))
+	})
+
+	It("returns an error when the stream stays idle", func() {
+		fakeGateway.KeepConnectionAlive()
+		client.SetIdleTimeout(50 * time.Millisecond)
+		_, errs := client.Stream("opentsdb-nozzle", "bearer good-token")
+
+		var err error
+		Eventually(errs).Should(Receive(&err))
+		Expect(err.Error()).To(ContainSubstring("no data received from the rlp gateway"))
+	})
+
+	It("does not report an error after it was closed", func() {
+		fakeGateway.KeepConnectionAlive()
+		_, errs := client.Stream("opentsdb-nozzle", "bearer good-token")
+		Eventually(fakeGateway.Requests).Should(Equal(1))
+
+		client.Close()
+		Consistently(errs).ShouldNot(Receive())
+	})
+
+	Describe("ParseSelectors", func() {
+		It("selects all metric envelope types by default", func() {
+			Expect(rlpgateway.ParseSelectors("")).To(Equal([]string{"gauge", "counter", "timer"}))
+		})
+
+		It("parses a comma separated list", func() {
+			Expect(rlpgateway.ParseSelectors("Gauge, timer")).To(Equal([]string{"gauge", "timer"}))
+		})
+
+		It("rejects unknown selectors", func() {
+			_, err := rlpgateway.ParseSelectors("gauge,log")
+			Expect(err).To(MatchError(ContainSubstring(`unknown RLP gateway selector "log"`)))
+		})
+	})
+})
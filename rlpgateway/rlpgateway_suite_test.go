@@ -0,0 +1,19 @@
+package rlpgateway_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestRLPGateway(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "RLPGateway Suite")
+}
+
+var _ = BeforeSuite(func() {
+	log.SetOutput(ioutil.Discard)
+})
@@ -0,0 +1,101 @@
+package testhelpers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+type FakeCloudController struct {
+	server *httptest.Server
+	lock   sync.Mutex
+
+	validToken string
+	apps       map[string]fakeApp
+
+	requests          int
+	lastAuthorization string
+}
+
+type fakeApp struct {
+	name      string
+	spaceName string
+	orgName   string
+}
+
+func NewFakeCloudController(validToken string) *FakeCloudController {
+	return &FakeCloudController{
+		validToken: validToken,
+		apps:       make(map[string]fakeApp),
+	}
+}
+
+func (f *FakeCloudController) Start() {
+	f.server = httptest.NewUnstartedServer(f)
+	f.server.Start()
+}
+
+func (f *FakeCloudController) Close() {
+	f.server.Close()
+}
+
+func (f *FakeCloudController) URL() string {
+	return f.server.URL
+}
+
+func (f *FakeCloudController) AddApp(guid string, name string, spaceName string, orgName string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.apps[guid] = fakeApp{name: name, spaceName: spaceName, orgName: orgName}
+}
+
+func (f *FakeCloudController) Requests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+func (f *FakeCloudController) LastAuthorization() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.lastAuthorization
+}
+
+func (f *FakeCloudController) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.requests++
+	f.lastAuthorization = r.Header.Get("Authorization")
+	if f.lastAuthorization != f.validToken {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	guid := strings.TrimPrefix(r.URL.Path, "/v2/apps/")
+	app, ok := f.apps[guid]
+	if !ok || r.URL.Query().Get("inline-relations-depth") != "2" {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rw.Write([]byte(fmt.Sprintf(`
+		{
+			"metadata": {"guid": "%s"},
+			"entity": {
+				"name": "%s",
+				"space": {
+					"entity": {
+						"name": "%s",
+						"organization": {
+							"entity": {"name": "%s"}
+						}
+					}
+				}
+			}
+		}
+	`, guid, app.name, app.spaceName, app.orgName)))
+}
@@ -4,11 +4,15 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 )
 
 type FakeOpenTSDB struct {
 	server           *httptest.Server
 	ReceivedContents chan []byte
+
+	lock     sync.Mutex
+	failures int
 }
 
 func NewFakeOpenTSDB() *FakeOpenTSDB {
@@ -30,10 +34,29 @@ func (f *FakeOpenTSDB) URL() string {
 	return f.server.URL
 }
 
+// FailRequests answers the next requests with 503 Service Unavailable,
+// without passing their contents on.
+func (f *FakeOpenTSDB) FailRequests(requests int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures = requests
+}
+
 func (f *FakeOpenTSDB) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	contents, _ := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
 
+	f.lock.Lock()
+	fail := f.failures > 0
+	if fail {
+		f.failures--
+	}
+	f.lock.Unlock()
+	if fail {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
 	go func() {
 		f.ReceivedContents <- contents
 	}()
@@ -0,0 +1,112 @@
+package testhelpers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+)
+
+type FakeRemoteWriteReceiver struct {
+	server *httptest.Server
+	lock   sync.Mutex
+
+	responses  []int
+	retryAfter string
+	requests   []*poster.WriteRequest
+	headers    []http.Header
+	attempts   int
+}
+
+func NewFakeRemoteWriteReceiver() *FakeRemoteWriteReceiver {
+	return &FakeRemoteWriteReceiver{}
+}
+
+func (f *FakeRemoteWriteReceiver) Start() {
+	f.server = httptest.NewUnstartedServer(f)
+	f.server.Start()
+}
+
+func (f *FakeRemoteWriteReceiver) Close() {
+	f.server.Close()
+}
+
+func (f *FakeRemoteWriteReceiver) URL() string {
+	return f.server.URL + "/api/v1/write"
+}
+
+// RespondWith queues status codes for the next requests, after which the
+// receiver accepts every request with 204 No Content.
+func (f *FakeRemoteWriteReceiver) RespondWith(statusCodes ...int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.responses = append(f.responses, statusCodes...)
+}
+
+// SetRetryAfter sets the Retry-After header of the queued error responses.
+func (f *FakeRemoteWriteReceiver) SetRetryAfter(retryAfter string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.retryAfter = retryAfter
+}
+
+// Requests returns the decoded requests that were accepted.
+func (f *FakeRemoteWriteReceiver) Requests() []*poster.WriteRequest {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+func (f *FakeRemoteWriteReceiver) Headers() []http.Header {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.headers
+}
+
+func (f *FakeRemoteWriteReceiver) Attempts() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.attempts
+}
+
+func (f *FakeRemoteWriteReceiver) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.attempts++
+
+	if len(f.responses) > 0 {
+		statusCode := f.responses[0]
+		f.responses = f.responses[1:]
+		if statusCode/100 != 2 {
+			if f.retryAfter != "" {
+				rw.Header().Set("Retry-After", f.retryAfter)
+			}
+			http.Error(rw, http.StatusText(statusCode), statusCode)
+			return
+		}
+	}
+
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request, err := DecodeWriteRequest(data)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.requests = append(f.requests, request)
+	f.headers = append(f.headers, r.Header)
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,110 @@
+package testhelpers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+)
+
+type FakeRLPGateway struct {
+	server *httptest.Server
+	lock   sync.Mutex
+
+	validToken string
+
+	lastAuthorization string
+	lastQuery         url.Values
+	requests          int
+
+	batches   []string
+	stayAlive bool
+	done      chan struct{}
+}
+
+func NewFakeRLPGateway(validToken string) *FakeRLPGateway {
+	return &FakeRLPGateway{
+		validToken: validToken,
+		done:       make(chan struct{}),
+	}
+}
+
+func (f *FakeRLPGateway) Start() {
+	f.server = httptest.NewUnstartedServer(f)
+	f.server.Start()
+}
+
+func (f *FakeRLPGateway) Close() {
+	close(f.done)
+	f.server.Close()
+}
+
+func (f *FakeRLPGateway) URL() string {
+	return f.server.URL
+}
+
+func (f *FakeRLPGateway) LastAuthorization() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.lastAuthorization
+}
+
+func (f *FakeRLPGateway) LastQuery() url.Values {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.lastQuery
+}
+
+func (f *FakeRLPGateway) Requests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+// AddBatch queues a loggregator v2 envelope batch, in its JSON encoding,
+// to be sent on the next stream.
+func (f *FakeRLPGateway) AddBatch(batch string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.batches = append(f.batches, batch)
+}
+
+func (f *FakeRLPGateway) KeepConnectionAlive() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.stayAlive = true
+}
+
+func (f *FakeRLPGateway) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	f.lock.Lock()
+	f.lastAuthorization = r.Header.Get("Authorization")
+	f.lastQuery = r.URL.Query()
+	f.requests++
+	batches := f.batches
+	stayAlive := f.stayAlive
+	f.lock.Unlock()
+
+	if r.Header.Get("Authorization") != f.validToken {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.WriteHeader(http.StatusOK)
+	flusher := rw.(http.Flusher)
+
+	fmt.Fprint(rw, "event: heartbeat\ndata: 1500000000\n\n")
+	for _, batch := range batches {
+		fmt.Fprintf(rw, "data: %s\n\n", batch)
+	}
+	flusher.Flush()
+
+	if stayAlive {
+		select {
+		case <-f.done:
+		case <-r.Context().Done():
+		}
+	}
+}
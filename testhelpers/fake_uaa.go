@@ -2,8 +2,10 @@ package testhelpers
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"sync"
 )
 
@@ -13,8 +15,13 @@ type FakeUAA struct {
 
 	tokenType   string
 	accessToken string
+	expiresIn   int
 
-	requested bool
+	requested        bool
+	connections      int
+	lastForm         url.Values
+	lastClientID     string
+	lastClientSecret string
 }
 
 func NewFakeUAA(tokenType string, accessToken string) *FakeUAA {
@@ -26,6 +33,13 @@ func NewFakeUAA(tokenType string, accessToken string) *FakeUAA {
 
 func (f *FakeUAA) Start() {
 	f.server = httptest.NewUnstartedServer(f)
+	f.server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			f.lock.Lock()
+			f.connections++
+			f.lock.Unlock()
+		}
+	}
 	f.server.Start()
 }
 
@@ -43,17 +57,49 @@ func (f *FakeUAA) Requested() bool {
 	return f.requested
 }
 
+// Connections returns how many connections clients opened.
+func (f *FakeUAA) Connections() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.connections
+}
+
+// SetExpiresIn makes the UAA report that its tokens expire after the given
+// number of seconds.
+func (f *FakeUAA) SetExpiresIn(seconds int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.expiresIn = seconds
+}
+
+// LastRequest returns the form and the basic auth credentials of the last
+// token request.
+func (f *FakeUAA) LastRequest() (form url.Values, clientID string, clientSecret string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.lastForm, f.lastClientID, f.lastClientSecret
+}
+
 func (f *FakeUAA) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	r.ParseForm()
+	clientID, clientSecret, _ := r.BasicAuth()
+
+	f.lock.Lock()
+	f.requested = true
+	f.lastForm = r.PostForm
+	f.lastClientID = clientID
+	f.lastClientSecret = clientSecret
+	expiresIn := f.expiresIn
+	f.lock.Unlock()
+
 	rw.Write([]byte(fmt.Sprintf(`
 		{
 			"token_type": "%s",
-			"access_token": "%s"
+			"access_token": "%s",
+			"expires_in": %d
 		}
-	`, f.tokenType, f.accessToken)))
-	f.lock.Lock()
-	f.requested = true
-	f.lock.Unlock()
+	`, f.tokenType, f.accessToken, expiresIn)))
 }
 
 func (f *FakeUAA) AuthToken() string {
@@ -0,0 +1,136 @@
+package testhelpers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/poster"
+)
+
+// Protobuf wire types, see https://developers.google.com/protocol-buffers/docs/encoding
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// DecodeWriteRequest decodes a remote write request by walking the protobuf
+// wire format with the field numbers of prometheus/prompb (remote.proto and
+// types.proto), instead of the struct tags of poster.WriteRequest, so that
+// a mistake in those tags does not cancel out in the tests. Unknown fields
+// and wire types are errors.
+func DecodeWriteRequest(data []byte) (*poster.WriteRequest, error) {
+	request := &poster.WriteRequest{}
+	err := decodeFields(data, func(field int, wireType int, value []byte, _ uint64) error {
+		if field != 1 || wireType != wireBytes {
+			return unexpectedField("WriteRequest", field, wireType)
+		}
+		series, err := decodeTimeSeries(value)
+		if err != nil {
+			return err
+		}
+		request.Timeseries = append(request.Timeseries, series)
+		return nil
+	})
+	return request, err
+}
+
+func decodeTimeSeries(data []byte) (poster.TimeSeries, error) {
+	var series poster.TimeSeries
+	err := decodeFields(data, func(field int, wireType int, value []byte, _ uint64) error {
+		switch {
+		case field == 1 && wireType == wireBytes:
+			label, err := decodeLabel(value)
+			series.Labels = append(series.Labels, label)
+			return err
+		case field == 2 && wireType == wireBytes:
+			sample, err := decodeSample(value)
+			series.Samples = append(series.Samples, sample)
+			return err
+		default:
+			return unexpectedField("TimeSeries", field, wireType)
+		}
+	})
+	return series, err
+}
+
+func decodeLabel(data []byte) (poster.Label, error) {
+	var label poster.Label
+	err := decodeFields(data, func(field int, wireType int, value []byte, _ uint64) error {
+		switch {
+		case field == 1 && wireType == wireBytes:
+			label.Name = string(value)
+		case field == 2 && wireType == wireBytes:
+			label.Value = string(value)
+		default:
+			return unexpectedField("Label", field, wireType)
+		}
+		return nil
+	})
+	return label, err
+}
+
+func decodeSample(data []byte) (poster.Sample, error) {
+	var sample poster.Sample
+	err := decodeFields(data, func(field int, wireType int, _ []byte, number uint64) error {
+		switch {
+		case field == 1 && wireType == wireFixed64:
+			sample.Value = math.Float64frombits(number)
+		case field == 2 && wireType == wireVarint:
+			sample.Timestamp = int64(number)
+		default:
+			return unexpectedField("Sample", field, wireType)
+		}
+		return nil
+	})
+	return sample, err
+}
+
+// decodeFields calls visit for every field of a message, with the payload
+// of length delimited fields in value and the others in number.
+func decodeFields(data []byte, visit func(field int, wireType int, value []byte, number uint64) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		data = data[n:]
+		field, wireType := int(key>>3), int(key&7)
+
+		var value []byte
+		var number uint64
+		switch wireType {
+		case wireVarint:
+			number, n = binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("invalid varint in field %d", field)
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return fmt.Errorf("truncated fixed64 in field %d", field)
+			}
+			number = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return fmt.Errorf("truncated bytes in field %d", field)
+			}
+			value = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return fmt.Errorf("unsupported wire type %d in field %d", wireType, field)
+		}
+
+		if err := visit(field, wireType, value, number); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unexpectedField(message string, field int, wireType int) error {
+	return fmt.Errorf("unexpected field %d with wire type %d in %s", field, wireType, message)
+}
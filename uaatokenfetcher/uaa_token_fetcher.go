@@ -1,28 +1,156 @@
 package uaatokenfetcher
 
 import (
-	"log"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/cloudfoundry-incubator/uaago"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
 )
 
+const clientCredentialsTimeout = 30 * time.Second
+
+// UAATokenFetcher gets tokens from the UAA. When ClientID is set it
+// authenticates as a UAA client with the client_credentials grant,
+// requesting Scopes in addition to the client's default scopes. Otherwise
+// it uses Username and Password.
 type UAATokenFetcher struct {
 	UaaUrl                string
 	Username              string
 	Password              string
+	ClientID              string
+	ClientSecret          string
+	Scopes                []string
 	InsecureSSLSkipVerify bool
+
+	lock      sync.Mutex
+	expiresAt time.Time
+	refreshes uint64
+	client    *http.Client
 }
 
 func (uaa *UAATokenFetcher) FetchAuthToken() string {
+	authToken, err := uaa.TryFetchAuthToken()
+	if err != nil {
+		logger.Fatal("Could not fetch a UAA token", logger.Fields{"endpoint": uaa.UaaUrl, "error": err})
+	}
+	return authToken
+}
+
+// TryFetchAuthToken fetches a token like FetchAuthToken, but returns the
+// error instead of exiting.
+func (uaa *UAATokenFetcher) TryFetchAuthToken() (string, error) {
+	if uaa.ClientID != "" {
+		authToken, expiresIn, err := uaa.fetchClientCredentialsToken()
+		if err != nil {
+			return "", fmt.Errorf("Error getting oauth token: %s. Please check your client ID and secret.", err.Error())
+		}
+		uaa.setExpiry(expiresIn)
+		return authToken, nil
+	}
+
 	uaaClient, err := uaago.NewClient(uaa.UaaUrl)
 	if err != nil {
-		log.Fatalf("Error creating uaa client: %s", err.Error())
+		return "", fmt.Errorf("Error creating uaa client: %s", err.Error())
 	}
 
-	var authToken string
-	authToken, err = uaaClient.GetAuthToken(uaa.Username, uaa.Password, uaa.InsecureSSLSkipVerify)
+	authToken, expiresIn, err := uaaClient.GetAuthTokenWithExpiresIn(uaa.Username, uaa.Password, uaa.InsecureSSLSkipVerify)
 	if err != nil {
-		log.Fatalf("Error getting oauth token: %s. Please check your username and password.", err.Error())
+		return "", fmt.Errorf("Error getting oauth token: %s. Please check your username and password.", err.Error())
 	}
-	return authToken
+	uaa.setExpiry(expiresIn)
+	return authToken, nil
+}
+
+// TokenExpiry returns when the last token fetched expires, or the zero
+// time when the UAA did not say.
+func (uaa *UAATokenFetcher) TokenExpiry() time.Time {
+	uaa.lock.Lock()
+	defer uaa.lock.Unlock()
+	return uaa.expiresAt
+}
+
+// TokenRefreshes returns how many tokens were fetched so far.
+func (uaa *UAATokenFetcher) TokenRefreshes() uint64 {
+	uaa.lock.Lock()
+	defer uaa.lock.Unlock()
+	return uaa.refreshes
+}
+
+func (uaa *UAATokenFetcher) setExpiry(expiresIn int) {
+	uaa.lock.Lock()
+	defer uaa.lock.Unlock()
+	uaa.refreshes++
+	if expiresIn <= 0 {
+		uaa.expiresAt = time.Time{}
+		return
+	}
+	uaa.expiresAt = time.Now().Add(time.Duration(expiresIn) * time.Second)
+}
+
+func (uaa *UAATokenFetcher) fetchClientCredentialsToken() (string, int, error) {
+	form := url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {uaa.ClientID},
+	}
+	if len(uaa.Scopes) > 0 {
+		form.Set("scope", strings.Join(uaa.Scopes, " "))
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimRight(uaa.UaaUrl, "/")+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.SetBasicAuth(url.QueryEscape(uaa.ClientID), url.QueryEscape(uaa.ClientSecret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := uaa.httpClient().Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	// read what the decoder leaves so that the connection can be reused
+	defer io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("UAA returned HTTP response: %d", resp.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", 0, fmt.Errorf("can not parse the UAA response: %s", err)
+	}
+	if token.AccessToken == "" {
+		return "", 0, fmt.Errorf("the UAA response has no access token")
+	}
+	return fmt.Sprintf("%s %s", token.TokenType, token.AccessToken), token.ExpiresIn, nil
+}
+
+// httpClient returns the client for the client_credentials grant, built on
+// first use so that its connections are reused across token refreshes.
+func (uaa *UAATokenFetcher) httpClient() *http.Client {
+	uaa.lock.Lock()
+	defer uaa.lock.Unlock()
+	if uaa.client == nil {
+		uaa.client = &http.Client{
+			Timeout: clientCredentialsTimeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: uaa.InsecureSSLSkipVerify},
+			},
+		}
+	}
+	return uaa.client
 }
@@ -1,6 +1,8 @@
 package uaatokenfetcher_test
 
 import (
+	"time"
+
 	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/uaatokenfetcher"
 
 	. "github.com/onsi/ginkgo"
@@ -28,4 +30,76 @@ var _ = Describe("UaaTokenFetcher", func() {
 		Expect(fakeUAA.Requested()).To(BeTrue())
 		Expect(receivedAuthToken).To(Equal(fakeToken))
 	})
+
+	It("returns an error when the UAA can not be reached", func() {
+		fakeUAA.Close()
+		_, err := tokenFetcher.TryFetchAuthToken()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix("Error getting oauth token: "))
+	})
+
+	It("records when the token expires", func() {
+		Expect(tokenFetcher.TokenExpiry()).To(BeZero())
+
+		fakeUAA.SetExpiresIn(3600)
+		tokenFetcher.FetchAuthToken()
+		Expect(tokenFetcher.TokenExpiry()).To(BeTemporally("~", time.Now().Add(time.Hour), 5*time.Second))
+	})
+
+	It("counts the tokens fetched", func() {
+		tokenFetcher.FetchAuthToken()
+		tokenFetcher.FetchAuthToken()
+		Expect(tokenFetcher.TokenRefreshes()).To(BeEquivalentTo(2))
+
+		fakeUAA.Close()
+		tokenFetcher.TryFetchAuthToken()
+		Expect(tokenFetcher.TokenRefreshes()).To(BeEquivalentTo(2))
+	})
+
+	Context("with a client ID", func() {
+		BeforeEach(func() {
+			tokenFetcher.ClientID = "opentsdb-nozzle"
+			tokenFetcher.ClientSecret = "client-secret"
+			tokenFetcher.Scopes = []string{"doppler.firehose", "cloud_controller.admin_read_only"}
+			fakeUAA.SetExpiresIn(600)
+		})
+
+		It("uses the client_credentials grant", func() {
+			authToken, err := tokenFetcher.TryFetchAuthToken()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(authToken).To(Equal(fakeToken))
+
+			form, clientID, clientSecret := fakeUAA.LastRequest()
+			Expect(form.Get("grant_type")).To(Equal("client_credentials"))
+			Expect(form.Get("client_id")).To(Equal("opentsdb-nozzle"))
+			Expect(form.Get("scope")).To(Equal("doppler.firehose cloud_controller.admin_read_only"))
+			Expect(clientID).To(Equal("opentsdb-nozzle"))
+			Expect(clientSecret).To(Equal("client-secret"))
+			Expect(tokenFetcher.TokenExpiry()).To(BeTemporally("~", time.Now().Add(10*time.Minute), 5*time.Second))
+		})
+
+		It("does not request extra scopes unless some are configured", func() {
+			tokenFetcher.Scopes = nil
+			_, err := tokenFetcher.TryFetchAuthToken()
+			Expect(err).ToNot(HaveOccurred())
+
+			form, _, _ := fakeUAA.LastRequest()
+			Expect(form).ToNot(HaveKey("scope"))
+		})
+
+		It("reuses its connection for later tokens", func() {
+			for i := 0; i < 3; i++ {
+				_, err := tokenFetcher.TryFetchAuthToken()
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(fakeUAA.Connections()).To(Equal(1))
+		})
+
+		It("returns an error when the UAA can not be reached", func() {
+			fakeUAA.Close()
+			_, err := tokenFetcher.TryFetchAuthToken()
+			Expect(err).To(MatchError(HavePrefix("Error getting oauth token: ")))
+			Expect(err.Error()).To(HaveSuffix("Please check your client ID and secret."))
+		})
+	})
 })
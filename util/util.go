@@ -4,20 +4,21 @@ import (
 	"bytes"
 	"compress/gzip"
 	"io/ioutil"
-	"log"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/logger"
 )
 
 func Unzip(contents []byte) ([]byte, error) {
 	buf := bytes.NewBuffer(contents)
 	gzipReader, err := gzip.NewReader(buf)
 	if err != nil {
-		log.Printf("Fail to new gzip reader: %v", err)
+		logger.Error("Could not create a gzip reader", logger.Fields{"error": err})
 		return nil, err
 	}
 
 	uncompressedData, err := ioutil.ReadAll(gzipReader)
 	if err != nil {
-		log.Printf("Fail to read content from gzip reader: %v", err)
+		logger.Error("Could not read from the gzip reader", logger.Fields{"error": err})
 		return nil, err
 	}
 
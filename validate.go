@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/configcheck"
+	"github.com/pivotal-cf-experimental/opentsdb-firehose-nozzle/nozzleconfig"
+)
+
+const (
+	exitValid       = 0
+	exitInvalid     = 1
+	exitUnreachable = 2
+)
+
+// runValidate implements the validate subcommand: it loads the config
+// with the environment and flag overrides, prints it with the secrets masked and
+// lists its problems, and optionally checks that the services it names can
+// be reached. It returns the exit code.
+func runValidate(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configFilePath := flags.String("config", "config/opentsdb-firehose-nozzle.json", "Location of the nozzle config file, JSON or YAML")
+	checkConnectivity := flags.Bool("check-connectivity", false, "Also check that the UAA, the envelope source and the outputs can be reached")
+	timeout := flags.Duration("timeout", 5*time.Second, "How long to wait for each service when checking connectivity")
+	overrides := nozzleconfig.RegisterFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return exitInvalid
+	}
+
+	config, err := nozzleconfig.Load(*configFilePath, overrides)
+	if config == nil {
+		fmt.Fprintf(stderr, "Error parsing config: %s\n", err)
+		return exitInvalid
+	}
+
+	effective, _ := json.MarshalIndent(config.Masked(), "", "  ")
+	fmt.Fprintf(stdout, "%s\n", effective)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitInvalid
+	}
+	fmt.Fprintln(stderr, "The configuration is valid")
+
+	if !*checkConnectivity {
+		return exitValid
+	}
+
+	exitCode := exitValid
+	for _, result := range configcheck.CheckConnectivity(config, *timeout) {
+		if result.Err != nil {
+			fmt.Fprintf(stderr, "FAIL %s %s: %s\n", result.Name, nozzleconfig.MaskURL(result.Target), result.Err)
+			exitCode = exitUnreachable
+		} else {
+			fmt.Fprintf(stderr, "OK   %s %s\n", result.Name, nozzleconfig.MaskURL(result.Target))
+		}
+	}
+	return exitCode
+}
@@ -0,0 +1,61 @@
+package main_test
+
+import (
+	"net"
+	"os"
+	"os/exec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("validate", func() {
+	validate := func(env []string, args ...string) *gexec.Session {
+		command := exec.Command(pathToNozzleExecutable, append([]string{"validate"}, args...)...)
+		command.Env = append(os.Environ(), env...)
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		return session
+	}
+
+	It("prints the effective config with the secrets masked", func() {
+		session := validate([]string{"NOZZLE_OPENTSDBBEARERTOKEN=tsd-token"}, "-config", "fixtures/http-test-config.json")
+
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(session.Out).To(gbytes.Say(`"Password": "\*\*\*\*\*\*\*\*"`))
+		Expect(session.Out).To(gbytes.Say(`"OpenTSDBBearerToken": "\*\*\*\*\*\*\*\*"`))
+		Expect(session.Out.Contents()).NotTo(ContainSubstring("UAA-password"))
+		Expect(session.Out.Contents()).NotTo(ContainSubstring("tsd-token"))
+		Expect(session.Err).To(gbytes.Say("The configuration is valid"))
+	})
+
+	It("lists the problems of an invalid config", func() {
+		session := validate([]string{"NOZZLE_FLUSHDURATIONSECONDS=0", "NOZZLE_USETELNETAPI=true"}, "-config", "fixtures/http-test-config.json")
+
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(session.Err).To(gbytes.Say("invalid configuration:"))
+		Expect(session.Err).To(gbytes.Say("FlushDurationSeconds must be positive"))
+		Expect(session.Err).To(gbytes.Say(`OpenTSDBURL "http://localhost:8087" is a URL but UseTelnetAPI is set`))
+	})
+
+	It("fails when the config file can not be read", func() {
+		session := validate(nil, "-config", "fixtures/missing.json")
+
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(session.Err).To(gbytes.Say("Error parsing config: Can not read config file"))
+	})
+
+	It("exits with 2 when a service can not be reached", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		closedURL := "http://" + listener.Addr().String()
+		listener.Close()
+
+		session := validate([]string{"NOZZLE_OPENTSDBURL=" + closedURL}, "-config", "fixtures/http-test-config.json", "-check-connectivity", "-timeout", "1s")
+
+		Eventually(session, 10).Should(gexec.Exit(2))
+		Expect(session.Err).To(gbytes.Say("FAIL OpenTSDB opentsdb " + closedURL))
+	})
+})